@@ -12,16 +12,23 @@
 package client
 
 import (
+	"bufio"
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
+	"net/http"
+	"os"
 	"rpc_test/codec"
+	"rpc_test/metadata"
 	"rpc_test/server"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -32,12 +39,35 @@ type Call struct {
 	Reply         interface{}
 	Error         error
 	Done          chan *Call
+	Trailer       metadata.MD     // 服务端随响应返回的元数据
+	ctx           context.Context // 调用的context，其截止时间和元数据会随请求发送给服务端
+	mu            sync.Mutex      // 保护abandoned和WithTrailer指定的接收变量
+	abandoned     bool            // Client.Call 已经因为context结束而返回，不再写入接收变量
 }
 
 func (call *Call) done() {
 	call.Done <- call
 }
 
+// setTrailer 保存响应携带的元数据，调用方通过metadata.WithTrailer指定了接收变量时一并写入
+func (call *Call) setTrailer(md map[string]string) {
+	call.Trailer = md
+	if receiver := metadata.TrailerReceiver(call.ctx); receiver != nil {
+		call.mu.Lock()
+		defer call.mu.Unlock()
+		if !call.abandoned {
+			*receiver = call.Trailer
+		}
+	}
+}
+
+// abandon 调用方不再等待结果，之后到达的响应不会再写入调用方的变量
+func (call *Call) abandon() {
+	call.mu.Lock()
+	call.abandoned = true
+	call.mu.Unlock()
+}
+
 /*
 Client代表一个RPC客户端。单个 Client 可能有多个相关联的调用，一个Client可能同时被多个goroutine使用。
 Client结构体中：
@@ -47,6 +77,7 @@ Client结构体中：
 	pending 用于存储未处理完的请求的哈希表，键是编号，值是Call对象。
 	losing 和shutdown 任意一个值置为true，则表示Client处于不可用的状态，
 但是closing是用户主动关闭的，即调用 Close() 方法，而shutdown置为 true一般是有错误发生。
+	draining 表示收到了服务端关闭时发送的GoAway消息，不再发送新的请求，等待中的调用全部结束后关闭连接。
 */
 
 type Client struct {
@@ -59,6 +90,11 @@ type Client struct {
 	pending  map[uint64]*Call
 	closing  bool
 	shutdown bool
+	draining bool
+	// handshake 服务端的握手应答
+	handshake *server.Handshake
+	// interceptors 通过Use注册的拦截器，见interceptor.go
+	interceptors atomic.Pointer[[]Interceptor]
 }
 
 type clientResult struct {
@@ -78,20 +114,34 @@ func (client *Client) Close() error {
 		return ErrorShutDown
 	}
 	client.closing = true
+	// 服务端正在关闭时，等待中的调用仍然会得到回复，连接在它们全部结束后关闭
+	if client.draining && len(client.pending) > 0 {
+		return nil
+	}
 	return client.cc.Close()
 }
 
 func (client *Client) IsAvailable() bool {
 	client.mu.Lock()
 	defer client.mu.Unlock()
-	return !(client.shutdown || client.closing)
+	return !(client.shutdown || client.closing || client.draining)
+}
+
+// closeIfDrained 收到GoAway消息并且等待中的调用全部结束时关闭连接
+func (client *Client) closeIfDrained() {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	if client.draining && len(client.pending) == 0 && !client.shutdown {
+		client.shutdown = true
+		_ = client.cc.Close()
+	}
 }
 
 // registerCall 将参数 call 添加到 client.pending 中，并更新 client.seq。
 func (client *Client) registerCall(call *Call) (uint64, error) {
 	client.mu.Lock()
 	defer client.mu.Unlock()
-	if client.closing || client.shutdown {
+	if client.closing || client.shutdown || client.draining {
 		return 0, ErrorShutDown
 	}
 	call.Seq = client.seq
@@ -124,14 +174,27 @@ func (client *Client) terminateCall(err error) {
 
 func (client *Client) receive() {
 	var err error
+	var h codec.Header // 所有消息共用，避免每条消息分配一次
 	for err == nil {
-		var h codec.Header
+		h = codec.Header{}
 		// 读取消息头出错，结束处理
 		if err = client.cc.ReadHeader(&h); err != nil {
 			break
 		}
+		// 服务端正在关闭，不再发送新的请求
+		if h.ServiceMethod == codec.GoAwayServiceMethod {
+			err = client.cc.ReadBody(nil)
+			client.mu.Lock()
+			client.draining = true
+			client.mu.Unlock()
+			client.closeIfDrained()
+			continue
+		}
 
 		call := client.removeCall(h.Seq)
+		if call != nil {
+			call.setTrailer(h.Metadata)
+		}
 
 		switch {
 		// 服务端返回的call不存在，可能是因为服务端已经处理过了或者是返回的消息出错
@@ -139,36 +202,169 @@ func (client *Client) receive() {
 			err = client.cc.ReadBody(nil)
 		// 消息头部错误
 		case h.Error != "":
-			call.Error = fmt.Errorf(h.Error)
+			call.Error = serverError(h.Error)
 			err = client.cc.ReadBody(nil)
 			call.done()
 		// 读取消息体Body到call.Reply中进一步处理
 		default:
 			err = client.cc.ReadBody(call.Reply)
 			if err != nil {
-				call.Error = errors.New("reading body: " + err.Error())
+				call.Error = fmt.Errorf("reading body: %w", err)
+			}
+			// 消息已经被完整读取或者跳过，只是无法反序列化到Reply中，连接仍然可以继续使用
+			if errors.Is(err, codec.ErrInvalidBody) || errors.Is(err, codec.ErrMessageTooLarge) {
+				err = nil
 			}
 			call.done()
 		}
+		client.closeIfDrained()
 	}
 	client.terminateCall(err)
 }
 
+// serverErrors 服务端可能返回的错误，客户端还原为对应的错误，调用方可以使用errors.Is判断
+var serverErrors = []error{codec.ErrMessageTooLarge, codec.ErrInvalidBody}
+
+// serverError 将服务端返回的错误消息转换为error
+func serverError(msg string) error {
+	for _, known := range serverErrors {
+		if strings.HasPrefix(msg, known.Error()) {
+			return fmt.Errorf("%w%s", known, strings.TrimPrefix(msg, known.Error()))
+		}
+	}
+	return errors.New(msg)
+}
+
 // NewClient 创建Client对象，同时与服务端协商好协议Option
 func NewClient(conn net.Conn, opt *server.Option) (*Client, error) {
-	f := codec.NewCodecFuncMap[opt.CodecType]
-	if f == nil {
+	f, ok := codec.Lookup(opt.CodecType)
+	if !ok {
 		err := fmt.Errorf("invaild codec type %s", opt.CodecType)
 		log.Println("rpc client: codec error: ", err)
 		return nil, err
 	}
+	if opt.Compression != codec.CompressionNone && codec.CompressorMap[opt.Compression] == nil {
+		err := fmt.Errorf("invalid compression %s", opt.Compression)
+		log.Println("rpc client: codec error: ", err)
+		return nil, err
+	}
 
 	if err := json.NewEncoder(conn).Encode(opt); err != nil {
 		log.Println("rpc client: options error: ", err)
 		_ = conn.Close()
 		return nil, err
 	}
-	return newClientCodec(f(conn), opt), nil
+	if opt.Version < 1 {
+		if opt.MaxResponseSize > 0 {
+			_ = conn.Close()
+			return nil, errors.New("rpc client: MaxResponseSize requires a framed connection, not LegacyVersion")
+		}
+		return newClientCodec(f(conn), opt), nil
+	}
+	ack, err := readHandshakeTimeout(conn, opt.ConnectionTimeout)
+	if err == nil && ack.Error != "" {
+		err = fmt.Errorf("%w: %s", ErrHandshake, ack.Error)
+	}
+	if err == nil && ack.Version < 1 {
+		err = fmt.Errorf("%w: unsupported protocol version %d", ErrHandshake, ack.Version)
+	}
+	if err != nil {
+		log.Println("rpc client: handshake error: ", err)
+		_ = conn.Close()
+		return nil, err
+	}
+	cc, err := ack.NewCodec(conn)
+	if err != nil {
+		log.Println("rpc client: codec error: ", err)
+		_ = conn.Close()
+		return nil, err
+	}
+	// 客户端自己的限制不依赖服务端的应答，服务端返回0（不限制）时同样生效
+	if l, ok := cc.(codec.Limiter); ok {
+		l.SetMaxReadSize(minSize(opt.MaxResponseSize, ack.MaxResponseSize))
+		l.SetMaxWriteSize(ack.MaxRequestSize)
+	} else if opt.MaxResponseSize > 0 {
+		_ = conn.Close()
+		err = fmt.Errorf("%w: MaxResponseSize requires a framed connection, server negotiated version %d with %s",
+			ErrHandshake, ack.Version, ack.CodecType)
+		log.Println("rpc client: handshake error: ", err)
+		return nil, err
+	}
+	client := newClientCodec(cc, opt)
+	client.handshake = ack
+	return client, nil
+}
+
+// minSize 返回两个大小限制中较小的一个，0表示不限制
+func minSize(a, b int) int {
+	if a == 0 || (b != 0 && b < a) {
+		return b
+	}
+	return a
+}
+
+// ErrHandshake 服务端拒绝了客户端的Option，或者握手应答不合法
+var ErrHandshake = errors.New("rpc client: handshake failed")
+
+// maxHandshakeSize 握手应答的最大长度
+const maxHandshakeSize = 64 << 10
+
+/*
+handshakeTimeout 等待握手应答的最长时间，ConnectionTimeout 更短时使用ConnectionTimeout。
+它比默认的ConnectionTimeout短，旧的服务端不回复应答时先得到明确的握手错误，而不是连接超时
+*/
+var handshakeTimeout = 5 * time.Second
+
+/*
+readHandshakeTimeout 在读取超时的限制下读取握手应答，ConnectionTimeout 为0时同样受handshakeTimeout的限制。
+不支持握手应答的旧服务端（引入Handshake之前的版本）永远不会回复，
+客户端无法把它和处理缓慢的新服务端区分开，所以不会自动退回版本0，
+连接这样的服务端需要显式设置Option.Version为server.LegacyVersion
+*/
+func readHandshakeTimeout(conn net.Conn, connectionTimeout time.Duration) (*server.Handshake, error) {
+	timeout := handshakeTimeout
+	if connectionTimeout > 0 && connectionTimeout < timeout {
+		timeout = connectionTimeout
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(timeout))
+	ack, err := readHandshake(conn)
+	_ = conn.SetReadDeadline(time.Time{})
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		err = fmt.Errorf("%w: no handshake reply within %s, the server may not support handshakes "+
+			"(use Option.Version server.LegacyVersion for such servers)", ErrHandshake, timeout)
+	}
+	return ack, err
+}
+
+/*
+readHandshake 读取服务端的握手应答，应答是以换行结尾的一行JSON。
+服务端在应答之后可能立即发送GoAway等消息，所以逐字节读取，不能预读应答之后的数据
+*/
+func readHandshake(conn io.Reader) (*server.Handshake, error) {
+	var line []byte
+	b := make([]byte, 1)
+	for {
+		if _, err := io.ReadFull(conn, b); err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrHandshake, err)
+		}
+		if b[0] == '\n' {
+			break
+		}
+		if len(line) >= maxHandshakeSize {
+			return nil, fmt.Errorf("%w: response too large", ErrHandshake)
+		}
+		line = append(line, b[0])
+	}
+	var ack server.Handshake
+	if err := json.Unmarshal(line, &ack); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrHandshake, err)
+	}
+	return &ack, nil
+}
+
+// Handshake 返回服务端的握手应答，服务端不支持握手应答（Option.Version为0）时返回nil
+func (client *Client) Handshake() *server.Handshake {
+	return client.handshake
 }
 
 func newClientCodec(f codec.Codec, opt *server.Option) *Client {
@@ -178,6 +374,10 @@ func newClientCodec(f codec.Codec, opt *server.Option) *Client {
 		opt:     opt,
 		pending: make(map[uint64]*Call),
 	}
+	if len(opt.Interceptors) > 0 {
+		interceptors := append([]Interceptor(nil), opt.Interceptors...)
+		client.interceptors.Store(&interceptors)
+	}
 	go client.receive()
 	return client
 }
@@ -185,15 +385,35 @@ func newClientCodec(f codec.Codec, opt *server.Option) *Client {
 // parseOptions 解析Option字段，以便后续Dial建立连接
 func parseOptions(opts ...*server.Option) (*server.Option, error) {
 	if len(opts) == 0 || opts[0] == nil {
-		return server.DefaultOption, nil
+		// 复制一份，协商的字段不会修改共享的DefaultOption
+		opt := *server.DefaultOption
+		opts = []*server.Option{&opt}
 	}
 	if len(opts) > 1 {
 		return nil, errors.New("number of options is more than 1")
 	}
 	opt := opts[0]
 	opt.MagicNumber = server.DefaultOption.MagicNumber
+	// 没有指定编解码方式时由服务端选择；CodecType 是首选，不支持协商的旧服务端直接使用它
 	if opt.CodecType == "" {
-		opt.CodecType = server.DefaultOption.CodecType
+		if len(opt.CodecTypes) == 0 {
+			opt.CodecTypes = codec.Types()
+		}
+		// 只提供客户端自己支持的编解码方式
+		supported := make([]codec.Type, 0, len(opt.CodecTypes))
+		for _, t := range opt.CodecTypes {
+			if _, ok := codec.Lookup(t); ok {
+				supported = append(supported, t)
+			}
+		}
+		if len(supported) == 0 {
+			return nil, fmt.Errorf("rpc client: none of the codecs %v is registered", opt.CodecTypes)
+		}
+		opt.CodecTypes = supported
+		opt.CodecType = supported[0]
+	}
+	if opt.Version == 0 {
+		opt.Version = server.ProtocolVersion
 	}
 	return opt, nil
 }
@@ -215,7 +435,8 @@ func dialTimeout(f newClientFunc, network, address string, opts ...*server.Optio
 		}
 	}()
 
-	ch := make(chan clientResult)
+	// 超时之后没有人接收结果，带缓冲的channel使协程可以退出
+	ch := make(chan clientResult, 1)
 	go func() {
 		client, err := f(conn, opt)
 		ch <- clientResult{client, err}
@@ -223,14 +444,18 @@ func dialTimeout(f newClientFunc, network, address string, opts ...*server.Optio
 	// 超时时间限制为0
 	if opt.ConnectionTimeout == 0 {
 		result := <-ch
+		err = result.err
 		return result.client, result.err
 	}
 
 	select {
 	case result := <-ch:
+		err = result.err
 		return result.client, result.err
 	case <-time.After(opt.ConnectionTimeout):
-		return nil, fmt.Errorf("rpc client: connection timeout: expect within %s", opt.ConnectionTimeout)
+		// 关闭连接，使等待握手应答的f返回
+		err = fmt.Errorf("rpc client: connection timeout: expect within %s", opt.ConnectionTimeout)
+		return nil, err
 	}
 }
 
@@ -239,6 +464,86 @@ func Dial(network, address string, opts ...*server.Option) (client *Client, err
 	return dialTimeout(NewClient, network, address, opts...)
 }
 
+// NewHTTPClient 先向服务端发送CONNECT请求，服务端接管连接之后再与其协商Option
+func NewHTTPClient(conn net.Conn, opt *server.Option) (*Client, error) {
+	_, _ = io.WriteString(conn, fmt.Sprintf("CONNECT %s HTTP/1.0\n\n", server.DefaultRPCPath))
+
+	// 服务端在收到Option之前不会再发送数据，所以bufio.Reader不会读走后续的消息
+	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: http.MethodConnect})
+	if err == nil && resp.Status == server.Connected {
+		return NewClient(conn, opt)
+	}
+	if err == nil {
+		err = errors.New("unexpected HTTP response: " + resp.Status)
+	}
+	return nil, err
+}
+
+// DialHTTP 通过HTTP CONNECT与服务端建立连接，服务端需要调用HandleHTTP
+func DialHTTP(network, address string, opts ...*server.Option) (*Client, error) {
+	return dialTimeout(NewHTTPClient, network, address, opts...)
+}
+
+/*
+newTLSClient 在f之前先完成TLS握手，握手与协商Option一样受ConnectionTimeout的限制。
+opt.TLSConfig 没有指定ServerName时，使用地址中的主机名验证服务端证书
+*/
+func newTLSClient(f newClientFunc, address string) newClientFunc {
+	return func(conn net.Conn, opt *server.Option) (*Client, error) {
+		config := &tls.Config{}
+		if opt.TLSConfig != nil {
+			config = opt.TLSConfig.Clone()
+		}
+		if config.ServerName == "" {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return nil, err
+			}
+			config.ServerName = host
+		}
+		tlsConn := tls.Client(conn, config)
+		if err := tlsConn.Handshake(); err != nil {
+			return nil, fmt.Errorf("rpc client: tls handshake error: %w", err)
+		}
+		return f(tlsConn, opt)
+	}
+}
+
+// DialTLS 通过TLS与服务端建立连接，证书的验证方式由opt.TLSConfig决定
+func DialTLS(network, address string, opts ...*server.Option) (*Client, error) {
+	return dialTimeout(newTLSClient(NewClient, address), network, address, opts...)
+}
+
+/*
+XDial 根据rpcAddr中的协议选择建立连接的方式，rpcAddr的格式为 protocol@addr，例如：
+
+	tcp@10.0.0.1:9999
+	unix@/run/svc.sock
+	http@10.0.0.1:7001  服务端调用了HandleHTTP，通过HTTP CONNECT建立连接
+	tls@10.0.0.5:8443
+
+没有指定协议（不包含@）时使用tcp，兼容只保存了地址的注册中心
+*/
+func XDial(rpcAddr string, opts ...*server.Option) (*Client, error) {
+	protocol, addr := "tcp", rpcAddr
+	if i := strings.Index(rpcAddr, "@"); i >= 0 {
+		protocol, addr = rpcAddr[:i], rpcAddr[i+1:]
+	}
+	if addr == "" {
+		return nil, fmt.Errorf("rpc client: wrong format '%s', expect protocol@addr", rpcAddr)
+	}
+	switch protocol {
+	case "tcp", "tcp4", "tcp6", "unix":
+		return Dial(protocol, addr, opts...)
+	case "http":
+		return DialHTTP("tcp", addr, opts...)
+	case "tls":
+		return DialTLS("tcp", addr, opts...)
+	default:
+		return nil, fmt.Errorf("rpc client: unsupported protocol '%s' in '%s'", protocol, rpcAddr)
+	}
+}
+
 // send 客户端发送请求
 func (client *Client) send(call *Call) {
 	client.sending.Lock()
@@ -256,6 +561,17 @@ func (client *Client) send(call *Call) {
 	client.header.ServiceMethod = call.ServiceMethod
 	client.header.Seq = seq
 	client.header.Error = ""
+	client.header.Timeout = 0
+	client.header.Metadata, _ = metadata.FromOutgoingContext(call.ctx)
+	if deadline, ok := call.ctx.Deadline(); ok {
+		client.header.Timeout = time.Until(deadline)
+		if client.header.Timeout <= 0 {
+			client.removeCall(seq)
+			call.Error = errors.New("rpc client: call failed: " + context.DeadlineExceeded.Error())
+			call.done()
+			return
+		}
+	}
 
 	// encode and send request
 	if err := client.cc.Write(&client.header, call.Args); err != nil {
@@ -271,8 +587,16 @@ func (client *Client) send(call *Call) {
 /*
 Go 和 Call 是客户端暴露给用户的两个RPC服务调用接口，Go是一个异步接口，返回call实例。
 Call 是对 Go 的封装，阻塞call.Done，等待响应返回，是一个同步接口。
+GoContext 与 Go 相同，但是 ctx 的截止时间会随请求发送给服务端，作为服务端处理该请求的超时，
+ctx 中通过metadata.NewOutgoingContext附加的元数据也会随请求发送。
+三者都会执行通过Use注册的拦截器。
 */
 func (client *Client) Go(serviceMethod string, args, reply interface{}, done chan *Call) *Call {
+	return client.GoContext(context.Background(), serviceMethod, args, reply, done)
+}
+
+func (client *Client) GoContext(ctx context.Context, serviceMethod string, args, reply interface{},
+	done chan *Call) *Call {
 	if done == nil {
 		done = make(chan *Call, 10)
 	} else if cap(done) == 0 {
@@ -283,18 +607,82 @@ func (client *Client) Go(serviceMethod string, args, reply interface{}, done cha
 		Args:          args,
 		Reply:         reply,
 		Done:          done,
+		ctx:           ctx,
+	}
+	interceptors := client.loadInterceptors()
+	if len(interceptors) == 0 {
+		client.send(call)
+		return call
+	}
+	// 拦截器是同步的，在单独的协程中执行，最内层发起真正的调用并等待响应
+	invoker := chain(interceptors, func(ctx context.Context, serviceMethod string, args, reply interface{}) error {
+		finished, err := client.wait(ctx, client.goContext(ctx, serviceMethod, args, reply))
+		if finished != nil {
+			call.Seq, call.Trailer = finished.Seq, finished.Trailer
+		}
+		return err
+	})
+	go func() {
+		call.Error = invoker(ctx, serviceMethod, args, reply)
+		call.done()
+	}()
+	return call
+}
+
+// goContext 不经过拦截器直接发送请求
+func (client *Client) goContext(ctx context.Context, serviceMethod string, args, reply interface{}) *Call {
+	call := &Call{
+		ServiceMethod: serviceMethod,
+		Args:          args,
+		Reply:         reply,
+		Done:          make(chan *Call, 1),
+		ctx:           ctx,
 	}
 	client.send(call)
 	return call
 }
 
+// Call 依次执行通过Use注册的拦截器，先注册的在外层，最后发起调用并等待响应。
 func (client *Client) Call(ctx context.Context, serviceMethod string, args, reply interface{}) error {
-	call := client.Go(serviceMethod, args, reply, make(chan *Call, 1))
+	if interceptors := client.loadInterceptors(); len(interceptors) > 0 {
+		return chain(interceptors, client.call)(ctx, serviceMethod, args, reply)
+	}
+	return client.call(ctx, serviceMethod, args, reply)
+}
+
+func (client *Client) call(ctx context.Context, serviceMethod string, args, reply interface{}) error {
+	_, err := client.wait(ctx, client.goContext(ctx, serviceMethod, args, reply))
+	return err
+}
+
+// wait 等待call完成并返回它；ctx先结束时放弃调用，通知服务端取消请求，返回的call为nil
+func (client *Client) wait(ctx context.Context, call *Call) (*Call, error) {
 	select {
 	case call := <-call.Done:
-		return call.Error
+		return call, call.Error
 	case <-ctx.Done():
-		client.removeCall(call.Seq)
-		return errors.New("rpc client: call failed: " + ctx.Err().Error())
+		// receive 可能已经取出了call，正在处理响应，返回之前确保它不再写入trailer的接收变量
+		call.abandon()
+		// 调用仍在等待响应时，通知服务端取消该请求
+		if client.removeCall(call.Seq) != nil {
+			client.sendCancel(call.Seq)
+			client.closeIfDrained()
+		}
+		return nil, errors.New("rpc client: call failed: " + ctx.Err().Error())
+	}
+}
+
+// sendCancel 发送取消消息，服务端收到后会取消 seq 对应请求的context
+func (client *Client) sendCancel(seq uint64) {
+	client.sending.Lock()
+	defer client.sending.Unlock()
+
+	client.header.ServiceMethod = codec.CancelServiceMethod
+	client.header.Seq = seq
+	client.header.Error = ""
+	client.header.Timeout = 0
+	client.header.Metadata = nil
+	if err := client.cc.Write(&client.header, struct{}{}); err != nil {
+		log.Println("rpc client: send cancel error: ", err)
 	}
 }
@@ -0,0 +1,103 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+
+	"rpc_test/server"
+)
+
+// Echo 原样返回参数，用于基准测试
+type Echo int
+
+func (e Echo) Echo(args []byte, reply *[]byte) error {
+	*reply = args
+	return nil
+}
+
+// EchoArgs 不包含引用类型的值参数，服务端可以复用它的内存
+type EchoArgs struct {
+	A, B int
+	Name string
+}
+
+func (e Echo) Sum(args EchoArgs, reply *int) error {
+	*reply = args.A + args.B
+	return nil
+}
+
+/*
+BenchmarkCall 测试一次完整调用（客户端编码、服务端解码、调用方法、回复、客户端解码）的耗时和内存分配，
+small 是16字节的参数，large 是64KB的参数；stream 使用不分帧的协议版本1，framed 使用默认的分帧协议
+*/
+func BenchmarkCall(b *testing.B) {
+	var e Echo
+	s := server.NewServer()
+	_ = s.Register(&e)
+	l, _ := net.Listen("tcp", ":0")
+	go s.Accept(l)
+	b.Cleanup(func() { _ = s.Close() })
+
+	protocols := []struct {
+		name    string
+		version int
+	}{{"stream", 1}, {"framed", server.ProtocolVersion}}
+	payloads := []struct {
+		name string
+		size int
+	}{{"small", 16}, {"large", 64 << 10}}
+	for _, p := range protocols {
+		client, err := Dial("tcp", l.Addr().String(), &server.Option{Version: p.version})
+		if err != nil {
+			b.Fatal(err)
+		}
+		for _, payload := range payloads {
+			args := bytes.Repeat([]byte{'x'}, payload.size)
+			b.Run(p.name+"/"+payload.name, func(b *testing.B) {
+				b.ReportAllocs()
+				b.SetBytes(int64(payload.size))
+				var reply []byte
+				for i := 0; i < b.N; i++ {
+					if err := client.Call(context.Background(), "Echo.Echo", args, &reply); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+		_ = client.Close()
+	}
+}
+
+// BenchmarkCall_Struct 参数是值传递的结构体，服务端复用解码参数的内存（reusableArgv）
+func BenchmarkCall_Struct(b *testing.B) {
+	var e Echo
+	s := server.NewServer()
+	_ = s.Register(&e)
+	l, _ := net.Listen("tcp", ":0")
+	go s.Accept(l)
+	b.Cleanup(func() { _ = s.Close() })
+
+	protocols := []struct {
+		name    string
+		version int
+	}{{"stream", 1}, {"framed", server.ProtocolVersion}}
+	for _, p := range protocols {
+		client, err := Dial("tcp", l.Addr().String(), &server.Option{Version: p.version})
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.Run(p.name, func(b *testing.B) {
+			b.ReportAllocs()
+			args := EchoArgs{A: 1, B: 2, Name: "bench"}
+			var reply int
+			for i := 0; i < b.N; i++ {
+				if err := client.Call(context.Background(), "Echo.Sum", args, &reply); err != nil || reply != 3 {
+					b.Fatal(reply, err)
+				}
+			}
+		})
+		_ = client.Close()
+	}
+}
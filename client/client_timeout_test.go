@@ -2,10 +2,18 @@ package client
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net"
+	"net/http"
+	"path/filepath"
+	"rpc_test/codec"
+	"rpc_test/metadata"
 	"rpc_test/server"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -28,6 +36,42 @@ func (b Bar) Timeout(argv int, reply *int) error {
 	return nil
 }
 
+var barCanceled = make(chan error, 1)
+
+// Wait 在ctx被取消时返回，并将ctx的错误发送到barCanceled
+func (b Bar) Wait(ctx context.Context, argv int, reply *int) error {
+	select {
+	case <-time.After(time.Second * 10):
+		return nil
+	case <-ctx.Done():
+		barCanceled <- ctx.Err()
+		return ctx.Err()
+	}
+}
+
+// Deadline 返回方法收到的context剩余的时间
+func (b Bar) Deadline(ctx context.Context, argv int, reply *time.Duration) error {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return errors.New("no deadline")
+	}
+	*reply = time.Until(deadline)
+	return nil
+}
+
+// Tenant 返回请求元数据中的tenant，并通过trailer返回request-id
+func (b Bar) Tenant(ctx context.Context, argv int, reply *string) error {
+	md, _ := metadata.FromIncomingContext(ctx)
+	*reply = md.Get("tenant")
+	return metadata.SetTrailer(ctx, metadata.Pairs("request-id", "42"))
+}
+
+// Repeat 返回将"x"重复argv次的字符串
+func (b Bar) Repeat(argv int, reply *string) error {
+	*reply = strings.Repeat("x", argv)
+	return nil
+}
+
 func startServer(addr chan string) {
 	var b Bar
 	_ = server.Register(&b)
@@ -68,11 +112,60 @@ func TestClient_Call(t *testing.T) {
 	time.Sleep(time.Second)
 	t.Run("client timeout", func(t *testing.T) {
 		client, _ := Dial("tcp", addr)
-		ctx, _ := context.WithTimeout(context.Background(), time.Second)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
 		var reply int
 		err := client.Call(ctx, "Bar.Timeout", 1, &reply)
 		_assert(err != nil && strings.Contains(err.Error(), ctx.Err().Error()), "expect a timeout error")
 	})
+	t.Run("client cancel", func(t *testing.T) {
+		client, _ := Dial("tcp", addr)
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(100*time.Millisecond, cancel)
+		var reply int
+		err := client.Call(ctx, "Bar.Wait", 1, &reply)
+		_assert(err != nil && strings.Contains(err.Error(), ctx.Err().Error()), "expect a canceled error")
+		select {
+		case err := <-barCanceled:
+			_assert(errors.Is(err, context.Canceled), "expect context canceled but got %v", err)
+		case <-time.After(time.Second):
+			t.Fatal("server handler was not canceled")
+		}
+	})
+	t.Run("deadline propagation", func(t *testing.T) {
+		client, _ := Dial("tcp", addr)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		var remaining time.Duration
+		err := client.Call(ctx, "Bar.Deadline", 1, &remaining)
+		_assert(err == nil && remaining > 0 && remaining <= time.Second,
+			"expect the server to see the client deadline, got %s, %v", remaining, err)
+
+		// 客户端没有截止时间时，方法只受服务端默认的处理超时限制
+		err = client.Call(context.Background(), "Bar.Deadline", 1, &remaining)
+		_assert(err == nil && remaining > time.Second && remaining <= server.DefaultHandlerTimeout,
+			"expect the server default handler timeout, got %s, %v", remaining, err)
+	})
+	t.Run("metadata", func(t *testing.T) {
+		client, _ := Dial("tcp", addr)
+		var trailer metadata.MD
+		ctx := metadata.NewOutgoingContext(context.Background(), metadata.Pairs("tenant", "t1"))
+		ctx = metadata.WithTrailer(ctx, &trailer)
+		var reply string
+		err := client.Call(ctx, "Bar.Tenant", 1, &reply)
+		_assert(err == nil && reply == "t1", "expect tenant t1 but got %q, %v", reply, err)
+		_assert(trailer.Get("request-id") == "42", "unexpected trailer: %v", trailer)
+
+		call := <-client.GoContext(ctx, "Bar.Tenant", 1, &reply, nil).Done
+		_assert(call.Error == nil && call.Trailer.Get("request-id") == "42", "unexpected trailer: %v", call.Trailer)
+
+		// Call 因为context结束返回之后，迟到的响应不会再写入trailer的接收变量
+		var late metadata.MD
+		abandoned := &Call{ctx: metadata.WithTrailer(context.Background(), &late)}
+		abandoned.abandon()
+		abandoned.setTrailer(metadata.Pairs("request-id", "43"))
+		_assert(late == nil && abandoned.Trailer.Get("request-id") == "43", "abandoned call wrote trailer: %v", late)
+	})
 	t.Run("server handle timeout", func(t *testing.T) {
 		client, _ := Dial("tcp", addr, &server.Option{
 			HandlerTimeout: time.Second,
@@ -82,3 +175,393 @@ func TestClient_Call(t *testing.T) {
 		_assert(err != nil && strings.Contains(err.Error(), "handle timeout"), "expect a timeout error")
 	})
 }
+
+func TestClient_ServerShutdown(t *testing.T) {
+	t.Parallel()
+	var b Bar
+	s := server.NewServer()
+	_ = s.Register(&b)
+	l, _ := net.Listen("tcp", ":0")
+	go s.Accept(l)
+
+	client, err := Dial("tcp", l.Addr().String())
+	_assert(err == nil, "dial error: %v", err)
+	call := client.Go("Bar.Timeout", 1, new(int), nil)
+	time.Sleep(100 * time.Millisecond)
+
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- s.Shutdown(context.Background()) }()
+	time.Sleep(100 * time.Millisecond)
+	_assert(!client.IsAvailable(), "client should stop sending new calls after GoAway")
+	err = client.Call(context.Background(), "Bar.Timeout", 1, new(int))
+	_assert(errors.Is(err, ErrorShutDown), "expect shutdown error but got %v", err)
+
+	call = <-call.Done
+	_assert(call.Error == nil, "in-flight call should finish: %v", call.Error)
+	_assert(<-shutdown == nil, "shutdown error")
+}
+
+func TestClient_Interceptors(t *testing.T) {
+	t.Parallel()
+	addrCh := make(chan string)
+	go startServer(addrCh)
+	addr := <-addrCh
+
+	var mu sync.Mutex
+	var trace []string
+	logging := func(ctx context.Context, serviceMethod string, args, reply interface{}, invoker Invoker) error {
+		mu.Lock()
+		trace = append(trace, "log:"+serviceMethod)
+		mu.Unlock()
+		return invoker(ctx, serviceMethod, args, reply)
+	}
+	tenant := func(ctx context.Context, serviceMethod string, args, reply interface{}, invoker Invoker) error {
+		mu.Lock()
+		trace = append(trace, "tenant")
+		mu.Unlock()
+		return invoker(metadata.AppendToOutgoingContext(ctx, "tenant", "t2"), serviceMethod, args, reply)
+	}
+	// Option 中配置的拦截器在Use追加的之前（外层）
+	client, err := Dial("tcp", addr, &server.Option{Interceptors: []Interceptor{logging}})
+	_assert(err == nil, "dial error: %v", err)
+	client.Use(tenant)
+
+	var reply string
+	err = client.Call(context.Background(), "Bar.Tenant", 1, &reply)
+	_assert(err == nil && reply == "t2", "expect tenant injected by interceptor but got %q, %v", reply, err)
+	_assert(strings.Join(trace, ",") == "log:Bar.Tenant,tenant", "unexpected order: %v", trace)
+
+	// 异步调用同样经过拦截器，call.Trailer 来自最终的响应
+	reply = ""
+	call := <-client.Go("Bar.Tenant", 1, &reply, nil).Done
+	_assert(call.Error == nil && reply == "t2" && call.Trailer.Get("request-id") == "42",
+		"expect async call to run interceptors but got %q, %v", reply, call.Error)
+	mu.Lock()
+	_assert(len(trace) == 4, "unexpected trace: %v", trace)
+	mu.Unlock()
+
+	// 故障注入：拦截器不调用invoker，直接返回错误
+	faulty, _ := Dial("tcp", addr, &server.Option{Interceptors: []Interceptor{
+		func(ctx context.Context, serviceMethod string, args, reply interface{}, invoker Invoker) error {
+			return errors.New("injected fault")
+		},
+	}})
+	err = faulty.Call(context.Background(), "Bar.Tenant", 1, &reply)
+	_assert(err != nil && err.Error() == "injected fault", "expect injected fault but got %v", err)
+	call = <-faulty.GoContext(context.Background(), "Bar.Tenant", 1, &reply, nil).Done
+	_assert(call.Error != nil && call.Error.Error() == "injected fault", "expect injected fault but got %v", call.Error)
+}
+
+func TestClient_DialHTTP(t *testing.T) {
+	t.Parallel()
+	var b Bar
+	s := server.NewServer()
+	_ = s.Register(&b)
+	// 使用独立的mux，不修改http.DefaultServeMux，测试可以重复运行
+	mux := http.NewServeMux()
+	s.HandleHTTPMux(mux)
+	l, _ := net.Listen("tcp", ":0")
+	go func() { _ = http.Serve(l, mux) }()
+	t.Cleanup(func() { _ = l.Close() })
+
+	client, err := DialHTTP("tcp", l.Addr().String())
+	_assert(err == nil, "dial http error: %v", err)
+	defer func() { _ = client.Close() }()
+	var reply string
+	err = client.Call(context.Background(), "Bar.Tenant", 1, &reply)
+	_assert(err == nil, "call over http error: %v", err)
+
+	resp, err := http.Get("http://" + l.Addr().String() + server.DefaultDebugPath)
+	_assert(err == nil && resp.StatusCode == http.StatusOK, "debug page error: %v", err)
+	page, _ := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	_assert(strings.Contains(string(page), "Service Bar") &&
+		strings.Contains(string(page), "Tenant(ctx context.Context, int, *string)") &&
+		strings.Contains(string(page), "Repeat(int, *string)"), "unexpected debug page: %s", page)
+
+	// 没有注册RPC路径的HTTP服务不能建立RPC连接
+	plain, _ := net.Listen("tcp", ":0")
+	go func() { _ = http.Serve(plain, http.NewServeMux()) }()
+	t.Cleanup(func() { _ = plain.Close() })
+	_, err = DialHTTP("tcp", plain.Addr().String())
+	_assert(err != nil && strings.Contains(err.Error(), "404"), "expect a 404 response but got %v", err)
+}
+
+func TestClient_XDial(t *testing.T) {
+	t.Parallel()
+	var b Bar
+	s := server.NewServer()
+	_ = s.Register(&b)
+
+	tcp, _ := net.Listen("tcp", ":0")
+	go s.Accept(tcp)
+	sock := filepath.Join(t.TempDir(), "rpc.sock")
+	unix, err := net.Listen("unix", sock)
+	_assert(err == nil, "listen unix error: %v", err)
+	go s.Accept(unix)
+	web, _ := net.Listen("tcp", ":0")
+	go func() { _ = http.Serve(web, s) }()
+	t.Cleanup(func() { _ = s.Close(); _ = web.Close() })
+
+	for _, addr := range []string{
+		tcp.Addr().String(),
+		"tcp@" + tcp.Addr().String(),
+		"unix@" + sock,
+		"http@" + web.Addr().String(),
+	} {
+		client, err := XDial(addr)
+		_assert(err == nil, "%s: dial error: %v", addr, err)
+		var reply string
+		err = client.Call(context.Background(), "Bar.Tenant", 1, &reply)
+		_assert(err == nil, "%s: call error: %v", addr, err)
+		_ = client.Close()
+	}
+
+	for _, addr := range []string{"tcp@", "quic@" + tcp.Addr().String()} {
+		_, err := XDial(addr)
+		_assert(err != nil, "%s: expect an error", addr)
+	}
+}
+
+func TestClient_Handshake(t *testing.T) {
+	t.Parallel()
+	var b Bar
+	s := server.NewServer()
+	s.HandlerTimeout = time.Minute
+	_ = s.Register(&b)
+	l, _ := net.Listen("tcp", ":0")
+	go s.Accept(l)
+	t.Cleanup(func() { _ = s.Close() })
+
+	client, err := Dial("tcp", l.Addr().String())
+	_assert(err == nil, "dial error: %v", err)
+	ack := client.Handshake()
+	_assert(ack != nil && ack.Version == server.ProtocolVersion && ack.HandlerTimeout == time.Minute,
+		"unexpected handshake: %+v", ack)
+	_ = client.Close()
+
+	// 服务端拒绝Option时，Dial立即返回服务端给出的原因
+	reject, _ := net.Listen("tcp", ":0")
+	t.Cleanup(func() { _ = reject.Close() })
+	go func() {
+		conn, err := reject.Accept()
+		if err != nil {
+			return
+		}
+		defer func() { _ = conn.Close() }()
+		var opt server.Option
+		_ = json.NewDecoder(conn).Decode(&opt)
+		_ = json.NewEncoder(conn).Encode(&server.Handshake{Version: 1, Error: "codec not allowed"})
+	}()
+	_, err = Dial("tcp", reject.Addr().String())
+	_assert(errors.Is(err, ErrHandshake) && strings.Contains(err.Error(), "codec not allowed"),
+		"expect a handshake error but got %v", err)
+
+	// 不回复握手应答的服务端，受ConnectionTimeout限制
+	silent, _ := net.Listen("tcp", ":0")
+	t.Cleanup(func() { _ = silent.Close() })
+	go func() {
+		conn, err := silent.Accept()
+		if err == nil {
+			defer func() { _ = conn.Close() }()
+			_, _ = io.Copy(io.Discard, conn)
+		}
+	}()
+	_, err = Dial("tcp", silent.Addr().String(), &server.Option{ConnectionTimeout: 100 * time.Millisecond})
+	_assert(err != nil, "expect a timeout")
+}
+
+// TestClient_HandshakeSilentServer 不回复握手应答的旧服务端，ConnectionTimeout 为0时也不会一直阻塞，错误说明了原因
+func TestClient_HandshakeSilentServer(t *testing.T) {
+	// 修改包级变量，不能与其他测试并行
+	defer func(d time.Duration) { handshakeTimeout = d }(handshakeTimeout)
+	handshakeTimeout = 100 * time.Millisecond
+
+	silent, _ := net.Listen("tcp", ":0")
+	t.Cleanup(func() { _ = silent.Close() })
+	go func() {
+		conn, err := silent.Accept()
+		if err == nil {
+			defer func() { _ = conn.Close() }()
+			_, _ = io.Copy(io.Discard, conn)
+		}
+	}()
+	_, err := Dial("tcp", silent.Addr().String(), &server.Option{ConnectionTimeout: 0})
+	_assert(errors.Is(err, ErrHandshake) && strings.Contains(err.Error(), "LegacyVersion"),
+		"expect a handshake timeout but got %v", err)
+
+	// LegacyVersion 不等待握手应答，新的服务端同样按照版本0处理
+	var b Bar
+	s := server.NewServer()
+	_ = s.Register(&b)
+	l, _ := net.Listen("tcp", ":0")
+	go s.Accept(l)
+	t.Cleanup(func() { _ = s.Close() })
+	client, err := Dial("tcp", l.Addr().String(), &server.Option{Version: server.LegacyVersion, CodecType: codec.GobType})
+	_assert(err == nil && client.Handshake() == nil, "legacy dial error: %v", err)
+	var reply string
+	_assert(client.Call(context.Background(), "Bar.Repeat", 2, &reply) == nil, "legacy call")
+}
+
+// TestClient_InvalidReply 回复无法反序列化到Reply时，只有这次调用失败，连接继续可用
+func TestClient_InvalidReply(t *testing.T) {
+	t.Parallel()
+	var b Bar
+	s := server.NewServer()
+	_ = s.Register(&b)
+	l, _ := net.Listen("tcp", ":0")
+	go s.Accept(l)
+	t.Cleanup(func() { _ = s.Close() })
+
+	client, err := Dial("tcp", l.Addr().String())
+	_assert(err == nil, "dial error: %v", err)
+	defer func() { _ = client.Close() }()
+	_assert(client.Handshake().Version == server.FramingVersion, "expect a framed connection")
+
+	var wrong int
+	err = client.Call(context.Background(), "Bar.Tenant", 1, &wrong)
+	_assert(err != nil && strings.Contains(err.Error(), "reading body"), "expect a body error but got %v", err)
+	_assert(client.IsAvailable(), "client should stay available")
+	var reply string
+	err = client.Call(context.Background(), "Bar.Tenant", 1, &reply)
+	_assert(err == nil, "call after an invalid reply error: %v", err)
+}
+
+func TestClient_MessageSizeLimits(t *testing.T) {
+	t.Parallel()
+	var b Bar
+	s := server.NewServer()
+	s.MaxRequestSize = 1024
+	s.MaxResponseSize = 4096
+	_ = s.Register(&b)
+	l, _ := net.Listen("tcp", ":0")
+	go s.Accept(l)
+	t.Cleanup(func() { _ = s.Close() })
+
+	client, err := Dial("tcp", l.Addr().String(), &server.Option{MaxResponseSize: 2048})
+	_assert(err == nil, "dial error: %v", err)
+	defer func() { _ = client.Close() }()
+	ack := client.Handshake()
+	_assert(ack.MaxRequestSize == 1024 && ack.MaxResponseSize == 2048, "unexpected limits: %+v", ack)
+
+	// 请求超过服务端的限制，在发送之前失败
+	var reply string
+	err = client.Call(context.Background(), "Bar.Tenant", strings.Repeat("x", 2048), &reply)
+	_assert(errors.Is(err, codec.ErrMessageTooLarge), "expect ErrMessageTooLarge but got %v", err)
+
+	// 响应超过客户端的限制，服务端回复错误
+	err = client.Call(context.Background(), "Bar.Repeat", 3000, &reply)
+	_assert(errors.Is(err, codec.ErrMessageTooLarge), "expect ErrMessageTooLarge but got %v", err)
+
+	_assert(client.IsAvailable(), "client should stay available")
+	err = client.Call(context.Background(), "Bar.Repeat", 10, &reply)
+	_assert(err == nil && reply == "xxxxxxxxxx", "call within limits: %q, %v", reply, err)
+}
+
+// TestClient_OwnMaxResponseSize 服务端在应答中不限制响应大小时，客户端仍然执行自己的MaxResponseSize
+func TestClient_OwnMaxResponseSize(t *testing.T) {
+	t.Parallel()
+	l, _ := net.Listen("tcp", ":0")
+	t.Cleanup(func() { _ = l.Close() })
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer func() { _ = conn.Close() }()
+		var opt server.Option
+		_ = json.NewDecoder(conn).Decode(&opt)
+		ack := &server.Handshake{Version: server.FramingVersion, CodecType: codec.GobType}
+		_ = json.NewEncoder(conn).Encode(ack)
+		cc, _ := ack.NewCodec(conn)
+		var h codec.Header
+		for cc.ReadHeader(&h) == nil {
+			_ = cc.ReadBody(nil)
+			_ = cc.Write(&h, strings.Repeat("x", 4096))
+		}
+	}()
+
+	client, err := Dial("tcp", l.Addr().String(), &server.Option{MaxResponseSize: 1024})
+	_assert(err == nil, "dial error: %v", err)
+	defer func() { _ = client.Close() }()
+	var reply string
+	err = client.Call(context.Background(), "Bar.Repeat", 1, &reply)
+	_assert(errors.Is(err, codec.ErrMessageTooLarge), "expect ErrMessageTooLarge but got %v", err)
+
+	// 不分帧的连接无法执行限制，直接拒绝
+	_, err = Dial("tcp", l.Addr().String(), &server.Option{MaxResponseSize: 1024, Version: server.LegacyVersion})
+	_assert(err != nil && strings.Contains(err.Error(), "requires a framed connection"), "unexpected error %v", err)
+}
+
+func TestClient_Compression(t *testing.T) {
+	t.Parallel()
+	var b Bar
+	s := server.NewServer()
+	s.MaxResponseSize = 1 << 20
+	_ = s.Register(&b)
+	l, _ := net.Listen("tcp", ":0")
+	go s.Accept(l)
+	t.Cleanup(func() { _ = s.Close() })
+
+	for typ := range codec.CompressorMap {
+		client, err := Dial("tcp", l.Addr().String(), &server.Option{Compression: typ})
+		_assert(err == nil, "%s: dial error: %v", typ, err)
+		_assert(client.Handshake().Compression == typ, "%s: unexpected handshake %+v", typ, client.Handshake())
+		var reply string
+		err = client.Call(context.Background(), "Bar.Repeat", 100000, &reply)
+		_assert(err == nil && len(reply) == 100000, "%s: call error: %v", typ, err)
+		_ = client.Close()
+	}
+
+	_, err := Dial("tcp", l.Addr().String(), &server.Option{Compression: "lz4"})
+	_assert(err != nil, "expect an error for unknown compression")
+}
+
+func TestClient_NegotiateCodec(t *testing.T) {
+	t.Parallel()
+	var b Bar
+	s := server.NewServer()
+	_ = s.Register(&b)
+	l, _ := net.Listen("tcp", ":0")
+	go s.Accept(l)
+	t.Cleanup(func() { _ = s.Close() })
+
+	client, err := Dial("tcp", l.Addr().String())
+	_assert(err == nil, "dial error: %v", err)
+	_assert(client.Handshake().CodecType == codec.GobType, "expect gob by default: %+v", client.Handshake())
+	_ = client.Close()
+	_assert(server.DefaultOption.CodecType == "", "DefaultOption should not be modified")
+
+	client, err = Dial("tcp", l.Addr().String(), &server.Option{
+		CodecTypes: []codec.Type{"application/x-unknown", codec.JsonType},
+	})
+	_assert(err == nil, "dial error: %v", err)
+	_assert(client.Handshake().CodecType == codec.JsonType, "expect json: %+v", client.Handshake())
+	var reply string
+	err = client.Call(context.Background(), "Bar.Tenant", 1, &reply)
+	_assert(err == nil, "call over negotiated codec: %v", err)
+	_ = client.Close()
+}
+
+// TestClient_Codecs 每种注册的编解码方式在分帧和不分帧的连接上都可以使用
+func TestClient_Codecs(t *testing.T) {
+	t.Parallel()
+	var b Bar
+	s := server.NewServer()
+	_ = s.Register(&b)
+	l, _ := net.Listen("tcp", ":0")
+	go s.Accept(l)
+	t.Cleanup(func() { _ = s.Close() })
+
+	for _, typ := range codec.Types() {
+		for _, version := range []int{1, server.ProtocolVersion} {
+			client, err := Dial("tcp", l.Addr().String(), &server.Option{CodecType: typ, Version: version})
+			_assert(err == nil, "dial error: %v", err)
+			_assert(client.Handshake().CodecType == typ, "expect %s: %+v", typ, client.Handshake())
+			var reply string
+			err = client.Call(context.Background(), "Bar.Repeat", 3, &reply)
+			_assert(err == nil && reply == "xxx", "call over %s version %d: %q %v", typ, version, reply, err)
+			_ = client.Close()
+		}
+	}
+}
@@ -0,0 +1,56 @@
+/*
+interceptor.go 实现了客户端的拦截器，包装每一次调用，用于日志、认证信息注入、监控、故障注入等通用逻辑。
+拦截器通过 Option.Interceptors 在Dial时配置（xclient.NewXClient 的Option会传给它创建的每一个Client），
+也可以在发起第一次调用之前通过 Client.Use 追加。先注册的在外层，
+可以通过 metadata 包读取或追加随请求发送的元数据，不调用 invoker 而直接返回错误则中止本次调用。
+Call 在调用方的协程中执行拦截器；Go 和 GoContext 在注册了拦截器时启动一个协程执行拦截器，
+拦截器全部返回之后才通过call.Done通知调用方。
+*/
+
+package client
+
+import (
+	"context"
+)
+
+// Invoker 发起一次RPC调用
+type Invoker = func(ctx context.Context, serviceMethod string, args, reply interface{}) error
+
+// Interceptor 客户端拦截器，invoker 执行后续的拦截器并真正发起调用；与Option.Interceptors的元素是同一个类型
+type Interceptor = func(ctx context.Context, serviceMethod string, args, reply interface{}, invoker Invoker) error
+
+/*
+Use 在Option.Interceptors之后追加拦截器，对之后发起的调用生效。
+应该在发起第一次调用之前调用：已经开始的调用不会经过新的拦截器，Use 之前发起的调用完全没有拦截器，
+通常应该通过Option.Interceptors在创建时配置
+*/
+func (client *Client) Use(interceptors ...Interceptor) {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	// 写时复制，发起调用时不需要加锁
+	var all []Interceptor
+	if p := client.interceptors.Load(); p != nil {
+		all = append(all, *p...)
+	}
+	all = append(all, interceptors...)
+	client.interceptors.Store(&all)
+}
+
+// loadInterceptors 返回注册的拦截器，没有拦截器时调用方不需要构造invoker闭包
+func (client *Client) loadInterceptors() []Interceptor {
+	if p := client.interceptors.Load(); p != nil {
+		return *p
+	}
+	return nil
+}
+
+// chain 用拦截器包装invoker，先注册的在最外层
+func chain(interceptors []Interceptor, invoker Invoker) Invoker {
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, next := interceptors[i], invoker
+		invoker = func(ctx context.Context, serviceMethod string, args, reply interface{}) error {
+			return interceptor(ctx, serviceMethod, args, reply, next)
+		}
+	}
+	return invoker
+}
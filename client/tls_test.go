@@ -0,0 +1,141 @@
+package client
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"rpc_test/server"
+	"testing"
+	"time"
+)
+
+// testCA 测试中生成的自签名CA，用来签发服务端和客户端证书
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	_assert(err == nil, "generate key: %v", err)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "rpc test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	_assert(err == nil, "create ca: %v", err)
+	cert, _ := x509.ParseCertificate(der)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &testCA{cert: cert, key: key, pool: pool}
+}
+
+// issue 签发一个CommonName为cn的证书，服务端证书对127.0.0.1有效
+func (ca *testCA) issue(t *testing.T, cn string, usage x509.ExtKeyUsage) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	_assert(err == nil, "generate key: %v", err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	_assert(err == nil, "issue %s: %v", cn, err)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+type Whoami int
+
+// Identity 返回客户端证书的CommonName
+func (w Whoami) Identity(ctx context.Context, argv int, reply *string) error {
+	peer, ok := server.PeerFromContext(ctx)
+	if !ok || peer.Addr == nil || peer.TLS == nil {
+		*reply = "<no tls peer>"
+		return nil
+	}
+	*reply = peer.Identity()
+	return nil
+}
+
+// startTLSServer 启动一个TLS服务端，返回监听地址
+func startTLSServer(t *testing.T, config *tls.Config) string {
+	var w Whoami
+	s := server.NewServer()
+	_ = s.Register(&w)
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	go s.AcceptTLS(l, config)
+	t.Cleanup(func() { _ = s.Close() })
+	return l.Addr().String()
+}
+
+func TestClient_TLS(t *testing.T) {
+	t.Parallel()
+	ca := newTestCA(t)
+	serverCert := ca.issue(t, "server", x509.ExtKeyUsageServerAuth)
+	addr := startTLSServer(t, &tls.Config{Certificates: []tls.Certificate{serverCert}})
+
+	client, err := DialTLS("tcp", addr, &server.Option{TLSConfig: &tls.Config{RootCAs: ca.pool}})
+	_assert(err == nil, "dial tls error: %v", err)
+	var identity string
+	err = client.Call(context.Background(), "Whoami.Identity", 1, &identity)
+	_assert(err == nil && identity == "", "expect an anonymous tls peer but got %q, %v", identity, err)
+	_ = client.Close()
+
+	// 不信任服务端证书时握手失败
+	_, err = DialTLS("tcp", addr, &server.Option{TLSConfig: &tls.Config{RootCAs: x509.NewCertPool()}})
+	_assert(err != nil, "expect an unknown authority error")
+
+	client, err = XDial("tls@"+addr, &server.Option{TLSConfig: &tls.Config{RootCAs: ca.pool}})
+	_assert(err == nil, "xdial tls error: %v", err)
+	err = client.Call(context.Background(), "Whoami.Identity", 1, &identity)
+	_assert(err == nil, "call over xdial tls error: %v", err)
+	_ = client.Close()
+}
+
+func TestClient_MutualTLS(t *testing.T) {
+	t.Parallel()
+	ca := newTestCA(t)
+	serverCert := ca.issue(t, "server", x509.ExtKeyUsageServerAuth)
+	clientCert := ca.issue(t, "alice", x509.ExtKeyUsageClientAuth)
+	addr := startTLSServer(t, &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    ca.pool,
+	})
+
+	client, err := DialTLS("tcp", addr, &server.Option{TLSConfig: &tls.Config{
+		RootCAs:      ca.pool,
+		Certificates: []tls.Certificate{clientCert},
+	}})
+	_assert(err == nil, "dial mtls error: %v", err)
+	var identity string
+	err = client.Call(context.Background(), "Whoami.Identity", 1, &identity)
+	_assert(err == nil && identity == "alice", "expect peer identity alice but got %q, %v", identity, err)
+	_ = client.Close()
+
+	// 没有客户端证书时，服务端拒绝连接；TLS 1.3中客户端在握手之后的第一次读取才会发现
+	client, err = DialTLS("tcp", addr, &server.Option{TLSConfig: &tls.Config{RootCAs: ca.pool}})
+	if err == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		err = client.Call(ctx, "Whoami.Identity", 1, &identity)
+		_ = client.Close()
+	}
+	_assert(err != nil, "expect the server to reject a client without certificate")
+}
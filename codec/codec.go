@@ -4,20 +4,50 @@ codec.go 提供了消息序列化与反序列化的接口，其内嵌一个io.Cl
 方法ReadHeader 用于读取消息的头部信息，并将读取的结果存储到给定的‘Header变量中；
 方法ReadBody 用于读取消息的主体部分，并将读取的结果存储到给定的接口类型变量中；
 方法Write 用于将消息的头部信息和主体部分写入到数据流中。三者均包括错误信息error
-gob.go 提供了Gob（Go binary）的序列化与反序列化方法，你可以根据自己的需求完成JSON方法的实现
+gob.go 提供了Gob（Go binary）的序列化与反序列化方法
+json.go 提供了JSON的序列化与反序列化方法，便于非Go语言的工具接入
+msgpack.go 提供了MessagePack的序列化与反序列化方法，比JSON更紧凑，同样便于非Go语言的服务接入
+protobuf.go 提供了与protobuf二进制格式兼容的序列化与反序列化方法，根据结构体的tag编码，不需要生成的代码
+frame.go 提供了分帧的消息格式，每条消息带有长度前缀，单条消息的错误不会影响后续的消息
+compress.go snappy.go 提供了分帧时消息体的压缩算法
+编解码方式通过Register注册，Lookup 查找，客户端可以与服务端协商使用双方都支持的编解码方式
+新的编解码器应该通过codectest包中的一致性测试
 */
 
 package codec
 
-import "io"
+import (
+	"io"
+	"sync"
+	"time"
+)
 
 // Header 消息头结构体
 type Header struct {
-	ServiceMethod string // 调用服务和方法的名称，格式为：Service.Method
-	Seq           uint64 // 客户端调用序列，用于区分不同的调用
-	Error         string // 错误消息
+	// ServiceMethod 调用服务和方法的名称，格式为：Service.Method
+	ServiceMethod string `protobuf:"bytes,1,opt,name=service_method,proto3"`
+	// Seq 客户端调用序列，用于区分不同的调用
+	Seq uint64 `protobuf:"varint,2,opt,name=seq,proto3"`
+	// Error 错误消息
+	Error string `protobuf:"bytes,3,opt,name=error,proto3"`
+	// Timeout 请求剩余的处理时间，来自客户端context的截止时间，0表示没有截止时间
+	Timeout time.Duration `protobuf:"varint,4,opt,name=timeout,proto3"`
+	// Metadata 请求中是客户端附加的元数据，响应中是方法设置的trailer，见metadata包
+	Metadata map[string]string `protobuf:"bytes,5,rep,name=metadata,proto3" protobuf_key:"bytes,1,opt,name=key,proto3" protobuf_val:"bytes,2,opt,name=value,proto3"`
 }
 
+/*
+CancelServiceMethod 是保留的ServiceMethod，客户端用它通知服务端取消Seq对应的请求。
+取消消息的Body是一个空结构体，服务端不会回复取消消息本身。
+*/
+const CancelServiceMethod = "_rpc.Cancel"
+
+/*
+GoAwayServiceMethod 是保留的ServiceMethod，服务端关闭时用它通知客户端不要再发送新的请求，
+已经发出的请求仍然会得到回复。GoAway消息的Seq为0，不对应任何请求，Body是一个空结构体。
+*/
+const GoAwayServiceMethod = "_rpc.GoAway"
+
 // Codec 消息序列化与反序列化的接口
 type Codec interface {
 	io.Closer
@@ -31,14 +61,137 @@ type NewCodecFunc func(writer io.ReadWriteCloser) Codec
 type Type string
 
 const (
-	GobType  Type = "application/gob"
-	JsonType Type = "application/json"
+	GobType      Type = "application/gob"
+	JsonType     Type = "application/json"
+	MsgpackType  Type = "application/msgpack"
+	ProtobufType Type = "application/x-protobuf"
+)
+
+var (
+	registryMu sync.RWMutex
+	codecs     = make(map[Type]NewCodecFunc)
+	marshalers = make(map[Type]Marshaler)
+	types      []Type // 按照注册的顺序，也是客户端协商时的优先顺序
 )
 
-// NewCodecFuncMap 两种序列化方式的构造函数
-var NewCodecFuncMap map[Type]NewCodecFunc
+/*
+NewCodecFuncMap 已注册的编解码器构造函数，与Register、Lookup使用同一个map，内容始终一致。
+
+Deprecated: 使用Register和Lookup。直接读写这个map不是并发安全的，
+直接写入的编解码器可以被Lookup找到，但是不会出现在Types()中，客户端不会在协商时提供它。
+*/
+var NewCodecFuncMap = codecs
 
 func init() {
-	NewCodecFuncMap = make(map[Type]NewCodecFunc)
-	NewCodecFuncMap[GobType] = NewGobCodec
+	Register(GobType, NewGobCodec)
+	Register(JsonType, NewJsonCodec)
+	Register(MsgpackType, NewMsgpackCodec)
+	Register(ProtobufType, NewProtobufCodec)
+	RegisterMarshaler(GobType, gobMarshaler{})
+	RegisterMarshaler(JsonType, jsonMarshaler{})
+	RegisterMarshaler(MsgpackType, msgpackMarshaler{})
+	RegisterMarshaler(ProtobufType, protobufMarshaler{})
+}
+
+/*
+Register 注册t对应的编解码器构造函数，可以在多个协程中并发调用。
+f 为nil或者t已经注册过时panic，与database/sql.Register一致，通常在init中调用
+*/
+func Register(t Type, f NewCodecFunc) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if f == nil {
+		panic("rpc codec: Register codec is nil")
+	}
+	if _, dup := codecs[t]; dup {
+		panic("rpc codec: Register called twice for codec " + string(t))
+	}
+	codecs[t] = f
+	types = append(types, t)
+}
+
+// RegisterMarshaler 注册t对应的Marshaler，注册之后t可以用于分帧的FrameCodec；t需要先通过Register注册
+func RegisterMarshaler(t Type, m Marshaler) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if m == nil {
+		panic("rpc codec: RegisterMarshaler marshaler is nil")
+	}
+	if _, ok := codecs[t]; !ok {
+		panic("rpc codec: RegisterMarshaler called for unregistered codec " + string(t))
+	}
+	if _, dup := marshalers[t]; dup {
+		panic("rpc codec: RegisterMarshaler called twice for codec " + string(t))
+	}
+	marshalers[t] = m
+}
+
+// Lookup 返回t对应的编解码器构造函数
+func Lookup(t Type) (NewCodecFunc, bool) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	f, ok := codecs[t]
+	return f, ok
+}
+
+// LookupMarshaler 返回t对应的Marshaler，t不支持分帧时返回false
+func LookupMarshaler(t Type) (Marshaler, bool) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	m, ok := marshalers[t]
+	return m, ok
+}
+
+// Types 按照注册的顺序返回所有已注册的编解码方式
+func Types() []Type {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	return append([]Type(nil), types...)
+}
+
+/*
+appendN 从r中读取n个字节追加到dst，按块读取，不会因为伪造的长度一次分配大量内存。
+数据不足n个字节时返回io.ErrUnexpectedEOF
+*/
+func appendN(dst []byte, r io.Reader, n int) ([]byte, error) {
+	const chunk = 32 << 10
+	for n > 0 {
+		size := n
+		if size > chunk {
+			size = chunk
+		}
+		start := len(dst)
+		dst = append(dst, make([]byte, size)...)
+		if _, err := io.ReadFull(r, dst[start:]); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return dst, err
+		}
+		n -= size
+	}
+	return dst, nil
+}
+
+// maxPooledBuffer 大于这个容量的缓冲区用完之后不放回bufferPool，避免偶尔的大消息长期占用内存
+const maxPooledBuffer = 1 << 20
+
+// bufferPool 复用编码和读取消息时使用的缓冲区，保存*[]byte，放回时不需要额外的分配
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 0, 4096)
+		return &b
+	},
+}
+
+func getBuffer() *[]byte {
+	return bufferPool.Get().(*[]byte)
+}
+
+func putBuffer(b *[]byte) {
+	if cap(*b) > maxPooledBuffer {
+		return
+	}
+	*b = (*b)[:0]
+	bufferPool.Put(b)
 }
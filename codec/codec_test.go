@@ -0,0 +1,65 @@
+package codec
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+// restoreRegistry 保存全局注册表，在测试结束时恢复，测试注册的编解码器不会留给其他测试
+func restoreRegistry(t *testing.T) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	savedCodecs := make(map[Type]NewCodecFunc, len(codecs))
+	for typ, f := range codecs {
+		savedCodecs[typ] = f
+	}
+	savedMarshalers := make(map[Type]Marshaler, len(marshalers))
+	for typ, m := range marshalers {
+		savedMarshalers[typ] = m
+	}
+	savedTypes := append([]Type(nil), types...)
+	t.Cleanup(func() {
+		registryMu.Lock()
+		defer registryMu.Unlock()
+		// codecs 原地恢复，NewCodecFuncMap 与它是同一个map
+		clear(codecs)
+		for typ, f := range savedCodecs {
+			codecs[typ] = f
+		}
+		marshalers, types = savedMarshalers, savedTypes
+	})
+}
+
+func TestRegister(t *testing.T) {
+	restoreRegistry(t)
+	types := Types()
+	_assert(len(types) >= 2 && types[0] == GobType && types[1] == JsonType, "gob should be preferred: %v", types)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			typ := Type(fmt.Sprintf("application/x-test-%d", i))
+			Register(typ, NewJsonCodec)
+			_, ok := Lookup(typ)
+			_assert(ok, "lookup %s after Register", typ)
+			_ = Types()
+		}(i)
+	}
+	wg.Wait()
+	_assert(len(Types()) == len(types)+10, "unexpected types: %v", Types())
+	_assert(NewCodecFuncMap["application/x-test-0"] != nil && NewCodecFuncMap[GobType] != nil,
+		"deprecated NewCodecFuncMap should stay in sync with Register")
+
+	_, ok := Lookup("application/unknown")
+	_assert(!ok, "unknown codec should not be found")
+	_, ok = LookupMarshaler("application/x-test-0")
+	_assert(!ok, "codec registered without marshaler does not support framing")
+
+	defer func() {
+		_assert(recover() != nil, "Register twice should panic")
+	}()
+	Register(GobType, NewGobCodec)
+}
@@ -0,0 +1,387 @@
+/*
+codectest 包提供了codec.Codec的一致性测试，客户端的receive和服务端的readRequest依赖这些行为，
+所有编解码器（包括第三方通过codec.Register注册的）都应该通过：
+
+	func TestMyCodec(t *testing.T) {
+		codectest.Run(t, NewMyCodec)
+	}
+
+测试的内容包括：
+Header 的每个字段都被完整地传递；多条消息按照写入的顺序读出，消息体可以是结构体、map、slice、指针和time.Time；
+ReadBody(nil) 丢弃消息体，不影响后续的消息；多个协程在同一个互斥锁下并发Write（与客户端的sending一致），消息不会交错；
+数据流在任意位置被截断时返回错误，不会返回错误的数据，消息中间的截断不能返回io.EOF（服务端把它当作连接正常关闭）；
+任意的垃圾数据返回错误，不会panic，也不会一次分配大量内存；Close 关闭底层连接，之后的Write和ReadHeader返回错误。
+*/
+
+package codectest
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"reflect"
+	"runtime/debug"
+	"sync"
+	"testing"
+	"time"
+
+	"rpc_test/codec"
+)
+
+// Run 对newCodec构造的编解码器运行所有的一致性测试，每一项是一个子测试
+func Run(t *testing.T, newCodec codec.NewCodecFunc) {
+	t.Run("HeaderRoundTrip", func(t *testing.T) { testHeaderRoundTrip(t, newCodec) })
+	t.Run("Ordering", func(t *testing.T) { testOrdering(t, newCodec) })
+	t.Run("DiscardBody", func(t *testing.T) { testDiscardBody(t, newCodec) })
+	t.Run("ConcurrentWrite", func(t *testing.T) { testConcurrentWrite(t, newCodec) })
+	t.Run("Truncated", func(t *testing.T) { testTruncated(t, newCodec) })
+	t.Run("Garbage", func(t *testing.T) { testGarbage(t, newCodec) })
+	t.Run("Close", func(t *testing.T) { testClose(t, newCodec) })
+}
+
+// conn 用内存缓冲区模拟连接，写入的数据可以被再次读出，关闭之后读写都返回io.ErrClosedPipe
+type conn struct {
+	mu     sync.Mutex
+	buf    bytes.Buffer
+	closed int
+}
+
+func newConn(data []byte) *conn {
+	c := &conn{}
+	c.buf.Write(data)
+	return c
+}
+
+func (c *conn) Read(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed > 0 {
+		return 0, io.ErrClosedPipe
+	}
+	return c.buf.Read(p)
+}
+
+func (c *conn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed > 0 {
+		return 0, io.ErrClosedPipe
+	}
+	return c.buf.Write(p)
+}
+
+func (c *conn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed++
+	return nil
+}
+
+func (c *conn) bytes() []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]byte(nil), c.buf.Bytes()...)
+}
+
+// Body 覆盖结构体、map、slice、指针和time.Time，是测试中使用的消息体
+type Body struct {
+	Name  string
+	Count int
+	Ratio float64
+	Tags  []string
+	Attrs map[string]int64
+	Raw   []byte
+	Next  *Body
+	At    time.Time
+}
+
+func newBody(name string) *Body {
+	return &Body{
+		Name:  name,
+		Count: -42,
+		Ratio: 0.5,
+		Tags:  []string{"a", "b"},
+		Attrs: map[string]int64{"x": 1, "y": 1 << 40},
+		Raw:   []byte{0, 1, 2, 255},
+		Next:  &Body{Name: "inner", Count: 7, At: time.Date(1969, 7, 20, 20, 17, 0, 0, time.UTC)},
+		At:    time.Date(2024, 2, 29, 12, 30, 45, 123456789, time.UTC),
+	}
+}
+
+// Equal 比较两个Body，时间使用Equal比较，因为不同的编解码方式不一定保留时区
+func (b *Body) Equal(o *Body) bool {
+	if b == nil || o == nil {
+		return b == o
+	}
+	if !b.At.Equal(o.At) || !b.Next.Equal(o.Next) {
+		return false
+	}
+	x, y := *b, *o
+	x.At, y.At, x.Next, y.Next = time.Time{}, time.Time{}, nil, nil
+	return reflect.DeepEqual(x, y)
+}
+
+func testHeaderRoundTrip(t *testing.T, newCodec codec.NewCodecFunc) {
+	c := newCodec(newConn(nil))
+	want := codec.Header{
+		ServiceMethod: "Foo.Sum",
+		Seq:           7,
+		Error:         "boom",
+		Timeout:       time.Second,
+		Metadata:      map[string]string{"tenant": "t1", "trace-id": "abc"},
+	}
+	if err := c.Write(&want, 1); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	var got codec.Header
+	var body int
+	if err := c.ReadHeader(&got); err != nil {
+		t.Fatalf("read header: %v", err)
+	}
+	if err := c.ReadBody(&body); err != nil || body != 1 {
+		t.Fatalf("read body: %d %v", body, err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("header mismatch: got %+v, want %+v", got, want)
+	}
+}
+
+func testOrdering(t *testing.T, newCodec codec.NewCodecFunc) {
+	conn := newConn(nil)
+	w, r := newCodec(conn), newCodec(conn)
+	for seq := uint64(1); seq <= 3; seq++ {
+		if err := w.Write(&codec.Header{ServiceMethod: "Foo.Echo", Seq: seq}, newBody(fmt.Sprint(seq))); err != nil {
+			t.Fatalf("write message %d: %v", seq, err)
+		}
+	}
+	for seq := uint64(1); seq <= 3; seq++ {
+		var h codec.Header
+		var got Body
+		if err := r.ReadHeader(&h); err != nil || h.Seq != seq || h.ServiceMethod != "Foo.Echo" {
+			t.Fatalf("read header %d: %+v %v", seq, h, err)
+		}
+		if err := r.ReadBody(&got); err != nil || !newBody(fmt.Sprint(seq)).Equal(&got) {
+			t.Fatalf("read body %d: %+v %v", seq, got, err)
+		}
+	}
+	var h codec.Header
+	if err := r.ReadHeader(&h); !errors.Is(err, io.EOF) {
+		t.Fatalf("end of stream should be io.EOF, got %v", err)
+	}
+}
+
+func testDiscardBody(t *testing.T, newCodec codec.NewCodecFunc) {
+	conn := newConn(nil)
+	c := newCodec(conn)
+	for seq, body := range []interface{}{newBody("first"), "second", []int{1, 2, 3}} {
+		if err := c.Write(&codec.Header{Seq: uint64(seq + 1)}, body); err != nil {
+			t.Fatalf("write message %d: %v", seq+1, err)
+		}
+	}
+	var h codec.Header
+	var s string
+	if err := c.ReadHeader(&h); err != nil || h.Seq != 1 {
+		t.Fatalf("read first header: %+v %v", h, err)
+	}
+	if err := c.ReadBody(nil); err != nil {
+		t.Fatalf("discard first body: %v", err)
+	}
+	if err := c.ReadHeader(&h); err != nil || h.Seq != 2 {
+		t.Fatalf("read second header: %+v %v", h, err)
+	}
+	if err := c.ReadBody(&s); err != nil || s != "second" {
+		t.Fatalf("read second body: %q %v", s, err)
+	}
+	if err := c.ReadHeader(&h); err != nil || h.Seq != 3 {
+		t.Fatalf("read third header: %+v %v", h, err)
+	}
+	if err := c.ReadBody(nil); err != nil {
+		t.Fatalf("discard third body: %v", err)
+	}
+	if err := c.ReadHeader(&h); !errors.Is(err, io.EOF) {
+		t.Fatalf("end of stream should be io.EOF, got %v", err)
+	}
+}
+
+// testConcurrentWrite 多个协程在同一个互斥锁下写入，每条消息的header和body必须成对出现
+func testConcurrentWrite(t *testing.T, newCodec codec.NewCodecFunc) {
+	const writers, messages = 8, 50
+	conn := newConn(nil)
+	c := newCodec(conn)
+	var sending sync.Mutex
+	var wg sync.WaitGroup
+	errs := make(chan error, writers)
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < messages; j++ {
+				seq := uint64(i*messages + j + 1)
+				sending.Lock()
+				err := c.Write(&codec.Header{Seq: seq}, newBody(fmt.Sprint(seq)))
+				sending.Unlock()
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatalf("concurrent write: %v", err)
+	}
+
+	seen := make(map[uint64]bool)
+	for n := 0; n < writers*messages; n++ {
+		var h codec.Header
+		var body Body
+		if err := c.ReadHeader(&h); err != nil {
+			t.Fatalf("read header %d: %v", n, err)
+		}
+		if err := c.ReadBody(&body); err != nil || !newBody(fmt.Sprint(h.Seq)).Equal(&body) {
+			t.Fatalf("body of seq %d mismatch: %+v %v", h.Seq, body, err)
+		}
+		if seen[h.Seq] {
+			t.Fatalf("seq %d read twice", h.Seq)
+		}
+		seen[h.Seq] = true
+	}
+}
+
+type message struct {
+	header codec.Header
+	body   *Body
+}
+
+// testTruncated 数据流在每一个位置被截断，读出的消息必须与写入的一致，直到返回错误为止
+func testTruncated(t *testing.T, newCodec codec.NewCodecFunc) {
+	messages := []message{
+		{codec.Header{ServiceMethod: "Foo.Echo", Seq: 1, Metadata: map[string]string{"k": "v"}}, newBody("first")},
+		{codec.Header{ServiceMethod: "Foo.Echo", Seq: 2, Error: "boom"}, newBody("second")},
+	}
+	conn := newConn(nil)
+	w := newCodec(conn)
+	// boundaries[i] 是前i条消息的总长度
+	boundaries := []int{0}
+	for _, m := range messages {
+		if err := w.Write(&m.header, m.body); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		boundaries = append(boundaries, len(conn.bytes()))
+	}
+	data := conn.bytes()
+
+	for n := 0; n < len(data); n++ {
+		err := catch(func() error {
+			r := newCodec(newConn(data[:n]))
+			for i, m := range messages {
+				var h codec.Header
+				if err := r.ReadHeader(&h); err != nil {
+					// 截断发生在消息中间时不能返回io.EOF，否则服务端会把它当作连接正常关闭
+					if errors.Is(err, io.EOF) && n > boundaries[i] {
+						return fmt.Errorf("header %d: io.EOF in the middle of a message", i+1)
+					}
+					return nil
+				}
+				if !reflect.DeepEqual(h, m.header) {
+					return fmt.Errorf("header %d mismatch: %+v", i+1, h)
+				}
+				var body Body
+				if err := r.ReadBody(&body); err != nil {
+					return nil
+				}
+				if !m.body.Equal(&body) {
+					return fmt.Errorf("body %d mismatch: %+v", i+1, body)
+				}
+			}
+			// 两条消息都被完整读出，截断的只能是消息末尾的分隔符
+			if n < boundaries[len(boundaries)-1]-1 {
+				return errors.New("all messages decoded from truncated stream")
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("truncated at %d of %d bytes: %v", n, len(data), err)
+		}
+	}
+}
+
+// garbage 返回测试用的垃圾数据，随机数据使用固定的种子，保证每次运行的结果相同
+func garbage() [][]byte {
+	inputs := [][]byte{
+		{0},
+		{0xff},
+		bytes.Repeat([]byte{0}, 64),
+		bytes.Repeat([]byte{0xff}, 64),
+		bytes.Repeat([]byte{0x7f}, 64),
+		[]byte("{\"ServiceMethod\":"),
+		[]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"),
+	}
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 200; i++ {
+		b := make([]byte, 1+rnd.Intn(256))
+		rnd.Read(b)
+		inputs = append(inputs, b)
+	}
+	return inputs
+}
+
+// testGarbage 垃圾数据最终返回错误，不会panic
+func testGarbage(t *testing.T, newCodec codec.NewCodecFunc) {
+	for _, data := range garbage() {
+		err := catch(func() error {
+			r := newCodec(newConn(data))
+			// 每次成功的读取至少消耗一个字节，因此读取的次数不会超过数据的长度
+			for i := 0; i <= len(data); i++ {
+				var h codec.Header
+				if err := r.ReadHeader(&h); err != nil {
+					return nil
+				}
+				var body Body
+				if err := r.ReadBody(&body); err != nil {
+					return nil
+				}
+			}
+			return errors.New("no error after reading every byte")
+		})
+		if err != nil {
+			t.Fatalf("garbage % x: %v", data, err)
+		}
+	}
+}
+
+func testClose(t *testing.T, newCodec codec.NewCodecFunc) {
+	conn := newConn(nil)
+	c := newCodec(conn)
+	if err := c.Write(&codec.Header{Seq: 1}, newBody("before close")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := c.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	if conn.closed != 1 {
+		t.Fatalf("Close should close the connection once, closed %d times", conn.closed)
+	}
+	if err := c.Write(&codec.Header{Seq: 2}, newBody("after close")); err == nil {
+		t.Fatalf("write after Close should fail")
+	}
+	var h codec.Header
+	if err := c.ReadHeader(&h); err == nil {
+		t.Fatalf("read after Close should fail")
+	}
+	_ = catch(func() error { return c.Close() })
+}
+
+// catch 调用f，将panic转换为带有调用栈的错误
+func catch(f func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v\n%s", r, debug.Stack())
+		}
+	}()
+	return f()
+}
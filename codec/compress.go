@@ -0,0 +1,129 @@
+/*
+compress.go 提供了消息体的压缩算法，在握手时协商，只用于分帧的FrameCodec：
+超过阈值的body在发送时压缩，压缩之后变小才使用压缩的结果，并在帧的flags中标记；
+接收方在ReadBody时解压，解压之后的大小同样受到最大消息大小的限制，防止压缩炸弹；
+没有设置最大消息大小时，gzip和deflate解压之后不能超过DefaultMaxDecompressedSize，snappy 不能超过压缩前声明的长度。
+
+	gzip    compress/gzip
+	deflate compress/flate
+	snappy  snappy.go 中实现的snappy块格式，压缩率较低，但是速度快得多
+*/
+
+package codec
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// CompressionType 压缩算法的名称，为空表示不压缩
+type CompressionType string
+
+const (
+	CompressionNone    CompressionType = ""
+	CompressionGzip    CompressionType = "gzip"
+	CompressionDeflate CompressionType = "deflate"
+	CompressionSnappy  CompressionType = "snappy"
+)
+
+// DefaultCompressThreshold 默认只压缩不小于1KB的body，太小的body压缩之后通常不会变小
+const DefaultCompressThreshold = 1024
+
+// Compressor 压缩算法
+type Compressor interface {
+	Compress(src []byte) ([]byte, error)
+	// Decompress 解压src，解压之后超过limit返回ErrMessageTooLarge，limit 小于等于0时使用实现自己的上限
+	Decompress(src []byte, limit int) ([]byte, error)
+}
+
+// Compressing 支持压缩消息体的编解码器，threshold 为0时使用DefaultCompressThreshold
+type Compressing interface {
+	SetCompressor(c Compressor, threshold int)
+}
+
+// CompressorMap 支持的压缩算法
+var CompressorMap = map[CompressionType]Compressor{
+	CompressionGzip:    gzipCompressor{},
+	CompressionDeflate: deflateCompressor{},
+	CompressionSnappy:  snappyCompressor{},
+}
+
+/*
+DefaultMaxDecompressedSize 没有设置最大消息大小时，gzip和deflate解压之后的上限。
+deflate 的压缩率最高可以超过1000倍，不设上限时很小的帧就能让接收方分配大量内存
+*/
+const DefaultMaxDecompressedSize = 64 << 20
+
+// maxDecompressedSize limit 小于等于0时readAllLimit使用的上限，测试时可以调小
+var maxDecompressedSize = DefaultMaxDecompressedSize
+
+// readAllLimit 读取r中的全部数据，超过limit返回ErrMessageTooLarge，limit 小于等于0时使用DefaultMaxDecompressedSize
+func readAllLimit(r io.Reader, limit int) ([]byte, error) {
+	if limit <= 0 {
+		limit = maxDecompressedSize
+	}
+	data, err := io.ReadAll(io.LimitReader(r, int64(limit)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > limit {
+		return nil, fmt.Errorf("%w: decompressed body exceeds limit %d", ErrMessageTooLarge, limit)
+	}
+	return data, nil
+}
+
+// gzipWriters 复用gzip.Writer，每个Writer内部有数百KB的状态
+var gzipWriters = sync.Pool{New: func() interface{} { return gzip.NewWriter(nil) }}
+
+type gzipCompressor struct{}
+
+func (gzipCompressor) Compress(src []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzipWriters.Get().(*gzip.Writer)
+	defer gzipWriters.Put(w)
+	w.Reset(&buf)
+	if _, err := w.Write(src); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gzipCompressor) Decompress(src []byte, limit int) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(src))
+	if err != nil {
+		return nil, err
+	}
+	return readAllLimit(r, limit)
+}
+
+var flateWriters = sync.Pool{New: func() interface{} {
+	w, _ := flate.NewWriter(nil, flate.DefaultCompression)
+	return w
+}}
+
+type deflateCompressor struct{}
+
+func (deflateCompressor) Compress(src []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := flateWriters.Get().(*flate.Writer)
+	defer flateWriters.Put(w)
+	w.Reset(&buf)
+	if _, err := w.Write(src); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (deflateCompressor) Decompress(src []byte, limit int) ([]byte, error) {
+	return readAllLimit(flate.NewReader(bytes.NewReader(src)), limit)
+}
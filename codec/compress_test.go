@@ -0,0 +1,186 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+// compressInputs 覆盖空数据、短数据、随机数据、重复数据以及超过64字节的重叠匹配
+func compressInputs() map[string][]byte {
+	r := rand.New(rand.NewSource(1))
+	random := make([]byte, 100000)
+	r.Read(random)
+	mixed := make([]byte, 0, 200000)
+	for len(mixed) < 200000 {
+		if r.Intn(2) == 0 {
+			mixed = append(mixed, random[:r.Intn(300)]...)
+		} else {
+			mixed = append(mixed, strings.Repeat(string(rune('a'+r.Intn(26))), r.Intn(300))...)
+		}
+	}
+	return map[string][]byte{
+		"empty":  {},
+		"short":  []byte("abc"),
+		"random": random,
+		"runs":   bytes.Repeat([]byte("a"), 100000),
+		"text":   []byte(strings.Repeat("the quick brown fox jumps over the lazy dog. ", 2000)),
+		"mixed":  mixed,
+	}
+}
+
+func TestCompressor_RoundTrip(t *testing.T) {
+	for typ, c := range CompressorMap {
+		for name, input := range compressInputs() {
+			compressed, err := c.Compress(input)
+			_assert(err == nil, "%s %s: compress error: %v", typ, name, err)
+			output, err := c.Decompress(compressed, 0)
+			_assert(err == nil && bytes.Equal(input, output), "%s %s: round trip mismatch: %v", typ, name, err)
+			if name == "runs" || name == "text" {
+				_assert(len(compressed) < len(input)/10, "%s %s: expect a good ratio but got %d/%d",
+					typ, name, len(compressed), len(input))
+			}
+		}
+	}
+}
+
+func TestCompressor_DecompressLimit(t *testing.T) {
+	input := bytes.Repeat([]byte("a"), 100000)
+	for typ, c := range CompressorMap {
+		compressed, _ := c.Compress(input)
+		_, err := c.Decompress(compressed, 1000)
+		_assert(errors.Is(err, ErrMessageTooLarge), "%s: expect ErrMessageTooLarge but got %v", typ, err)
+		_, err = c.Decompress(compressed, len(input))
+		_assert(err == nil, "%s: decompress within limit: %v", typ, err)
+	}
+}
+
+func TestCompressor_DecompressDefaultLimit(t *testing.T) {
+	// 很小的压缩数据解压之后超过默认上限，没有设置limit时也必须拒绝
+	defer func(n int) { maxDecompressedSize = n }(maxDecompressedSize)
+	maxDecompressedSize = 1 << 20
+	bomb := make([]byte, maxDecompressedSize+1)
+	for _, typ := range []CompressionType{CompressionGzip, CompressionDeflate} {
+		c := CompressorMap[typ]
+		compressed, _ := c.Compress(bomb)
+		_, err := c.Decompress(compressed, 0)
+		_assert(errors.Is(err, ErrMessageTooLarge), "%s: expect ErrMessageTooLarge but got %v", typ, err)
+		output, err := c.Decompress(compressed, len(bomb))
+		_assert(err == nil && len(output) == len(bomb), "%s: explicit limit overrides the default: %v", typ, err)
+	}
+}
+
+func TestSnappy_Format(t *testing.T) {
+	// 长度10，literal "a"，然后是offset为1、长度为9的copy
+	output, err := snappyDecode([]byte{0x0a, 0x00, 'a', 0x15, 0x01}, 0)
+	_assert(err == nil && string(output) == "aaaaaaaaaa", "decode %q, %v", output, err)
+
+	for _, corrupt := range [][]byte{
+		{},
+		{0x0a, 0x00, 'a'},                    // 长度不足
+		{0x02, 0x00, 'a', 0x05, 0x02},        // offset 超过已解压的数据
+		{0x05, 0x10, 'a'},                    // literal 超出输入
+		{0xff, 0xff, 0xff, 0xff, 0x0f, 0x00}, // 伪造的原始长度
+	} {
+		_, err := snappyDecode(corrupt, 0)
+		_assert(err != nil, "expect an error for %x", corrupt)
+	}
+
+	// 随机输入不能导致panic
+	r := rand.New(rand.NewSource(2))
+	for i := 0; i < 10000; i++ {
+		garbage := make([]byte, r.Intn(64))
+		r.Read(garbage)
+		_, _ = snappyDecode(garbage, 0)
+	}
+}
+
+func TestFrameCodec_Compression(t *testing.T) {
+	for typ, c := range CompressorMap {
+		conn := new(bufferConn)
+		w := NewFrameCodec(conn, gobMarshaler{})
+		w.(Compressing).SetCompressor(c, 0)
+		big := strings.Repeat("compressible ", 1000)
+		_ = w.Write(&Header{Seq: 1}, big)
+		_assert(conn.Bytes()[0] == frameCompressed && conn.Len() < len(big)/4,
+			"%s: body should be compressed, frame of %d bytes", typ, conn.Len())
+		_ = w.Write(&Header{Seq: 2}, "small")
+		_ = w.Write(&Header{Seq: 3}, big)
+
+		r := NewFrameCodec(conn, gobMarshaler{})
+		r.(Compressing).SetCompressor(c, 0)
+		var h Header
+		var body string
+		_assert(r.ReadHeader(&h) == nil && r.ReadBody(&body) == nil && body == big, "%s: read compressed body", typ)
+		_assert(r.ReadHeader(&h) == nil && r.ReadBody(&body) == nil && body == "small", "%s: read small body", typ)
+
+		// 解压之后的大小同样受到限制
+		r.(Limiter).SetMaxReadSize(4096)
+		_assert(r.ReadHeader(&h) == nil && h.Seq == 3, "%s: compressed frame is within the wire limit", typ)
+		err := r.ReadBody(&body)
+		_assert(errors.Is(err, ErrMessageTooLarge), "%s: expect ErrMessageTooLarge but got %v", typ, err)
+	}
+
+	// 没有协商压缩算法时，不接受压缩的帧
+	conn := new(bufferConn)
+	w := NewFrameCodec(conn, gobMarshaler{})
+	w.(Compressing).SetCompressor(CompressorMap[CompressionSnappy], 0)
+	_ = w.Write(&Header{Seq: 1}, strings.Repeat("compressible ", 1000))
+	err := NewFrameCodec(conn, gobMarshaler{}).ReadHeader(&Header{})
+	_assert(err != nil, "expect an error for a compressed frame without compressor")
+}
+
+// benchmarkPayload 模拟一个较大的回复：结构体切片的gob编码
+func benchmarkPayload(b *testing.B) []byte {
+	type record struct {
+		ID    int
+		Name  string
+		Tags  []string
+		Score float64
+	}
+	records := make([]record, 1000)
+	for i := range records {
+		records[i] = record{ID: i, Name: fmt.Sprintf("user-%d", i), Tags: []string{"alpha", "beta"}, Score: float64(i) / 3}
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(records); err != nil {
+		b.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// BenchmarkCompress 比较各个压缩算法的速度，ratio 是压缩之后与压缩之前大小的比例
+func BenchmarkCompress(b *testing.B) {
+	payload := benchmarkPayload(b)
+	for _, typ := range []CompressionType{CompressionGzip, CompressionDeflate, CompressionSnappy} {
+		c := CompressorMap[typ]
+		b.Run(string(typ), func(b *testing.B) {
+			b.SetBytes(int64(len(payload)))
+			b.ReportAllocs()
+			var compressed []byte
+			for i := 0; i < b.N; i++ {
+				compressed, _ = c.Compress(payload)
+			}
+			b.ReportMetric(float64(len(compressed))/float64(len(payload)), "ratio")
+		})
+	}
+}
+
+func BenchmarkDecompress(b *testing.B) {
+	payload := benchmarkPayload(b)
+	for _, typ := range []CompressionType{CompressionGzip, CompressionDeflate, CompressionSnappy} {
+		c := CompressorMap[typ]
+		compressed, _ := c.Compress(payload)
+		b.Run(string(typ), func(b *testing.B) {
+			b.SetBytes(int64(len(payload)))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				_, _ = c.Decompress(compressed, 0)
+			}
+		})
+	}
+}
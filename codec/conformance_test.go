@@ -0,0 +1,22 @@
+package codec_test
+
+import (
+	"io"
+	"testing"
+
+	"rpc_test/codec"
+	"rpc_test/codec/codectest"
+)
+
+// TestConformance 所有注册的编解码器，以及支持分帧的编解码器对应的FrameCodec，都需要通过一致性测试
+func TestConformance(t *testing.T) {
+	for _, typ := range codec.Types() {
+		newCodec, _ := codec.Lookup(typ)
+		t.Run(string(typ), func(t *testing.T) { codectest.Run(t, newCodec) })
+		if m, ok := codec.LookupMarshaler(typ); ok {
+			t.Run("frame "+string(typ), func(t *testing.T) {
+				codectest.Run(t, func(conn io.ReadWriteCloser) codec.Codec { return codec.NewFrameCodec(conn, m) })
+			})
+		}
+	}
+}
@@ -0,0 +1,252 @@
+/*
+frame.go 实现了分帧的消息格式FrameCodec，每条消息是一个独立的帧：
+
+	| flags 1 byte | header length 4 bytes | body length 4 bytes | header | body |
+
+长度都是大端序的uint32，header和body分别由Marshaler独立编码，不依赖前后的消息。
+ReadHeader 会把整帧读入，所以即使body无法反序列化到给定的类型，也只影响这一条消息，
+ReadBody 返回ErrInvalidBody，后续的消息依然可以正确读取。
+Write 在写入之前完成编码，编码失败时不会向连接写入任何数据。
+flags 的最低位表示body使用协商的压缩算法压缩过（见compress.go），其余的位保留给以后的扩展，必须为0。
+
+FrameCodec 实现了Limiter，可以限制读取和写入的消息大小（header与body长度之和）：
+读取时只有body超过限制，则跳过body而不分配内存，ReadBody 返回ErrMessageTooLarge，连接可以继续使用；
+header本身超过限制时ReadHeader返回ErrMessageTooLarge，此时无法得知Seq，连接不能继续使用。
+写入时超过限制返回ErrMessageTooLarge，不会写入任何数据。
+*/
+
+package codec
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+)
+
+// frameHeaderSize 帧头的长度：flags、header长度、body长度
+const frameHeaderSize = 9
+
+// frameCompressed flags中表示body被压缩的位
+const frameCompressed = 0x01
+
+// ErrInvalidBody 消息体无法反序列化到给定的值，分帧的编解码器已经读完这条消息，连接可以继续使用
+var ErrInvalidBody = errors.New("rpc codec: invalid body")
+
+// ErrMessageTooLarge 消息的大小超过了Limiter设置的限制
+var ErrMessageTooLarge = errors.New("rpc codec: message too large")
+
+// Limiter 可以限制消息大小的编解码器，n为0表示不限制
+type Limiter interface {
+	SetMaxReadSize(n int)
+	SetMaxWriteSize(n int)
+}
+
+// Marshaler 将单个值编码为独立的字节序列，用于FrameCodec
+type Marshaler interface {
+	Marshal(v interface{}) ([]byte, error)
+	// Unmarshal 将data解码到v中，v必须是指针；data 的内存会被复用，返回之后不能再引用data
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// AppendMarshaler Marshaler 可以选择实现的接口，将v编码之后追加到dst，FrameCodec 据此复用写入的缓冲区
+type AppendMarshaler interface {
+	AppendMarshal(dst []byte, v interface{}) ([]byte, error)
+}
+
+// appendMarshal 使用m将v编码之后追加到dst
+func appendMarshal(m Marshaler, dst []byte, v interface{}) ([]byte, error) {
+	if am, ok := m.(AppendMarshaler); ok {
+		return am.AppendMarshal(dst, v)
+	}
+	data, err := m.Marshal(v)
+	if err != nil {
+		return dst, err
+	}
+	return append(dst, data...), nil
+}
+
+type FrameCodec struct {
+	conn   io.ReadWriteCloser
+	reader *bufio.Reader
+	buffer *bufio.Writer
+	m      Marshaler
+	frame  *[]byte // ReadHeader 读入的整帧，来自bufferPool，body 被读取之后放回
+	body   []byte  // ReadHeader 读入的、还没有被ReadBody读取的body
+	// bodyErr body被跳过时，ReadBody 返回的错误
+	bodyErr error
+	// compressed ReadHeader 读入的body是否被压缩，bodyLimit 是解压之后body的大小限制，0表示不限制
+	compressed bool
+	bodyLimit  int
+	// maxRead maxWrite 读取和写入的消息大小限制，0表示不限制
+	maxRead, maxWrite int
+	// compressor threshold 压缩算法和压缩的阈值，compressor 为nil时不压缩
+	compressor Compressor
+	threshold  int
+}
+
+var _ Codec = (*FrameCodec)(nil)
+var _ Limiter = (*FrameCodec)(nil)
+var _ Compressing = (*FrameCodec)(nil)
+
+func (f *FrameCodec) SetCompressor(c Compressor, threshold int) {
+	if threshold <= 0 {
+		threshold = DefaultCompressThreshold
+	}
+	f.compressor = c
+	f.threshold = threshold
+}
+
+func (f *FrameCodec) SetMaxReadSize(n int) {
+	f.maxRead = n
+}
+
+func (f *FrameCodec) SetMaxWriteSize(n int) {
+	f.maxWrite = n
+}
+
+func (f *FrameCodec) Close() error {
+	return f.conn.Close()
+}
+
+// ReadHeader 读入整帧，解码header，body留给之后的ReadBody；上一条消息的body没有被读取时直接丢弃
+func (f *FrameCodec) ReadHeader(header *Header) error {
+	f.releaseFrame()
+	var prefix [frameHeaderSize]byte
+	if _, err := io.ReadFull(f.reader, prefix[:]); err != nil {
+		return err
+	}
+	if prefix[0]&^frameCompressed != 0 || (prefix[0]&frameCompressed != 0 && f.compressor == nil) {
+		return fmt.Errorf("rpc codec: unknown frame flags %#x", prefix[0])
+	}
+	f.compressed = prefix[0]&frameCompressed != 0
+	headerLen := int(binary.BigEndian.Uint32(prefix[1:5]))
+	bodyLen := int(binary.BigEndian.Uint32(prefix[5:9]))
+	if f.maxRead > 0 && headerLen > f.maxRead {
+		return fmt.Errorf("%w: header of %d bytes exceeds limit %d", ErrMessageTooLarge, headerLen, f.maxRead)
+	}
+	size := headerLen + bodyLen
+	if f.maxRead > 0 && size > f.maxRead {
+		// 只读取header，跳过body，保证后续的消息能被正确读取
+		size = headerLen
+		f.bodyErr = fmt.Errorf("%w: %d bytes exceeds limit %d", ErrMessageTooLarge, headerLen+bodyLen, f.maxRead)
+	}
+	// 长度来自对端，按块读取，截断或者伪造的长度不会导致一次分配大量内存
+	f.frame = getBuffer()
+	data, err := appendN(*f.frame, f.reader, size)
+	*f.frame = data
+	if err != nil {
+		return err
+	}
+	if f.bodyErr != nil {
+		if _, err := io.CopyN(io.Discard, f.reader, int64(bodyLen)); err != nil {
+			return unexpectedEOF(err)
+		}
+	}
+	f.body = data[headerLen:]
+	f.bodyLimit = 0
+	if f.maxRead > 0 {
+		f.bodyLimit = f.maxRead - headerLen
+	}
+	return f.m.Unmarshal(data[:headerLen], header)
+}
+
+// releaseFrame 丢弃还没有被读取的body，将整帧的缓冲区放回bufferPool
+func (f *FrameCodec) releaseFrame() {
+	f.body, f.bodyErr = nil, nil
+	if f.frame != nil {
+		putBuffer(f.frame)
+		f.frame = nil
+	}
+}
+
+// unexpectedEOF 帧读取到一半时遇到EOF，说明数据被截断
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// ReadBody 将ReadHeader读入的body解码到i中，i为nil时丢弃
+func (f *FrameCodec) ReadBody(i interface{}) error {
+	body, bodyErr := f.body, f.bodyErr
+	defer f.releaseFrame()
+	if i == nil {
+		return nil
+	}
+	if bodyErr != nil {
+		return bodyErr
+	}
+	if f.compressed {
+		var err error
+		if body, err = f.compressor.Decompress(body, f.bodyLimit); err != nil {
+			if errors.Is(err, ErrMessageTooLarge) {
+				return err
+			}
+			return fmt.Errorf("%w: %v", ErrInvalidBody, err)
+		}
+	}
+	if err := f.m.Unmarshal(body, i); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidBody, err)
+	}
+	return nil
+}
+
+// Write 将帧头、header和body编码到bufferPool中的同一个缓冲区，一次写入
+func (f *FrameCodec) Write(header *Header, i interface{}) (err error) {
+	buf := getBuffer()
+	defer putBuffer(buf)
+	frame := append(*buf, make([]byte, frameHeaderSize)...)
+	if frame, err = appendMarshal(f.m, frame, header); err != nil {
+		log.Println("rpc codec: frame error encoding header: ", err)
+		return err
+	}
+	headerLen := len(frame) - frameHeaderSize
+	if frame, err = appendMarshal(f.m, frame, i); err != nil {
+		log.Println("rpc codec: frame error encoding body: ", err)
+		return err
+	}
+	*buf = frame
+	body := frame[frameHeaderSize+headerLen:]
+	if uint64(headerLen) > math.MaxUint32 || uint64(len(body)) > math.MaxUint32 {
+		return errors.New("rpc codec: frame too large")
+	}
+	if f.maxWrite > 0 && headerLen+len(body) > f.maxWrite {
+		return fmt.Errorf("%w: %d bytes exceeds limit %d", ErrMessageTooLarge, headerLen+len(body), f.maxWrite)
+	}
+	// 大小的限制针对压缩之前的body，与接收方解压之后的检查一致
+	if f.compressor != nil && len(body) >= f.threshold {
+		if compressed, err := f.compressor.Compress(body); err == nil && len(compressed) < len(body) {
+			frame = append(frame[:frameHeaderSize+headerLen], compressed...)
+			body = compressed
+			frame[0] |= frameCompressed
+		}
+	}
+
+	defer func() {
+		if flushErr := f.buffer.Flush(); flushErr != nil {
+			_ = f.Close()
+			if err == nil {
+				err = flushErr
+			}
+		}
+	}()
+	binary.BigEndian.PutUint32(frame[1:5], uint32(headerLen))
+	binary.BigEndian.PutUint32(frame[5:9], uint32(len(body)))
+	_, err = f.buffer.Write(frame)
+	return err
+}
+
+// NewFrameCodec 构造函数，m 决定header和body的编码方式
+func NewFrameCodec(conn io.ReadWriteCloser, m Marshaler) Codec {
+	return &FrameCodec{
+		conn:   conn,
+		reader: bufio.NewReader(conn),
+		buffer: bufio.NewWriter(conn),
+		m:      m,
+	}
+}
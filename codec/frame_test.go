@@ -0,0 +1,93 @@
+package codec
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestFrameCodec_BodyTypeMismatch(t *testing.T) {
+	for _, typ := range Types() {
+		m, ok := LookupMarshaler(typ)
+		if !ok {
+			continue
+		}
+		t.Run(string(typ), func(t *testing.T) {
+			conn := new(bufferConn)
+			c := NewFrameCodec(conn, m)
+			_ = c.Write(&Header{ServiceMethod: "Foo.Sum", Seq: 1}, "not an args struct")
+			_ = c.Write(&Header{ServiceMethod: "Foo.Sum", Seq: 2}, &jsonArgs{3, 4})
+			_ = c.Write(&Header{ServiceMethod: "Foo.Sum", Seq: 3}, &jsonArgs{5, 6})
+
+			var h Header
+			var args jsonArgs
+			_assert(c.ReadHeader(&h) == nil && h.Seq == 1, "read first header")
+			err := c.ReadBody(&args)
+			_assert(errors.Is(err, ErrInvalidBody), "expect ErrInvalidBody but got %v", err)
+
+			h = Header{}
+			_assert(c.ReadHeader(&h) == nil && h.Seq == 2, "stream should stay in sync: %+v", h)
+			_assert(c.ReadBody(&args) == nil && args.Num1 == 3 && args.Num2 == 4, "read second body: %+v", args)
+
+			// 没有读取body就读取下一个header时，body被丢弃
+			h = Header{}
+			_assert(c.ReadHeader(&h) == nil && h.Seq == 3, "read third header: %+v", h)
+			_assert(c.ReadHeader(&h) == io.EOF, "expect EOF after all messages")
+		})
+	}
+}
+
+func TestFrameCodec_Malformed(t *testing.T) {
+	conn := new(bufferConn)
+	c := NewFrameCodec(conn, gobMarshaler{})
+	_ = c.Write(&Header{ServiceMethod: "Foo.Sum", Seq: 1}, 1)
+	data := conn.Bytes()
+
+	// 帧被截断
+	truncated := new(bufferConn)
+	truncated.Write(data[:len(data)-1])
+	err := NewFrameCodec(truncated, gobMarshaler{}).ReadHeader(&Header{})
+	_assert(err == io.ErrUnexpectedEOF, "expect ErrUnexpectedEOF but got %v", err)
+
+	// 未知的flags
+	flagged := new(bufferConn)
+	flagged.Write(append([]byte{0x80}, data[1:]...))
+	err = NewFrameCodec(flagged, gobMarshaler{}).ReadHeader(&Header{})
+	_assert(err != nil && err != io.EOF, "expect an error for unknown flags")
+
+	// body编码失败时不写入任何数据
+	before := conn.Len()
+	_assert(c.Write(&Header{Seq: 2}, make(chan int)) != nil, "expect an encoding error")
+	_assert(conn.Len() == before, "nothing should be written when encoding fails")
+}
+
+func TestFrameCodec_Limits(t *testing.T) {
+	conn := new(bufferConn)
+	w := NewFrameCodec(conn, gobMarshaler{})
+	big := strings.Repeat("x", 4096)
+	_ = w.Write(&Header{ServiceMethod: "Foo.Echo", Seq: 1}, big)
+	_ = w.Write(&Header{ServiceMethod: "Foo.Echo", Seq: 2}, "small")
+
+	r := NewFrameCodec(conn, gobMarshaler{})
+	r.(Limiter).SetMaxReadSize(1024)
+	var h Header
+	var body string
+	_assert(r.ReadHeader(&h) == nil && h.Seq == 1, "header within limit should be read: %+v", h)
+	err := r.ReadBody(&body)
+	_assert(errors.Is(err, ErrMessageTooLarge), "expect ErrMessageTooLarge but got %v", err)
+	h = Header{}
+	_assert(r.ReadHeader(&h) == nil && h.Seq == 2, "stream should stay in sync: %+v", h)
+	_assert(r.ReadBody(&body) == nil && body == "small", "read second body: %q", body)
+
+	// header本身超过限制
+	_ = w.Write(&Header{ServiceMethod: big, Seq: 3}, 0)
+	err = r.ReadHeader(&h)
+	_assert(errors.Is(err, ErrMessageTooLarge), "expect ErrMessageTooLarge but got %v", err)
+
+	w.(Limiter).SetMaxWriteSize(1024)
+	before := conn.Len()
+	err = w.Write(&Header{Seq: 4}, big)
+	_assert(errors.Is(err, ErrMessageTooLarge) && conn.Len() == before, "oversized write should fail without writing")
+	_assert(w.Write(&Header{Seq: 5}, "small") == nil, "write within limit")
+}
@@ -4,15 +4,21 @@ gob.go 实现了Codec接口，采用Gob序列化方式
 conn 是由构建函数传入，通常是TCP socket，decode、encode使用gob模块中的方法
 buffer 是带缓冲的Writer，防止输入阻塞
 通过NewGobCodec 构造函数得到gob发放实现的序列化或者反序列化消息
+gobMarshaler 用于分帧的FrameCodec，每条消息独立编码，复用Encoder和Decoder以减少内存分配
 */
 
 package codec
 
 import (
 	"bufio"
+	"bytes"
+	"container/list"
 	"encoding/gob"
+	"errors"
 	"io"
 	"log"
+	"reflect"
+	"sync"
 )
 
 type GobCodec struct {
@@ -37,12 +43,14 @@ func (g *GobCodec) ReadBody(i interface{}) error {
 	return g.decode.Decode(i)
 }
 
-func (g *GobCodec) Write(header *Header, i interface{}) error {
+func (g *GobCodec) Write(header *Header, i interface{}) (err error) {
 	//TODO implement me
 	defer func() {
-		err := g.buffer.Flush()
-		if err != nil {
+		if flushErr := g.buffer.Flush(); flushErr != nil {
 			_ = g.Close()
+			if err == nil {
+				err = flushErr
+			}
 		}
 	}()
 
@@ -67,3 +75,224 @@ func NewGobCodec(conn io.ReadWriteCloser) Codec {
 		encode: gob.NewEncoder(buf),
 	}
 }
+
+/*
+gobMarshaler 将每个值编码为独立的gob流：先是值的类型定义，然后是值本身，可以单独解码。
+使用新的Encoder和Decoder处理每个值的代价很高，类型定义每次都要重新编码，接收方每次都要重新编译解码器，
+因此编码和解码都复用已经处理过类型定义的Encoder和Decoder，输出的字节与使用新的Encoder完全相同：
+
+	编码时按照Go类型缓存Encoder，第一次编码时记录类型定义，之后只编码值，拼接在类型定义之后；
+	类型中包含interface时，需要发送的类型定义取决于具体的值，不能缓存，每次使用新的Encoder。
+	解码时按照类型定义的字节缓存Decoder，已经接收过相同类型定义的Decoder只需解码值；
+	类型定义来自对端，最多缓存gobMaxDecoderKeys种，超过时淘汰最久没有使用的，
+	对端发送的无用类型定义不会永久占据缓存；超过gobMaxDecoderKey字节的不缓存。
+*/
+type gobMarshaler struct{}
+
+var _ AppendMarshaler = gobMarshaler{}
+
+const (
+	gobMaxDecoderKeys = 256
+	gobMaxDecoderKey  = 4096
+)
+
+// gobEncoder 已经发送过类型定义的Encoder，prefix 是第一次编码时输出的类型定义
+type gobEncoder struct {
+	enc    *gob.Encoder
+	w      sliceWriter
+	prefix []byte
+	primed bool
+}
+
+// gobEncoderPool 每个Go类型对应的Encoder池，cacheable 为false时类型中包含interface，不使用缓存
+type gobEncoderPool struct {
+	cacheable bool
+	pool      sync.Pool
+}
+
+// gobDecoder 已经接收过某一组类型定义的Decoder
+type gobDecoder struct {
+	dec *gob.Decoder
+	r   bytes.Reader
+}
+
+// gobDecoderCache 按照类型定义的字节缓存Decoder池，超过gobMaxDecoderKeys种时淘汰最久没有使用的
+type gobDecoderCache struct {
+	mu    sync.Mutex
+	pools map[string]*list.Element // 类型定义的字节 -> lru中的元素
+	lru   list.List                // *gobDecoderEntry，最近使用的在前面
+}
+
+type gobDecoderEntry struct {
+	key  string
+	pool sync.Pool // *gobDecoder池
+}
+
+var (
+	gobEncoders sync.Map // reflect.Type -> *gobEncoderPool
+	gobDecoders = gobDecoderCache{pools: make(map[string]*list.Element)}
+)
+
+// get 返回key对应的Decoder池，不存在时创建；被淘汰的池仍然可以被正在使用它的调用方使用
+func (c *gobDecoderCache) get(key []byte) *sync.Pool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.pools[string(key)]; ok {
+		c.lru.MoveToFront(e)
+		return &e.Value.(*gobDecoderEntry).pool
+	}
+	if c.lru.Len() >= gobMaxDecoderKeys {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.pools, oldest.Value.(*gobDecoderEntry).key)
+	}
+	entry := &gobDecoderEntry{key: string(key)}
+	c.pools[entry.key] = c.lru.PushFront(entry)
+	return &entry.pool
+}
+
+// sliceWriter 将写入的数据追加到切片中
+type sliceWriter struct {
+	b []byte
+}
+
+func (w *sliceWriter) Write(p []byte) (int, error) {
+	w.b = append(w.b, p...)
+	return len(p), nil
+}
+
+func (m gobMarshaler) Marshal(v interface{}) ([]byte, error) {
+	return m.AppendMarshal(nil, v)
+}
+
+func (gobMarshaler) AppendMarshal(dst []byte, v interface{}) ([]byte, error) {
+	t := reflect.TypeOf(v)
+	if t == nil {
+		return dst, errors.New("gob: cannot encode nil value")
+	}
+	p, ok := gobEncoders.Load(t)
+	if !ok {
+		p, _ = gobEncoders.LoadOrStore(t, &gobEncoderPool{cacheable: gobCacheable(t, make(map[reflect.Type]bool))})
+	}
+	pool := p.(*gobEncoderPool)
+	if !pool.cacheable {
+		w := sliceWriter{b: dst}
+		err := gob.NewEncoder(&w).Encode(v)
+		return w.b, err
+	}
+
+	e, _ := pool.pool.Get().(*gobEncoder)
+	if e == nil {
+		e = &gobEncoder{}
+		e.enc = gob.NewEncoder(&e.w)
+	}
+	e.w.b = e.w.b[:0]
+	// 编码失败的Encoder不再放回，它的状态可能不完整
+	if err := e.enc.Encode(v); err != nil {
+		return dst, err
+	}
+	if !e.primed {
+		start, ok := gobValueStart(e.w.b)
+		if !ok {
+			return append(dst, e.w.b...), nil
+		}
+		e.prefix = append([]byte(nil), e.w.b[:start]...)
+		e.primed = true
+		dst = append(dst, e.w.b...)
+	} else {
+		dst = append(append(dst, e.prefix...), e.w.b...)
+	}
+	if cap(e.w.b) <= maxPooledBuffer {
+		pool.pool.Put(e)
+	}
+	return dst, nil
+}
+
+func (gobMarshaler) Unmarshal(data []byte, v interface{}) error {
+	start, ok := gobValueStart(data)
+	if !ok || start > gobMaxDecoderKey {
+		return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+	}
+	pool := gobDecoders.get(data[:start])
+	d, _ := pool.Get().(*gobDecoder)
+	if d == nil {
+		// 新的Decoder先接收类型定义
+		d = &gobDecoder{}
+		d.r.Reset(data)
+		d.dec = gob.NewDecoder(&d.r)
+	} else {
+		d.r.Reset(data[start:])
+	}
+	// 解码失败的Decoder不再放回，它的状态可能不完整
+	if err := d.dec.Decode(v); err != nil {
+		return err
+	}
+	d.r.Reset(nil)
+	pool.Put(d)
+	return nil
+}
+
+// gobCacheable 类型中不包含interface时，需要发送的类型定义只取决于类型，Encoder 可以缓存
+func gobCacheable(t reflect.Type, seen map[reflect.Type]bool) bool {
+	if seen[t] {
+		return true
+	}
+	seen[t] = true
+	switch t.Kind() {
+	case reflect.Interface:
+		return false
+	case reflect.Ptr, reflect.Slice, reflect.Array:
+		return gobCacheable(t.Elem(), seen)
+	case reflect.Map:
+		return gobCacheable(t.Key(), seen) && gobCacheable(t.Elem(), seen)
+	case reflect.Struct:
+		for i := 0; i < t.NumField(); i++ {
+			if !gobCacheable(t.Field(i).Type, seen) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+/*
+gobValueStart 检查data是否由若干条类型定义消息和最后一条值消息组成，返回值消息的起始位置。
+每条gob消息是长度加内容，内容以类型id开头，类型定义的id为负数，值的id为正数
+*/
+func gobValueStart(data []byte) (int, bool) {
+	for pos := 0; pos < len(data); {
+		size, n, ok := gobUint(data[pos:])
+		if !ok || size > uint64(len(data)-pos-n) {
+			return 0, false
+		}
+		id, _, ok := gobUint(data[pos+n : pos+n+int(size)])
+		if !ok || id == 0 {
+			return 0, false
+		}
+		// 类型id是有符号整数，最低位为1表示负数
+		if id&1 == 0 {
+			return pos, pos+n+int(size) == len(data)
+		}
+		pos += n + int(size)
+	}
+	return 0, false
+}
+
+// gobUint 解码gob的无符号整数：小于128时为一个字节，否则第一个字节是后续字节数的相反数，之后是大端序的值
+func gobUint(b []byte) (uint64, int, bool) {
+	if len(b) == 0 {
+		return 0, 0, false
+	}
+	if b[0] < 0x80 {
+		return uint64(b[0]), 1, true
+	}
+	n := -int(int8(b[0]))
+	if n > 8 || len(b) < 1+n {
+		return 0, 0, false
+	}
+	var x uint64
+	for _, c := range b[1 : 1+n] {
+		x = x<<8 | uint64(c)
+	}
+	return x, 1 + n, true
+}
@@ -0,0 +1,99 @@
+package codec
+
+import (
+	"bytes"
+	"container/list"
+	"encoding/gob"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+type gobWithInterface struct {
+	Value interface{}
+}
+
+func init() {
+	gob.Register(time.Time{})
+}
+
+// TestGobMarshaler_Cache 复用Encoder的输出与新的Encoder完全相同，复用的Decoder能解码不同的值
+func TestGobMarshaler_Cache(t *testing.T) {
+	values := []interface{}{
+		&Header{ServiceMethod: "Foo.Sum", Seq: 1, Metadata: map[string]string{"k": "v"}},
+		&Header{Seq: 2},
+		42,
+		[]string{"a", "b"},
+		time.Unix(1, 2),
+		gobWithInterface{Value: 1},
+		gobWithInterface{Value: "str"},
+		gobWithInterface{Value: time.Unix(3, 4)},
+	}
+	var m gobMarshaler
+	for round := 0; round < 3; round++ {
+		for _, v := range values {
+			var fresh bytes.Buffer
+			_assert(gob.NewEncoder(&fresh).Encode(v) == nil, "fresh encode %v", v)
+			got, err := m.Marshal(v)
+			_assert(err == nil && bytes.Equal(got, fresh.Bytes()), "round %d: %#v encoded differently", round, v)
+		}
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				want := Header{ServiceMethod: fmt.Sprint(i), Seq: uint64(j), Timeout: time.Duration(j)}
+				data, err := m.Marshal(&want)
+				_assert(err == nil, "marshal: %v", err)
+				var got Header
+				_assert(m.Unmarshal(data, &got) == nil && got.ServiceMethod == want.ServiceMethod &&
+					got.Seq == want.Seq && got.Timeout == want.Timeout, "unexpected header: %+v", got)
+
+				data, _ = m.Marshal(gobWithInterface{Value: j})
+				var iface gobWithInterface
+				_assert(m.Unmarshal(data, &iface) == nil && iface.Value == j, "unexpected value: %+v", iface)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	var h Header
+	data, _ := m.Marshal(&Header{Seq: 1})
+	_assert(m.Unmarshal(data[:len(data)-1], &h) != nil, "truncated data should fail")
+	_assert(m.Unmarshal(data, &h) == nil && h.Seq == 1, "decoder should recover after an error")
+}
+
+// TestGobDecoderCache 对端发送大量不同的类型定义时淘汰最久没有使用的，正在使用的类型定义仍然被缓存
+func TestGobDecoderCache(t *testing.T) {
+	c := gobDecoderCache{pools: make(map[string]*list.Element)}
+	used := c.get([]byte("used"))
+	for i := 0; i < gobMaxDecoderKeys*2; i++ {
+		_ = c.get([]byte(fmt.Sprint("junk-", i)))
+		_assert(c.get([]byte("used")) == used, "the recently used key should stay cached")
+	}
+	_assert(c.lru.Len() == gobMaxDecoderKeys && len(c.pools) == gobMaxDecoderKeys,
+		"cache should be bounded: %d %d", c.lru.Len(), len(c.pools))
+	_, ok := c.pools["junk-0"]
+	_assert(!ok, "the least recently used key should be evicted")
+}
+
+// BenchmarkGobMarshaler 分帧时每条消息的header都要独立编码和解码
+func BenchmarkGobMarshaler(b *testing.B) {
+	var m gobMarshaler
+	h := &Header{ServiceMethod: "Foo.Sum", Seq: 1, Metadata: map[string]string{"k": "v"}}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		data, err := m.Marshal(h)
+		if err != nil {
+			b.Fatal(err)
+		}
+		var got Header
+		if err := m.Unmarshal(data, &got); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
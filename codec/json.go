@@ -0,0 +1,97 @@
+/*
+codec 包实现了RPC消息序列化与反序列化的，其中提供实现JSON与Gob两种实现
+json.go 实现了Codec接口，采用JSON序列化方式
+conn 是由构建函数传入，通常是TCP socket，decode、encode使用encoding/json模块中的方法
+buffer 是带缓冲的Writer，防止输入阻塞
+与Gob不同，JSON是文本格式，非Go语言的工具甚至直接使用netcat也可以与服务端通信
+通过NewJsonCodec 构造函数得到JSON方式实现的序列化或者反序列化消息
+*/
+
+package codec
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+)
+
+type JsonCodec struct {
+	conn   io.ReadWriteCloser
+	buffer *bufio.Writer
+	decode *json.Decoder
+	encode *json.Encoder
+}
+
+var _ Codec = (*JsonCodec)(nil)
+
+func (j *JsonCodec) Close() error {
+	return j.conn.Close()
+}
+
+func (j *JsonCodec) ReadHeader(header *Header) error {
+	return j.decode.Decode(header)
+}
+
+/*
+ReadBody 先将消息体完整地读取为json.RawMessage，再反序列化到i中。
+这样即使消息体与i的类型不匹配，数据流的位置依然正确，不会影响后续的消息；
+i 为nil时（例如客户端丢弃已经被移除的call的响应），读取后直接丢弃；类型不匹配时返回ErrInvalidBody
+*/
+func (j *JsonCodec) ReadBody(i interface{}) error {
+	var raw json.RawMessage
+	if err := j.decode.Decode(&raw); err != nil {
+		return err
+	}
+	if i == nil {
+		return nil
+	}
+	if err := json.Unmarshal(raw, i); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidBody, err)
+	}
+	return nil
+}
+
+func (j *JsonCodec) Write(header *Header, i interface{}) (err error) {
+	defer func() {
+		if flushErr := j.buffer.Flush(); flushErr != nil {
+			_ = j.Close()
+			if err == nil {
+				err = flushErr
+			}
+		}
+	}()
+
+	if err := j.encode.Encode(header); err != nil {
+		log.Println("rpc codec: json error encoding header: ", err)
+		return err
+	}
+	if err := j.encode.Encode(i); err != nil {
+		log.Println("rpc codec: json error encoding body: ", err)
+		return err
+	}
+	return nil
+}
+
+// NewJsonCodec 构造函数
+func NewJsonCodec(conn io.ReadWriteCloser) Codec {
+	buf := bufio.NewWriter(conn)
+	return &JsonCodec{
+		conn:   conn,
+		buffer: buf,
+		decode: json.NewDecoder(conn),
+		encode: json.NewEncoder(buf),
+	}
+}
+
+// jsonMarshaler 用于分帧的FrameCodec
+type jsonMarshaler struct{}
+
+func (jsonMarshaler) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonMarshaler) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
@@ -0,0 +1,63 @@
+package codec
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"testing"
+)
+
+func _assert(condition bool, msg string, v ...interface{}) {
+	if !condition {
+		panic(fmt.Sprintf("assertion failed: "+msg, v...))
+	}
+}
+
+// bufferConn 用内存缓冲区模拟连接，写入的数据可以被再次读出
+type bufferConn struct {
+	bytes.Buffer
+}
+
+func (b *bufferConn) Close() error {
+	return nil
+}
+
+var _ io.ReadWriteCloser = (*bufferConn)(nil)
+
+type jsonArgs struct {
+	Num1, Num2 int
+}
+
+func TestJsonCodec_RoundTrip(t *testing.T) {
+	conn := new(bufferConn)
+	c := NewJsonCodec(conn)
+
+	_assert(c.Write(&Header{ServiceMethod: "Foo.Sum", Seq: 1}, &jsonArgs{1, 2}) == nil, "write first message")
+	_assert(c.Write(&Header{ServiceMethod: "Foo.Sum", Seq: 2, Error: "boom"}, struct{}{}) == nil,
+		"write second message")
+
+	var h Header
+	var args jsonArgs
+	_assert(c.ReadHeader(&h) == nil && h.ServiceMethod == "Foo.Sum" && h.Seq == 1, "read first header: %+v", h)
+	_assert(c.ReadBody(&args) == nil && args.Num1 == 1 && args.Num2 == 2, "read first body: %+v", args)
+
+	h = Header{}
+	_assert(c.ReadHeader(&h) == nil && h.Seq == 2 && h.Error == "boom", "read second header: %+v", h)
+	_assert(c.ReadBody(nil) == nil, "ReadBody(nil) should discard the body")
+	_assert(c.ReadHeader(&h) == io.EOF, "expect EOF after all messages")
+}
+
+func TestJsonCodec_BodyTypeMismatch(t *testing.T) {
+	conn := new(bufferConn)
+	c := NewJsonCodec(conn)
+	_ = c.Write(&Header{ServiceMethod: "Foo.Sum", Seq: 1}, "not an args struct")
+	_ = c.Write(&Header{ServiceMethod: "Foo.Sum", Seq: 2}, &jsonArgs{3, 4})
+
+	var h Header
+	var args jsonArgs
+	_assert(c.ReadHeader(&h) == nil && h.Seq == 1, "read first header")
+	_assert(c.ReadBody(&args) != nil, "expect a type mismatch error")
+
+	_assert(c.ReadHeader(&h) == nil && h.Seq == 2, "stream should stay in sync after a bad body")
+	_assert(c.ReadBody(&args) == nil && args.Num1 == 3 && args.Num2 == 4, "read second body: %+v", args)
+}
@@ -0,0 +1,1067 @@
+/*
+msgpack.go 实现了Codec接口，采用MessagePack序列化方式，编码和解码都基于反射，不依赖第三方库。
+MessagePack 是二进制格式，比JSON更紧凑、解析更快，Python、JS等语言都有成熟的实现，便于非Go语言的服务接入。
+
+支持的类型与编码方式：
+
+	bool、整数、浮点数、string     对应的MessagePack类型，整数使用能够容纳其值的最短编码
+	[]byte                         bin
+	slice、array                   array，nil slice 编码为nil
+	map                            map，nil map 编码为nil
+	struct                         map，键是字段名，可以通过 `msgpack:"name,omitempty"` 修改，"-" 表示忽略；
+	                               没有tag的匿名结构体字段会被展开，未导出的字段被忽略
+	pointer、interface             编码指向的值，nil 编码为nil
+	time.Time                      timestamp 扩展类型（-1），解码得到本地时区的时间
+
+解码到interface{}时，整数得到int64（超出范围时为uint64），浮点数得到float64，array 得到[]interface{}，
+键都是字符串的map得到map[string]interface{}，否则得到map[interface{}]interface{}。
+
+MsgpackCodec 先读取一个完整的值，再反序列化到给定的类型，因此类型不匹配时返回ErrInvalidBody，
+数据流的位置依然正确；msgpackMarshaler 用于分帧的FrameCodec。
+*/
+
+package codec
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MessagePack 格式中的类型字节
+const (
+	mpNil      = 0xc0
+	mpFalse    = 0xc2
+	mpTrue     = 0xc3
+	mpBin8     = 0xc4
+	mpBin16    = 0xc5
+	mpBin32    = 0xc6
+	mpExt8     = 0xc7
+	mpExt16    = 0xc8
+	mpExt32    = 0xc9
+	mpFloat32  = 0xca
+	mpFloat64  = 0xcb
+	mpUint8    = 0xcc
+	mpUint16   = 0xcd
+	mpUint32   = 0xce
+	mpUint64   = 0xcf
+	mpInt8     = 0xd0
+	mpInt16    = 0xd1
+	mpInt32    = 0xd2
+	mpInt64    = 0xd3
+	mpFixExt1  = 0xd4
+	mpFixExt4  = 0xd6
+	mpFixExt8  = 0xd7
+	mpFixExt16 = 0xd8
+	mpStr8     = 0xd9
+	mpStr16    = 0xda
+	mpStr32    = 0xdb
+	mpArray16  = 0xdc
+	mpArray32  = 0xdd
+	mpMap16    = 0xde
+	mpMap32    = 0xdf
+
+	mpTimestampExt = -1
+	// mpMaxDepth 解码时允许的最大嵌套深度，防止恶意的数据耗尽栈空间
+	mpMaxDepth = 10000
+)
+
+var errMsgpackTruncated = fmt.Errorf("rpc codec: msgpack: %w", io.ErrUnexpectedEOF)
+
+type MsgpackCodec struct {
+	conn   io.ReadWriteCloser
+	reader *bufio.Reader
+	buffer *bufio.Writer
+	raw    []byte // 读取一个完整的值时复用的缓冲区
+}
+
+var _ Codec = (*MsgpackCodec)(nil)
+
+func (m *MsgpackCodec) Close() error {
+	return m.conn.Close()
+}
+
+func (m *MsgpackCodec) ReadHeader(header *Header) error {
+	raw, err := msgpackReadValue(m.raw[:0], m.reader)
+	m.raw = raw
+	if err != nil {
+		return err
+	}
+	*header = Header{}
+	return msgpackUnmarshal(raw, header)
+}
+
+// ReadBody 先读取一个完整的值，i 为nil时丢弃，类型不匹配时返回ErrInvalidBody
+func (m *MsgpackCodec) ReadBody(i interface{}) error {
+	raw, err := msgpackReadValue(m.raw[:0], m.reader)
+	m.raw = raw
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	if i == nil {
+		return nil
+	}
+	if err := msgpackUnmarshal(raw, i); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidBody, err)
+	}
+	return nil
+}
+
+func (m *MsgpackCodec) Write(header *Header, i interface{}) (err error) {
+	buf := getBuffer()
+	defer putBuffer(buf)
+	if *buf, err = msgpackAppend(*buf, header); err != nil {
+		log.Println("rpc codec: msgpack error encoding header: ", err)
+		return err
+	}
+	if *buf, err = msgpackAppend(*buf, i); err != nil {
+		log.Println("rpc codec: msgpack error encoding body: ", err)
+		return err
+	}
+	defer func() {
+		if flushErr := m.buffer.Flush(); flushErr != nil {
+			_ = m.Close()
+			if err == nil {
+				err = flushErr
+			}
+		}
+	}()
+	_, err = m.buffer.Write(*buf)
+	return err
+}
+
+// NewMsgpackCodec 构造函数
+func NewMsgpackCodec(conn io.ReadWriteCloser) Codec {
+	return &MsgpackCodec{
+		conn:   conn,
+		reader: bufio.NewReader(conn),
+		buffer: bufio.NewWriter(conn),
+	}
+}
+
+// msgpackMarshaler 用于分帧的FrameCodec
+type msgpackMarshaler struct{}
+
+var _ AppendMarshaler = msgpackMarshaler{}
+
+func (msgpackMarshaler) Marshal(v interface{}) ([]byte, error) {
+	return msgpackMarshal(v)
+}
+
+func (msgpackMarshaler) AppendMarshal(dst []byte, v interface{}) ([]byte, error) {
+	return msgpackAppend(dst, v)
+}
+
+func (msgpackMarshaler) Unmarshal(data []byte, v interface{}) error {
+	return msgpackUnmarshal(data, v)
+}
+
+/*
+msgpackReadValue 从r中读取一个完整的值，原样追加到dst之后返回。
+不做反射，只根据类型字节和长度跳过数据；数据在第一个字节之前结束时返回io.EOF，读到一半时返回io.ErrUnexpectedEOF
+*/
+func msgpackReadValue(dst []byte, r io.ByteReader) ([]byte, error) {
+	reader := r.(io.Reader)
+	for remaining, first := 1, true; remaining > 0; remaining, first = remaining-1, false {
+		c, err := r.ReadByte()
+		if err != nil {
+			if err == io.EOF && !first {
+				err = errMsgpackTruncated
+			}
+			return dst, err
+		}
+		dst = append(dst, c)
+		lenSize, payload, children, perItem := 0, 0, 0, 0
+		switch {
+		case c <= 0x7f || c >= 0xe0: // positive/negative fixint
+		case c <= 0x8f: // fixmap
+			children = 2 * int(c&0x0f)
+		case c <= 0x9f: // fixarray
+			children = int(c & 0x0f)
+		case c <= 0xbf: // fixstr
+			payload = int(c & 0x1f)
+		case c == mpNil, c == mpFalse, c == mpTrue:
+		case c == mpBin8, c == mpStr8:
+			lenSize = 1
+		case c == mpBin16, c == mpStr16:
+			lenSize = 2
+		case c == mpBin32, c == mpStr32:
+			lenSize = 4
+		case c == mpExt8:
+			lenSize, payload = 1, 1
+		case c == mpExt16:
+			lenSize, payload = 2, 1
+		case c == mpExt32:
+			lenSize, payload = 4, 1
+		case c == mpFloat32, c == mpUint32, c == mpInt32:
+			payload = 4
+		case c == mpFloat64, c == mpUint64, c == mpInt64:
+			payload = 8
+		case c == mpUint8, c == mpInt8:
+			payload = 1
+		case c == mpUint16, c == mpInt16:
+			payload = 2
+		case c >= mpFixExt1 && c <= mpFixExt16:
+			payload = 1 + 1<<(c-mpFixExt1)
+		case c == mpArray16:
+			lenSize, perItem = 2, 1
+		case c == mpArray32:
+			lenSize, perItem = 4, 1
+		case c == mpMap16:
+			lenSize, perItem = 2, 2
+		case c == mpMap32:
+			lenSize, perItem = 4, 2
+		default:
+			return dst, fmt.Errorf("rpc codec: msgpack: invalid code %#x", c)
+		}
+		if lenSize > 0 {
+			start := len(dst)
+			if dst, err = appendN(dst, reader, lenSize); err != nil {
+				return dst, err
+			}
+			n := msgpackUint(dst[start:])
+			// 32位平台上int放不下的长度，数据不可能完整，与读到一半时一样处理
+			if n > math.MaxInt/2 {
+				return dst, errMsgpackTruncated
+			}
+			if perItem > 0 {
+				children = perItem * int(n)
+			} else {
+				payload += int(n)
+			}
+		}
+		if dst, err = appendN(dst, reader, payload); err != nil {
+			return dst, err
+		}
+		remaining += children
+	}
+	return dst, nil
+}
+
+// msgpackUint 将大端序的1、2、4、8个字节解析为整数
+func msgpackUint(b []byte) uint64 {
+	switch len(b) {
+	case 1:
+		return uint64(b[0])
+	case 2:
+		return uint64(binary.BigEndian.Uint16(b))
+	case 4:
+		return uint64(binary.BigEndian.Uint32(b))
+	default:
+		return binary.BigEndian.Uint64(b)
+	}
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// msgpackField 结构体中参与编码的字段
+type msgpackField struct {
+	name      string
+	index     []int
+	omitEmpty bool
+}
+
+// msgpackFieldCache 缓存每个结构体类型的字段信息，键是reflect.Type
+var msgpackFieldCache sync.Map
+
+func msgpackFields(t reflect.Type) []msgpackField {
+	if fields, ok := msgpackFieldCache.Load(t); ok {
+		return fields.([]msgpackField)
+	}
+	fields := msgpackCollectFields(t, nil)
+	msgpackFieldCache.Store(t, fields)
+	return fields
+}
+
+func msgpackCollectFields(t reflect.Type, index []int) []msgpackField {
+	var fields []msgpackField
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("msgpack")
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		fieldIndex := append(append([]int(nil), index...), i)
+		// 没有tag的匿名结构体字段被展开
+		if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+			fields = append(fields, msgpackCollectFields(f.Type, fieldIndex)...)
+			continue
+		}
+		if !f.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		fields = append(fields, msgpackField{name: name, index: fieldIndex, omitEmpty: opts == "omitempty"})
+	}
+	return fields
+}
+
+func msgpackMarshal(v interface{}) ([]byte, error) {
+	return msgpackAppend(nil, v)
+}
+
+// msgpackAppend 将v编码之后追加到dst
+func msgpackAppend(dst []byte, v interface{}) ([]byte, error) {
+	e := &msgpackEncoder{buf: dst}
+	if err := e.encode(reflect.ValueOf(v)); err != nil {
+		return dst, err
+	}
+	return e.buf, nil
+}
+
+type msgpackEncoder struct {
+	buf []byte
+}
+
+func (e *msgpackEncoder) encode(v reflect.Value) error {
+	if !v.IsValid() {
+		e.buf = append(e.buf, mpNil)
+		return nil
+	}
+	if v.Type() == timeType {
+		e.encodeTime(v.Interface().(time.Time))
+		return nil
+	}
+	switch v.Kind() {
+	case reflect.Bool:
+		if v.Bool() {
+			e.buf = append(e.buf, mpTrue)
+		} else {
+			e.buf = append(e.buf, mpFalse)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		e.encodeInt(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		e.encodeUint(v.Uint())
+	case reflect.Float32:
+		e.buf = append(e.buf, mpFloat32)
+		e.buf = binary.BigEndian.AppendUint32(e.buf, math.Float32bits(float32(v.Float())))
+	case reflect.Float64:
+		e.buf = append(e.buf, mpFloat64)
+		e.buf = binary.BigEndian.AppendUint64(e.buf, math.Float64bits(v.Float()))
+	case reflect.String:
+		e.encodeString(v.String())
+	case reflect.Slice:
+		if v.IsNil() {
+			e.buf = append(e.buf, mpNil)
+			return nil
+		}
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			e.encodeBytes(v.Bytes())
+			return nil
+		}
+		return e.encodeArray(v)
+	case reflect.Array:
+		return e.encodeArray(v)
+	case reflect.Map:
+		if v.IsNil() {
+			e.buf = append(e.buf, mpNil)
+			return nil
+		}
+		e.encodeLen(v.Len(), 0x80, 0x0f, mpMap16, mpMap32)
+		iter := v.MapRange()
+		for iter.Next() {
+			if err := e.encode(iter.Key()); err != nil {
+				return err
+			}
+			if err := e.encode(iter.Value()); err != nil {
+				return err
+			}
+		}
+	case reflect.Struct:
+		return e.encodeStruct(v)
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			e.buf = append(e.buf, mpNil)
+			return nil
+		}
+		return e.encode(v.Elem())
+	default:
+		return fmt.Errorf("rpc codec: msgpack: unsupported type %s", v.Type())
+	}
+	return nil
+}
+
+func (e *msgpackEncoder) encodeInt(i int64) {
+	switch {
+	case i >= 0:
+		e.encodeUint(uint64(i))
+	case i >= -32:
+		e.buf = append(e.buf, byte(i))
+	case i >= math.MinInt8:
+		e.buf = append(e.buf, mpInt8, byte(i))
+	case i >= math.MinInt16:
+		e.buf = binary.BigEndian.AppendUint16(append(e.buf, mpInt16), uint16(i))
+	case i >= math.MinInt32:
+		e.buf = binary.BigEndian.AppendUint32(append(e.buf, mpInt32), uint32(i))
+	default:
+		e.buf = binary.BigEndian.AppendUint64(append(e.buf, mpInt64), uint64(i))
+	}
+}
+
+func (e *msgpackEncoder) encodeUint(u uint64) {
+	switch {
+	case u <= 0x7f:
+		e.buf = append(e.buf, byte(u))
+	case u <= math.MaxUint8:
+		e.buf = append(e.buf, mpUint8, byte(u))
+	case u <= math.MaxUint16:
+		e.buf = binary.BigEndian.AppendUint16(append(e.buf, mpUint16), uint16(u))
+	case u <= math.MaxUint32:
+		e.buf = binary.BigEndian.AppendUint32(append(e.buf, mpUint32), uint32(u))
+	default:
+		e.buf = binary.BigEndian.AppendUint64(append(e.buf, mpUint64), u)
+	}
+}
+
+// encodeLen 输出长度n：不超过fixMax时使用fix格式，否则使用16位或32位的长度
+func (e *msgpackEncoder) encodeLen(n int, fix byte, fixMax int, code16, code32 byte) {
+	switch {
+	case n <= fixMax:
+		e.buf = append(e.buf, fix|byte(n))
+	case n <= math.MaxUint16:
+		e.buf = binary.BigEndian.AppendUint16(append(e.buf, code16), uint16(n))
+	default:
+		e.buf = binary.BigEndian.AppendUint32(append(e.buf, code32), uint32(n))
+	}
+}
+
+func (e *msgpackEncoder) encodeString(s string) {
+	if len(s) > 0x1f && len(s) <= math.MaxUint8 {
+		e.buf = append(e.buf, mpStr8, byte(len(s)))
+	} else {
+		e.encodeLen(len(s), 0xa0, 0x1f, mpStr16, mpStr32)
+	}
+	e.buf = append(e.buf, s...)
+}
+
+func (e *msgpackEncoder) encodeBytes(b []byte) {
+	if len(b) <= math.MaxUint8 {
+		e.buf = append(e.buf, mpBin8, byte(len(b)))
+	} else {
+		e.encodeLen(len(b), 0, -1, mpBin16, mpBin32)
+	}
+	e.buf = append(e.buf, b...)
+}
+
+func (e *msgpackEncoder) encodeArray(v reflect.Value) error {
+	e.encodeLen(v.Len(), 0x90, 0x0f, mpArray16, mpArray32)
+	for i := 0; i < v.Len(); i++ {
+		if err := e.encode(v.Index(i)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *msgpackEncoder) encodeStruct(v reflect.Value) error {
+	fields := msgpackFields(v.Type())
+	values := make([]reflect.Value, 0, len(fields))
+	names := make([]string, 0, len(fields))
+	for _, f := range fields {
+		fv := v.FieldByIndex(f.index)
+		if f.omitEmpty && fv.IsZero() {
+			continue
+		}
+		values = append(values, fv)
+		names = append(names, f.name)
+	}
+	e.encodeLen(len(values), 0x80, 0x0f, mpMap16, mpMap32)
+	for i, fv := range values {
+		e.encodeString(names[i])
+		if err := e.encode(fv); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// encodeTime 使用能够表示t的最短的timestamp格式
+func (e *msgpackEncoder) encodeTime(t time.Time) {
+	sec, nsec := t.Unix(), int64(t.Nanosecond())
+	switch {
+	case sec >= 0 && sec>>34 == 0 && nsec == 0 && sec <= math.MaxUint32:
+		e.buf = append(e.buf, mpFixExt4, 0xff)
+		e.buf = binary.BigEndian.AppendUint32(e.buf, uint32(sec))
+	case sec >= 0 && sec>>34 == 0:
+		e.buf = append(e.buf, mpFixExt8, 0xff)
+		e.buf = binary.BigEndian.AppendUint64(e.buf, uint64(nsec)<<34|uint64(sec))
+	default:
+		e.buf = append(e.buf, mpExt8, 12, 0xff)
+		e.buf = binary.BigEndian.AppendUint32(e.buf, uint32(nsec))
+		e.buf = binary.BigEndian.AppendUint64(e.buf, uint64(sec))
+	}
+}
+
+func msgpackUnmarshal(data []byte, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return fmt.Errorf("rpc codec: msgpack: Unmarshal(non-pointer %T)", v)
+	}
+	d := &msgpackDecoder{data: data}
+	if err := d.decode(rv.Elem()); err != nil {
+		return err
+	}
+	if d.pos != len(d.data) {
+		return errors.New("rpc codec: msgpack: trailing data")
+	}
+	return nil
+}
+
+type msgpackDecoder struct {
+	data  []byte
+	pos   int
+	depth int
+}
+
+func (d *msgpackDecoder) peek() (byte, error) {
+	if d.pos >= len(d.data) {
+		return 0, errMsgpackTruncated
+	}
+	return d.data[d.pos], nil
+}
+
+func (d *msgpackDecoder) next(n int) ([]byte, error) {
+	if n < 0 || len(d.data)-d.pos < n {
+		return nil, errMsgpackTruncated
+	}
+	b := d.data[d.pos : d.pos+n]
+	d.pos += n
+	return b, nil
+}
+
+func (d *msgpackDecoder) readByte() (byte, error) {
+	b, err := d.next(1)
+	if err != nil {
+		return 0, err
+	}
+	return b[0], nil
+}
+
+// readLen 读取长度字段，n 不超过剩余的字节数（每个元素至少一个字节），防止伪造的长度导致大量分配
+func (d *msgpackDecoder) readLen(size int) (int, error) {
+	b, err := d.next(size)
+	if err != nil {
+		return 0, err
+	}
+	n := msgpackUint(b)
+	if n > uint64(len(d.data)-d.pos) {
+		return 0, errMsgpackTruncated
+	}
+	return int(n), nil
+}
+
+func (d *msgpackDecoder) mismatch(c byte, t reflect.Type) error {
+	return fmt.Errorf("rpc codec: msgpack: cannot decode code %#x into %s", c, t)
+}
+
+func (d *msgpackDecoder) decode(v reflect.Value) error {
+	d.depth++
+	defer func() { d.depth-- }()
+	if d.depth > mpMaxDepth {
+		return errors.New("rpc codec: msgpack: exceeded max depth")
+	}
+	c, err := d.peek()
+	if err != nil {
+		return err
+	}
+	if c == mpNil {
+		d.pos++
+		v.Set(reflect.Zero(v.Type()))
+		return nil
+	}
+	if v.Type() == timeType {
+		t, err := d.readTime()
+		if err != nil {
+			return err
+		}
+		v.Set(reflect.ValueOf(t))
+		return nil
+	}
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return d.decode(v.Elem())
+	case reflect.Interface:
+		if v.NumMethod() != 0 {
+			return fmt.Errorf("rpc codec: msgpack: cannot decode into non-empty interface %s", v.Type())
+		}
+		i, err := d.decodeInterface()
+		if err != nil {
+			return err
+		}
+		if i != nil {
+			v.Set(reflect.ValueOf(i))
+		} else {
+			v.Set(reflect.Zero(v.Type()))
+		}
+		return nil
+	case reflect.Bool:
+		d.pos++
+		switch c {
+		case mpTrue:
+			v.SetBool(true)
+		case mpFalse:
+			v.SetBool(false)
+		default:
+			return d.mismatch(c, v.Type())
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := d.readInt(v.Type())
+		if err != nil {
+			return err
+		}
+		if v.OverflowInt(i) {
+			return fmt.Errorf("rpc codec: msgpack: %d overflows %s", i, v.Type())
+		}
+		v.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		u, err := d.readUint(v.Type())
+		if err != nil {
+			return err
+		}
+		if v.OverflowUint(u) {
+			return fmt.Errorf("rpc codec: msgpack: %d overflows %s", u, v.Type())
+		}
+		v.SetUint(u)
+	case reflect.Float32, reflect.Float64:
+		f, err := d.readFloat(v.Type())
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	case reflect.String:
+		b, err := d.readBytes(v.Type())
+		if err != nil {
+			return err
+		}
+		v.SetString(string(b))
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			b, err := d.readBytes(v.Type())
+			if err != nil {
+				return err
+			}
+			v.SetBytes(append([]byte{}, b...))
+			return nil
+		}
+		n, err := d.readArrayLen(v.Type())
+		if err != nil {
+			return err
+		}
+		v.Set(reflect.MakeSlice(v.Type(), n, n))
+		for i := 0; i < n; i++ {
+			if err := d.decode(v.Index(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Array:
+		n, err := d.readArrayLen(v.Type())
+		if err != nil {
+			return err
+		}
+		if n > v.Len() {
+			return fmt.Errorf("rpc codec: msgpack: array of %d elements overflows %s", n, v.Type())
+		}
+		for i := 0; i < v.Len(); i++ {
+			if i >= n {
+				v.Index(i).Set(reflect.Zero(v.Type().Elem()))
+				continue
+			}
+			if err := d.decode(v.Index(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		n, err := d.readMapLen(v.Type())
+		if err != nil {
+			return err
+		}
+		if v.IsNil() {
+			v.Set(reflect.MakeMapWithSize(v.Type(), n))
+		}
+		for i := 0; i < n; i++ {
+			key := reflect.New(v.Type().Key()).Elem()
+			if err := d.decode(key); err != nil {
+				return err
+			}
+			value := reflect.New(v.Type().Elem()).Elem()
+			if err := d.decode(value); err != nil {
+				return err
+			}
+			v.SetMapIndex(key, value)
+		}
+	case reflect.Struct:
+		return d.decodeStruct(v)
+	default:
+		return fmt.Errorf("rpc codec: msgpack: unsupported type %s", v.Type())
+	}
+	return nil
+}
+
+func (d *msgpackDecoder) decodeStruct(v reflect.Value) error {
+	n, err := d.readMapLen(v.Type())
+	if err != nil {
+		return err
+	}
+	fields := msgpackFields(v.Type())
+	for i := 0; i < n; i++ {
+		name, err := d.readBytes(v.Type())
+		if err != nil {
+			return err
+		}
+		var field *msgpackField
+		for j := range fields {
+			if fields[j].name == string(name) {
+				field = &fields[j]
+				break
+			}
+		}
+		// 未知的字段被跳过
+		if field == nil {
+			if err := d.skip(); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := d.decode(v.FieldByIndex(field.index)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// skip 跳过一个完整的值
+func (d *msgpackDecoder) skip() error {
+	r := &msgpackByteReader{data: d.data, pos: d.pos}
+	if _, err := msgpackReadValue(nil, r); err != nil {
+		return err
+	}
+	d.pos = r.pos
+	return nil
+}
+
+// msgpackByteReader 在[]byte上实现io.ByteReader和io.Reader，用于skip
+type msgpackByteReader struct {
+	data []byte
+	pos  int
+}
+
+func (r *msgpackByteReader) ReadByte() (byte, error) {
+	if r.pos >= len(r.data) {
+		return 0, io.EOF
+	}
+	r.pos++
+	return r.data[r.pos-1], nil
+}
+
+func (r *msgpackByteReader) Read(p []byte) (int, error) {
+	if r.pos >= len(r.data) {
+		return 0, io.EOF
+	}
+	n := copy(p, r.data[r.pos:])
+	r.pos += n
+	return n, nil
+}
+
+// readInt 读取任意一种整数格式
+func (d *msgpackDecoder) readInt(t reflect.Type) (int64, error) {
+	c, _ := d.peek()
+	switch {
+	case c <= 0x7f:
+		d.pos++
+		return int64(c), nil
+	case c >= 0xe0:
+		d.pos++
+		return int64(int8(c)), nil
+	case c >= mpUint8 && c <= mpUint64:
+		u, err := d.readUint(t)
+		if err != nil {
+			return 0, err
+		}
+		if u > math.MaxInt64 {
+			return 0, fmt.Errorf("rpc codec: msgpack: %d overflows %s", u, t)
+		}
+		return int64(u), nil
+	case c >= mpInt8 && c <= mpInt64:
+		d.pos++
+		b, err := d.next(1 << (c - mpInt8))
+		if err != nil {
+			return 0, err
+		}
+		switch len(b) {
+		case 1:
+			return int64(int8(b[0])), nil
+		case 2:
+			return int64(int16(binary.BigEndian.Uint16(b))), nil
+		case 4:
+			return int64(int32(binary.BigEndian.Uint32(b))), nil
+		default:
+			return int64(binary.BigEndian.Uint64(b)), nil
+		}
+	}
+	return 0, d.mismatch(c, t)
+}
+
+// readUint 读取任意一种整数格式，负数返回错误
+func (d *msgpackDecoder) readUint(t reflect.Type) (uint64, error) {
+	c, _ := d.peek()
+	if c >= mpUint8 && c <= mpUint64 {
+		d.pos++
+		b, err := d.next(1 << (c - mpUint8))
+		if err != nil {
+			return 0, err
+		}
+		return msgpackUint(b), nil
+	}
+	i, err := d.readInt(t)
+	if err != nil {
+		return 0, err
+	}
+	if i < 0 {
+		return 0, fmt.Errorf("rpc codec: msgpack: %d overflows %s", i, t)
+	}
+	return uint64(i), nil
+}
+
+// readFloat 读取浮点数，整数也可以解码为浮点数
+func (d *msgpackDecoder) readFloat(t reflect.Type) (float64, error) {
+	c, _ := d.peek()
+	switch c {
+	case mpFloat32:
+		d.pos++
+		b, err := d.next(4)
+		if err != nil {
+			return 0, err
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), nil
+	case mpFloat64:
+		d.pos++
+		b, err := d.next(8)
+		if err != nil {
+			return 0, err
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), nil
+	}
+	if c >= mpUint8 && c <= mpUint64 {
+		u, err := d.readUint(t)
+		return float64(u), err
+	}
+	i, err := d.readInt(t)
+	return float64(i), err
+}
+
+// readBytes 读取str或者bin，返回的切片引用输入的数据
+func (d *msgpackDecoder) readBytes(t reflect.Type) ([]byte, error) {
+	c, _ := d.peek()
+	d.pos++
+	var n int
+	var err error
+	switch {
+	case c >= 0xa0 && c <= 0xbf:
+		n = int(c & 0x1f)
+	case c == mpStr8 || c == mpBin8:
+		n, err = d.readLen(1)
+	case c == mpStr16 || c == mpBin16:
+		n, err = d.readLen(2)
+	case c == mpStr32 || c == mpBin32:
+		n, err = d.readLen(4)
+	default:
+		d.pos--
+		return nil, d.mismatch(c, t)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return d.next(n)
+}
+
+func (d *msgpackDecoder) readArrayLen(t reflect.Type) (int, error) {
+	c, _ := d.peek()
+	d.pos++
+	switch {
+	case c >= 0x90 && c <= 0x9f:
+		return int(c & 0x0f), nil
+	case c == mpArray16:
+		return d.readLen(2)
+	case c == mpArray32:
+		return d.readLen(4)
+	}
+	d.pos--
+	return 0, d.mismatch(c, t)
+}
+
+func (d *msgpackDecoder) readMapLen(t reflect.Type) (int, error) {
+	c, _ := d.peek()
+	d.pos++
+	switch {
+	case c >= 0x80 && c <= 0x8f:
+		return int(c & 0x0f), nil
+	case c == mpMap16:
+		return d.readLen(2)
+	case c == mpMap32:
+		return d.readLen(4)
+	}
+	d.pos--
+	return 0, d.mismatch(c, t)
+}
+
+// readExt 读取扩展类型，返回类型和数据
+func (d *msgpackDecoder) readExt() (int8, []byte, error) {
+	c, err := d.readByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	var n int
+	switch {
+	case c >= mpFixExt1 && c <= mpFixExt16:
+		n = 1 << (c - mpFixExt1)
+	case c == mpExt8:
+		n, err = d.readLen(1)
+	case c == mpExt16:
+		n, err = d.readLen(2)
+	case c == mpExt32:
+		n, err = d.readLen(4)
+	default:
+		d.pos--
+		return 0, nil, d.mismatch(c, timeType)
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+	typ, err := d.readByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	data, err := d.next(n)
+	return int8(typ), data, err
+}
+
+func (d *msgpackDecoder) readTime() (time.Time, error) {
+	typ, data, err := d.readExt()
+	if err != nil {
+		return time.Time{}, err
+	}
+	if typ != mpTimestampExt {
+		return time.Time{}, fmt.Errorf("rpc codec: msgpack: cannot decode extension %d into time.Time", typ)
+	}
+	switch len(data) {
+	case 4:
+		return time.Unix(int64(binary.BigEndian.Uint32(data)), 0), nil
+	case 8:
+		v := binary.BigEndian.Uint64(data)
+		return time.Unix(int64(v&(1<<34-1)), int64(v>>34)), nil
+	case 12:
+		nsec := binary.BigEndian.Uint32(data)
+		return time.Unix(int64(binary.BigEndian.Uint64(data[4:])), int64(nsec)), nil
+	}
+	return time.Time{}, fmt.Errorf("rpc codec: msgpack: invalid timestamp length %d", len(data))
+}
+
+// decodeInterface 解码为interface{}，类型的对应关系见文件开头的说明
+func (d *msgpackDecoder) decodeInterface() (interface{}, error) {
+	d.depth++
+	defer func() { d.depth-- }()
+	if d.depth > mpMaxDepth {
+		return nil, errors.New("rpc codec: msgpack: exceeded max depth")
+	}
+	c, err := d.peek()
+	if err != nil {
+		return nil, err
+	}
+	anyType := reflect.TypeOf((*interface{})(nil)).Elem()
+	switch {
+	case c == mpNil:
+		d.pos++
+		return nil, nil
+	case c == mpTrue || c == mpFalse:
+		d.pos++
+		return c == mpTrue, nil
+	case c <= 0x7f || c >= 0xe0 || (c >= mpInt8 && c <= mpInt64):
+		return d.readInt(anyType)
+	case c >= mpUint8 && c <= mpUint64:
+		u, err := d.readUint(anyType)
+		if err != nil || u > math.MaxInt64 {
+			return u, err
+		}
+		return int64(u), nil
+	case c == mpFloat32 || c == mpFloat64:
+		return d.readFloat(anyType)
+	case (c >= 0xa0 && c <= 0xbf) || (c >= mpStr8 && c <= mpStr32):
+		b, err := d.readBytes(anyType)
+		return string(b), err
+	case c >= mpBin8 && c <= mpBin32:
+		b, err := d.readBytes(anyType)
+		return append([]byte{}, b...), err
+	case (c >= 0x90 && c <= 0x9f) || c == mpArray16 || c == mpArray32:
+		n, err := d.readArrayLen(anyType)
+		if err != nil {
+			return nil, err
+		}
+		array := make([]interface{}, n)
+		for i := range array {
+			if array[i], err = d.decodeInterface(); err != nil {
+				return nil, err
+			}
+		}
+		return array, nil
+	case (c >= 0x80 && c <= 0x8f) || c == mpMap16 || c == mpMap32:
+		return d.decodeInterfaceMap()
+	case (c >= mpFixExt1 && c <= mpFixExt16) || (c >= mpExt8 && c <= mpExt32):
+		return d.readTime()
+	}
+	return nil, fmt.Errorf("rpc codec: msgpack: invalid code %#x", c)
+}
+
+// decodeInterfaceMap 键都是字符串时返回map[string]interface{}，否则返回map[interface{}]interface{}
+func (d *msgpackDecoder) decodeInterfaceMap() (interface{}, error) {
+	n, err := d.readMapLen(reflect.TypeOf(map[string]interface{}{}))
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]interface{}, n)
+	values := make([]interface{}, n)
+	allStrings := true
+	for i := 0; i < n; i++ {
+		if keys[i], err = d.decodeInterface(); err != nil {
+			return nil, err
+		}
+		if values[i], err = d.decodeInterface(); err != nil {
+			return nil, err
+		}
+		if _, ok := keys[i].(string); !ok {
+			allStrings = false
+		}
+	}
+	if allStrings {
+		m := make(map[string]interface{}, n)
+		for i, k := range keys {
+			m[k.(string)] = values[i]
+		}
+		return m, nil
+	}
+	m := make(map[interface{}]interface{}, n)
+	for i, k := range keys {
+		if k != nil && !reflect.TypeOf(k).Comparable() {
+			return nil, fmt.Errorf("rpc codec: msgpack: unhashable map key %T", k)
+		}
+		m[k] = values[i]
+	}
+	return m, nil
+}
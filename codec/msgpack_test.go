@@ -0,0 +1,124 @@
+package codec
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// TestMsgpack_Format 编码结果与MessagePack规范一致，便于其他语言的实现解码
+func TestMsgpack_Format(t *testing.T) {
+	cases := []struct {
+		v    interface{}
+		want []byte
+	}{
+		{nil, []byte{0xc0}},
+		{true, []byte{0xc3}},
+		{1, []byte{0x01}},
+		{-1, []byte{0xff}},
+		{-33, []byte{0xd0, 0xdf}},
+		{200, []byte{0xcc, 0xc8}},
+		{uint64(math.MaxUint64), []byte{0xcf, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}},
+		{1.5, []byte{0xcb, 0x3f, 0xf8, 0, 0, 0, 0, 0, 0}},
+		{"a", []byte{0xa1, 'a'}},
+		{[]byte{1}, []byte{0xc4, 0x01, 0x01}},
+		{[]int{1, 2}, []byte{0x92, 0x01, 0x02}},
+		{map[string]int{"a": 1}, []byte{0x81, 0xa1, 'a', 0x01}},
+		{struct {
+			A int `msgpack:"a"`
+			B int `msgpack:"-"`
+			C int `msgpack:",omitempty"`
+		}{A: 1, B: 2}, []byte{0x81, 0xa1, 'a', 0x01}},
+		{time.Unix(1, 0), []byte{0xd6, 0xff, 0, 0, 0, 1}},
+	}
+	for _, c := range cases {
+		got, err := msgpackMarshal(c.v)
+		_assert(err == nil && bytes.Equal(got, c.want), "encode %#v: got % x, want % x", c.v, got, c.want)
+	}
+}
+
+type msgpackEmbedded struct {
+	ID int
+}
+
+type msgpackTagged struct {
+	msgpackEmbedded
+	Name    string `msgpack:"name"`
+	Skipped string `msgpack:"-"`
+	Any     interface{}
+	Array   [3]int
+	Times   []time.Time
+	private int
+}
+
+func TestMsgpack_RoundTrip(t *testing.T) {
+	want := msgpackTagged{
+		msgpackEmbedded: msgpackEmbedded{ID: 9},
+		Name:            "tagged",
+		Skipped:         "dropped",
+		Any:             map[string]interface{}{"list": []interface{}{int64(1), "two", nil}, "f": 2.5},
+		Array:           [3]int{1, 2, 3},
+		Times: []time.Time{
+			time.Unix(1<<33, 999).UTC(),
+			time.Unix(-1, 5).UTC(),
+		},
+		private: 1,
+	}
+	data, err := msgpackMarshal(&want)
+	_assert(err == nil, "marshal: %v", err)
+
+	var got msgpackTagged
+	_assert(msgpackUnmarshal(data, &got) == nil, "unmarshal")
+	_assert(got.ID == 9 && got.Name == "tagged" && got.Skipped == "" && got.private == 0 && got.Array == want.Array,
+		"unexpected fields: %+v", got)
+	_assert(reflect.DeepEqual(got.Any, want.Any), "interface mismatch: %#v", got.Any)
+	for i := range want.Times {
+		_assert(got.Times[i].Equal(want.Times[i]), "time %d: got %v, want %v", i, got.Times[i], want.Times[i])
+	}
+
+	// 未知的字段被跳过，nil 将指针置空
+	data, _ = msgpackMarshal(map[string]interface{}{"Unknown": []int{1}, "name": "x"})
+	p := &msgpackTagged{Name: "old"}
+	_assert(msgpackUnmarshal(data, p) == nil && p.Name == "x", "unknown fields should be skipped")
+	ptr := &got
+	_assert(msgpackUnmarshal([]byte{0xc0}, &ptr) == nil && ptr == nil, "nil should clear pointer")
+}
+
+// TestMsgpack_Malformed 错误的数据返回错误，不会panic
+func TestMsgpack_Malformed(t *testing.T) {
+	var v interface{}
+	_assert(msgpackUnmarshal([]byte{0xc1}, &v) != nil, "0xc1 is never used")
+	_assert(errors.Is(msgpackUnmarshal([]byte{0x92, 0x01}, &v), io.ErrUnexpectedEOF), "truncated array")
+	_assert(msgpackUnmarshal([]byte{0xdd, 0xff, 0xff, 0xff, 0xff}, &v) != nil, "forged array length")
+	_assert(msgpackUnmarshal([]byte{0x01, 0x02}, &v) != nil, "trailing data")
+	var small int8
+	_assert(msgpackUnmarshal([]byte{0xcc, 0xc8}, &small) != nil, "200 overflows int8")
+	var u uint
+	_assert(msgpackUnmarshal([]byte{0xff}, &u) != nil, "-1 overflows uint")
+	_assert(msgpackUnmarshal([]byte{0x01}, v) != nil, "non-pointer")
+
+	_, err := msgpackReadValue(nil, bytes.NewReader([]byte{0xdb, 0xff, 0xff, 0xff, 0xff, 'a'}))
+	_assert(errors.Is(err, io.ErrUnexpectedEOF), "forged string length: %v", err)
+}
+
+// TestMsgpackCodec_InvalidBody 消息体类型不匹配时返回ErrInvalidBody，后续的消息不受影响
+func TestMsgpackCodec_InvalidBody(t *testing.T) {
+	conn := new(bufferConn)
+	c := NewMsgpackCodec(conn)
+	_ = c.Write(&Header{Seq: 1}, "not a number")
+	_ = c.Write(&Header{Seq: 2}, 2)
+
+	var h Header
+	var n int
+	_assert(c.ReadHeader(&h) == nil && h.Seq == 1, "read first header")
+	_assert(errors.Is(c.ReadBody(&n), ErrInvalidBody), "type mismatch should be ErrInvalidBody")
+	_assert(c.ReadHeader(&h) == nil && h.Seq == 2, "read second header: %+v", h)
+	_assert(c.ReadBody(&n) == nil && n == 2, "read second body")
+
+	conn.Write([]byte{0x81, 0xa1})
+	_assert(errors.Is(c.ReadHeader(&h), io.ErrUnexpectedEOF), "truncated header")
+}
@@ -0,0 +1,769 @@
+/*
+protobuf.go 实现了Codec接口，按照protobuf（proto3）的二进制格式编码Go结构体，不依赖生成的代码和第三方库，
+便于与使用protobuf的服务互通。编码和解码都基于反射，字段的编号和编码方式来自结构体的tag，格式与protoc-gen-go生成的一致：
+
+	Seq   uint64            `protobuf:"varint,2,opt,name=seq,proto3"`
+	Attrs map[string]int64  `protobuf:"bytes,5,rep,name=attrs,proto3" protobuf_key:"bytes,1,opt,name=key,proto3" protobuf_val:"varint,2,opt,name=value,proto3"`
+
+编码方式可以是varint、zigzag32、zigzag64（sint32、sint64）、fixed32、fixed64（包括float、double）和bytes
+（string、bytes、嵌套的消息和map）。结构体中只要有一个字段带有protobuf tag，就只编码带tag的字段；
+完全没有tag的结构体按照导出字段声明的顺序从1开始编号，编码方式根据字段类型推断，仅适合两端都是Go的场景。
+
+与proto3一致，值为零的标量字段不会被编码，指针类型的标量（optional）不为nil时总是编码；repeated 的数值类型使用packed编码，
+解码时两种形式都接受；未知的字段被跳过。time.Time 按照google.protobuf.Timestamp编码。
+消息体不是结构体时（例如int、string、[]int），编码为只有字段1的消息，与google.protobuf.Int64Value等包装类型兼容。
+
+ProtobufCodec 使用protobuf常用的长度前缀格式（writeDelimitedTo），每条消息依次写入varint编码的Header长度、Header、
+varint编码的Body长度、Body，因此类型不匹配时返回ErrInvalidBody，数据流的位置依然正确；protobufMarshaler 用于分帧的FrameCodec。
+Header 对应的消息定义为：
+
+	message Header {
+		string service_method = 1;
+		uint64 seq = 2;
+		string error = 3;
+		int64 timeout = 4; // 纳秒
+		map<string, string> metadata = 5;
+	}
+*/
+
+package codec
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// protobuf 的wire type
+const (
+	pbVarint  = 0
+	pbFixed64 = 1
+	pbBytes   = 2
+	pbFixed32 = 5
+
+	// pbMaxMessageSize 长度前缀允许的最大值，与protobuf的2GB限制一致
+	pbMaxMessageSize = math.MaxInt32
+	// pbMaxDepth 解码时允许的最大嵌套深度，与protobuf的默认值一致
+	pbMaxDepth = 100
+)
+
+var errProtobufTruncated = fmt.Errorf("rpc codec: protobuf: %w", io.ErrUnexpectedEOF)
+
+type ProtobufCodec struct {
+	conn   io.ReadWriteCloser
+	reader *bufio.Reader
+	buffer *bufio.Writer
+	raw    []byte // 读取消息时复用的缓冲区
+}
+
+var _ Codec = (*ProtobufCodec)(nil)
+
+func (p *ProtobufCodec) Close() error {
+	return p.conn.Close()
+}
+
+// readDelimited 读取一个带长度前缀的消息
+func (p *ProtobufCodec) readDelimited() ([]byte, error) {
+	n, err := binary.ReadUvarint(p.reader)
+	if err != nil {
+		return nil, err
+	}
+	if n > pbMaxMessageSize {
+		return nil, fmt.Errorf("rpc codec: protobuf: message of %d bytes is too large", n)
+	}
+	p.raw, err = appendN(p.raw[:0], p.reader, int(n))
+	return p.raw, err
+}
+
+func (p *ProtobufCodec) ReadHeader(header *Header) error {
+	data, err := p.readDelimited()
+	if err != nil {
+		return err
+	}
+	*header = Header{}
+	return protobufUnmarshal(data, header)
+}
+
+// ReadBody 先读取完整的消息体，i 为nil时丢弃，类型不匹配时返回ErrInvalidBody
+func (p *ProtobufCodec) ReadBody(i interface{}) error {
+	data, err := p.readDelimited()
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	if i == nil {
+		return nil
+	}
+	if err := protobufUnmarshal(data, i); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidBody, err)
+	}
+	return nil
+}
+
+func (p *ProtobufCodec) Write(header *Header, i interface{}) (err error) {
+	buf := getBuffer()
+	defer putBuffer(buf)
+	if *buf, err = protobufAppend(*buf, header); err != nil {
+		log.Println("rpc codec: protobuf error encoding header: ", err)
+		return err
+	}
+	headerLen := len(*buf)
+	if *buf, err = protobufAppend(*buf, i); err != nil {
+		log.Println("rpc codec: protobuf error encoding body: ", err)
+		return err
+	}
+	h, body := (*buf)[:headerLen], (*buf)[headerLen:]
+	defer func() {
+		if flushErr := p.buffer.Flush(); flushErr != nil {
+			_ = p.Close()
+			if err == nil {
+				err = flushErr
+			}
+		}
+	}()
+	var prefix [2 * binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(prefix[:], uint64(len(h)))
+	_, _ = p.buffer.Write(prefix[:n])
+	_, _ = p.buffer.Write(h)
+	n = binary.PutUvarint(prefix[:], uint64(len(body)))
+	_, _ = p.buffer.Write(prefix[:n])
+	_, err = p.buffer.Write(body)
+	return err
+}
+
+// NewProtobufCodec 构造函数
+func NewProtobufCodec(conn io.ReadWriteCloser) Codec {
+	return &ProtobufCodec{
+		conn:   conn,
+		reader: bufio.NewReader(conn),
+		buffer: bufio.NewWriter(conn),
+	}
+}
+
+// protobufMarshaler 用于分帧的FrameCodec
+type protobufMarshaler struct{}
+
+var _ AppendMarshaler = protobufMarshaler{}
+
+func (protobufMarshaler) Marshal(v interface{}) ([]byte, error) {
+	return protobufMarshal(v)
+}
+
+func (protobufMarshaler) AppendMarshal(dst []byte, v interface{}) ([]byte, error) {
+	return protobufAppend(dst, v)
+}
+
+func (protobufMarshaler) Unmarshal(data []byte, v interface{}) error {
+	return protobufUnmarshal(data, v)
+}
+
+// pbField 消息中的一个字段，map 字段的key和val描述map entry中的两个字段
+type pbField struct {
+	num      int
+	wireType int
+	encoding string // varint、zigzag32、zigzag64、fixed32、fixed64、bytes
+	index    []int
+	key, val *pbField
+}
+
+// pbFieldCache 缓存每个结构体类型的字段信息，键是reflect.Type，值是*pbFields
+var pbFieldCache sync.Map
+
+type pbFields struct {
+	list  []*pbField
+	byNum map[int]*pbField
+	err   error
+}
+
+var pbWireTypes = map[string]int{
+	"varint":   pbVarint,
+	"zigzag32": pbVarint,
+	"zigzag64": pbVarint,
+	"fixed32":  pbFixed32,
+	"fixed64":  pbFixed64,
+	"bytes":    pbBytes,
+}
+
+func protobufFields(t reflect.Type) (*pbFields, error) {
+	if fields, ok := pbFieldCache.Load(t); ok {
+		return fields.(*pbFields), fields.(*pbFields).err
+	}
+	fields := &pbFields{byNum: make(map[int]*pbField)}
+	fields.list, fields.err = protobufCollectFields(t)
+	for _, f := range fields.list {
+		if fields.byNum[f.num] != nil && fields.err == nil {
+			fields.err = fmt.Errorf("rpc codec: protobuf: duplicate field number %d in %s", f.num, t)
+		}
+		fields.byNum[f.num] = f
+	}
+	pbFieldCache.Store(t, fields)
+	return fields, fields.err
+}
+
+func protobufCollectFields(t reflect.Type) ([]*pbField, error) {
+	tagged := false
+	for i := 0; i < t.NumField(); i++ {
+		if _, ok := t.Field(i).Tag.Lookup("protobuf"); ok {
+			tagged = true
+			break
+		}
+	}
+	var list []*pbField
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if !sf.IsExported() {
+			continue
+		}
+		var f *pbField
+		var err error
+		if tagged {
+			tag, ok := sf.Tag.Lookup("protobuf")
+			if !ok {
+				continue
+			}
+			if f, err = protobufParseTag(tag); err == nil && sf.Type.Kind() == reflect.Map {
+				if f.key, err = protobufParseTag(sf.Tag.Get("protobuf_key")); err == nil {
+					f.val, err = protobufParseTag(sf.Tag.Get("protobuf_val"))
+				}
+			}
+		} else {
+			f, err = protobufInferField(len(list)+1, sf.Type)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("rpc codec: protobuf: field %s.%s: %v", t, sf.Name, err)
+		}
+		f.index = sf.Index
+		list = append(list, f)
+	}
+	return list, nil
+}
+
+// protobufParseTag 解析形如"varint,2,opt,name=seq,proto3"的tag，只使用前两项
+func protobufParseTag(tag string) (*pbField, error) {
+	parts := strings.Split(tag, ",")
+	if len(parts) < 2 {
+		return nil, fmt.Errorf("invalid tag %q", tag)
+	}
+	wireType, ok := pbWireTypes[parts[0]]
+	if !ok {
+		return nil, fmt.Errorf("unsupported encoding %q", parts[0])
+	}
+	num, err := strconv.Atoi(parts[1])
+	if err != nil || num < 1 || num > 1<<29-1 {
+		return nil, fmt.Errorf("invalid field number %q", parts[1])
+	}
+	return &pbField{num: num, wireType: wireType, encoding: parts[0]}, nil
+}
+
+// protobufInferField 没有tag时根据Go类型推断字段的编码方式
+func protobufInferField(num int, t reflect.Type) (*pbField, error) {
+	encoding, err := protobufInferEncoding(t, true)
+	if err != nil {
+		return nil, err
+	}
+	f := &pbField{num: num, wireType: pbWireTypes[encoding], encoding: encoding}
+	if t.Kind() == reflect.Map {
+		if f.key, err = protobufInferField(1, t.Key()); err != nil {
+			return nil, err
+		}
+		if f.val, err = protobufInferField(2, t.Elem()); err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// protobufInferEncoding repeated 为true时t可以是slice，此时返回元素的编码方式
+func protobufInferEncoding(t reflect.Type, repeated bool) (string, error) {
+	if t == timeType {
+		return "bytes", nil
+	}
+	switch t.Kind() {
+	case reflect.Bool, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "varint", nil
+	case reflect.Float32:
+		return "fixed32", nil
+	case reflect.Float64:
+		return "fixed64", nil
+	case reflect.String, reflect.Struct, reflect.Map:
+		return "bytes", nil
+	case reflect.Ptr:
+		if t.Elem().Kind() == reflect.Ptr {
+			break
+		}
+		return protobufInferEncoding(t.Elem(), false)
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return "bytes", nil
+		}
+		if repeated && t.Elem().Kind() != reflect.Map {
+			return protobufInferEncoding(t.Elem(), false)
+		}
+	}
+	return "", fmt.Errorf("unsupported type %s", t)
+}
+
+func protobufMarshal(v interface{}) ([]byte, error) {
+	data, err := protobufAppend(nil, v)
+	if data == nil && err == nil {
+		data = []byte{}
+	}
+	return data, err
+}
+
+// protobufAppend 将v编码之后追加到dst
+func protobufAppend(dst []byte, v interface{}) ([]byte, error) {
+	rv := reflect.ValueOf(v)
+	for rv.Kind() == reflect.Ptr && !rv.IsNil() && rv.Elem().Kind() == reflect.Ptr {
+		rv = rv.Elem()
+	}
+	if rv.Kind() == reflect.Ptr {
+		if rv.IsNil() {
+			return dst, nil
+		}
+		rv = rv.Elem()
+	}
+	if !rv.IsValid() {
+		return dst, nil
+	}
+	if rv.Kind() == reflect.Struct {
+		return protobufEncodeMessage(dst, rv)
+	}
+	// 不是结构体时编码为只有字段1的包装消息
+	f, err := protobufInferField(1, rv.Type())
+	if err != nil {
+		return dst, fmt.Errorf("rpc codec: protobuf: %v", err)
+	}
+	return protobufEncodeField(dst, f, rv)
+}
+
+func protobufEncodeMessage(buf []byte, v reflect.Value) ([]byte, error) {
+	if v.Type() == timeType {
+		t := v.Interface().(time.Time)
+		buf = protobufAppendTag(buf, 1, pbVarint)
+		buf = binary.AppendUvarint(buf, uint64(t.Unix()))
+		if t.Nanosecond() != 0 {
+			buf = protobufAppendTag(buf, 2, pbVarint)
+			buf = binary.AppendUvarint(buf, uint64(t.Nanosecond()))
+		}
+		return buf, nil
+	}
+	fields, err := protobufFields(v.Type())
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range fields.list {
+		if buf, err = protobufEncodeField(buf, f, v.FieldByIndex(f.index)); err != nil {
+			return nil, err
+		}
+	}
+	return buf, nil
+}
+
+func protobufAppendTag(buf []byte, num, wireType int) []byte {
+	return binary.AppendUvarint(buf, uint64(num)<<3|uint64(wireType))
+}
+
+// protobufEncodeField 编码字段f，值为零的标量、nil 指针和空的repeated字段不会被编码
+func protobufEncodeField(buf []byte, f *pbField, v reflect.Value) ([]byte, error) {
+	var err error
+	switch {
+	case v.Kind() == reflect.Ptr:
+		if v.IsNil() {
+			return buf, nil
+		}
+		buf = protobufAppendTag(buf, f.num, f.wireType)
+		return protobufEncodeValue(buf, f, v.Elem())
+	case v.Kind() == reflect.Map:
+		if f.key == nil || f.val == nil {
+			return nil, fmt.Errorf("rpc codec: protobuf: map field %d without protobuf_key or protobuf_val", f.num)
+		}
+		iter := v.MapRange()
+		for iter.Next() {
+			var entry []byte
+			if entry, err = protobufEncodeEntry(f.key, iter.Key()); err != nil {
+				return nil, err
+			}
+			var val []byte
+			if val, err = protobufEncodeEntry(f.val, iter.Value()); err != nil {
+				return nil, err
+			}
+			entry = append(entry, val...)
+			buf = protobufAppendTag(buf, f.num, pbBytes)
+			buf = binary.AppendUvarint(buf, uint64(len(entry)))
+			buf = append(buf, entry...)
+		}
+		return buf, nil
+	case v.Kind() == reflect.Slice && v.Type().Elem().Kind() != reflect.Uint8:
+		if v.Len() == 0 {
+			return buf, nil
+		}
+		// 数值类型使用packed编码
+		if f.wireType != pbBytes {
+			var packed []byte
+			for i := 0; i < v.Len(); i++ {
+				if packed, err = protobufEncodeValue(packed, f, v.Index(i)); err != nil {
+					return nil, err
+				}
+			}
+			buf = protobufAppendTag(buf, f.num, pbBytes)
+			buf = binary.AppendUvarint(buf, uint64(len(packed)))
+			return append(buf, packed...), nil
+		}
+		for i := 0; i < v.Len(); i++ {
+			buf = protobufAppendTag(buf, f.num, f.wireType)
+			if buf, err = protobufEncodeValue(buf, f, v.Index(i)); err != nil {
+				return nil, err
+			}
+		}
+		return buf, nil
+	}
+	if v.IsZero() {
+		return buf, nil
+	}
+	buf = protobufAppendTag(buf, f.num, f.wireType)
+	return protobufEncodeValue(buf, f, v)
+}
+
+// protobufEncodeEntry 编码map entry中的key或者value，与生成的代码一致，值为零时也会编码
+func protobufEncodeEntry(f *pbField, v reflect.Value) ([]byte, error) {
+	buf := protobufAppendTag(nil, f.num, f.wireType)
+	return protobufEncodeValue(buf, f, v)
+}
+
+// protobufEncodeValue 编码一个不带tag的值，bytes 编码方式包括长度前缀；nil 指针编码为零值
+func protobufEncodeValue(buf []byte, f *pbField, v reflect.Value) ([]byte, error) {
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			v = reflect.New(v.Type().Elem())
+		}
+		v = v.Elem()
+	}
+	switch f.encoding {
+	case "varint":
+		switch v.Kind() {
+		case reflect.Bool:
+			if v.Bool() {
+				return append(buf, 1), nil
+			}
+			return append(buf, 0), nil
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			return binary.AppendUvarint(buf, uint64(v.Int())), nil
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			return binary.AppendUvarint(buf, v.Uint()), nil
+		}
+	case "zigzag32":
+		if isIntKind(v.Kind()) {
+			x := int32(v.Int())
+			return binary.AppendUvarint(buf, uint64(uint32(x<<1^x>>31))), nil
+		}
+	case "zigzag64":
+		if isIntKind(v.Kind()) {
+			x := v.Int()
+			return binary.AppendUvarint(buf, uint64(x<<1^x>>63)), nil
+		}
+	case "fixed32":
+		switch {
+		case v.Kind() == reflect.Float32:
+			return binary.LittleEndian.AppendUint32(buf, math.Float32bits(float32(v.Float()))), nil
+		case isIntKind(v.Kind()):
+			return binary.LittleEndian.AppendUint32(buf, uint32(v.Int())), nil
+		case isUintKind(v.Kind()):
+			return binary.LittleEndian.AppendUint32(buf, uint32(v.Uint())), nil
+		}
+	case "fixed64":
+		switch {
+		case v.Kind() == reflect.Float64:
+			return binary.LittleEndian.AppendUint64(buf, math.Float64bits(v.Float())), nil
+		case isIntKind(v.Kind()):
+			return binary.LittleEndian.AppendUint64(buf, uint64(v.Int())), nil
+		case isUintKind(v.Kind()):
+			return binary.LittleEndian.AppendUint64(buf, v.Uint()), nil
+		}
+	case "bytes":
+		switch {
+		case v.Kind() == reflect.String:
+			buf = binary.AppendUvarint(buf, uint64(v.Len()))
+			return append(buf, v.String()...), nil
+		case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8:
+			buf = binary.AppendUvarint(buf, uint64(v.Len()))
+			return append(buf, v.Bytes()...), nil
+		case v.Kind() == reflect.Struct:
+			msg, err := protobufEncodeMessage(nil, v)
+			if err != nil {
+				return nil, err
+			}
+			buf = binary.AppendUvarint(buf, uint64(len(msg)))
+			return append(buf, msg...), nil
+		}
+	}
+	return nil, fmt.Errorf("rpc codec: protobuf: cannot encode %s as %s", v.Type(), f.encoding)
+}
+
+func isIntKind(k reflect.Kind) bool {
+	return k >= reflect.Int && k <= reflect.Int64
+}
+
+func isUintKind(k reflect.Kind) bool {
+	return k >= reflect.Uint && k <= reflect.Uint64
+}
+
+func protobufUnmarshal(data []byte, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return fmt.Errorf("rpc codec: protobuf: Unmarshal(non-pointer %T)", v)
+	}
+	rv = rv.Elem()
+	rv.Set(reflect.Zero(rv.Type()))
+	if rv.Kind() == reflect.Struct {
+		return protobufDecodeMessage(data, rv, 0)
+	}
+	// 不是结构体时从包装消息的字段1解码
+	f, err := protobufInferField(1, rv.Type())
+	if err != nil {
+		return fmt.Errorf("rpc codec: protobuf: %v", err)
+	}
+	return protobufDecodeFields(data, 0, func(num int) (*pbField, reflect.Value) {
+		if num == 1 {
+			return f, rv
+		}
+		return nil, reflect.Value{}
+	})
+}
+
+func protobufDecodeMessage(data []byte, v reflect.Value, depth int) error {
+	if depth > pbMaxDepth {
+		return errors.New("rpc codec: protobuf: exceeded max depth")
+	}
+	if v.Type() == timeType {
+		var sec, nsec int64
+		err := protobufDecodeFields(data, depth, func(num int) (*pbField, reflect.Value) {
+			switch num {
+			case 1:
+				return &pbField{num: 1, wireType: pbVarint, encoding: "varint"}, reflect.ValueOf(&sec).Elem()
+			case 2:
+				return &pbField{num: 2, wireType: pbVarint, encoding: "varint"}, reflect.ValueOf(&nsec).Elem()
+			}
+			return nil, reflect.Value{}
+		})
+		if err != nil {
+			return err
+		}
+		v.Set(reflect.ValueOf(time.Unix(sec, nsec)))
+		return nil
+	}
+	fields, err := protobufFields(v.Type())
+	if err != nil {
+		return err
+	}
+	return protobufDecodeFields(data, depth, func(num int) (*pbField, reflect.Value) {
+		f := fields.byNum[num]
+		if f == nil {
+			return nil, reflect.Value{}
+		}
+		return f, v.FieldByIndex(f.index)
+	})
+}
+
+/*
+protobufDecodeFields 依次读取data中的字段，lookup 返回字段编号对应的字段信息和目标值，未知的字段被跳过
+*/
+func protobufDecodeFields(data []byte, depth int, lookup func(num int) (*pbField, reflect.Value)) error {
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			return errProtobufTruncated
+		}
+		data = data[n:]
+		num, wireType := int(key>>3), int(key&7)
+		if num == 0 {
+			return errors.New("rpc codec: protobuf: invalid field number 0")
+		}
+		var u uint64
+		var b []byte
+		switch wireType {
+		case pbVarint:
+			if u, n = binary.Uvarint(data); n <= 0 {
+				return errProtobufTruncated
+			}
+		case pbFixed64:
+			if n = 8; len(data) < n {
+				return errProtobufTruncated
+			}
+			u = binary.LittleEndian.Uint64(data)
+		case pbFixed32:
+			if n = 4; len(data) < n {
+				return errProtobufTruncated
+			}
+			u = uint64(binary.LittleEndian.Uint32(data))
+		case pbBytes:
+			size, m := binary.Uvarint(data)
+			if m <= 0 || size > uint64(len(data)-m) {
+				return errProtobufTruncated
+			}
+			b, n = data[m:m+int(size)], m+int(size)
+		default:
+			return fmt.Errorf("rpc codec: protobuf: unsupported wire type %d", wireType)
+		}
+		data = data[n:]
+		f, v := lookup(num)
+		if f == nil {
+			continue
+		}
+		if err := protobufDecodeField(f, v, wireType, u, b, depth); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// protobufDecodeField 将一个字段的值解码到v，repeated 字段追加，map 字段插入，嵌套的消息合并
+func protobufDecodeField(f *pbField, v reflect.Value, wireType int, u uint64, b []byte, depth int) error {
+	switch {
+	case v.Kind() == reflect.Map:
+		if wireType != pbBytes || f.key == nil || f.val == nil {
+			return fmt.Errorf("rpc codec: protobuf: invalid map field %d", f.num)
+		}
+		key := reflect.New(v.Type().Key()).Elem()
+		val := reflect.New(v.Type().Elem()).Elem()
+		err := protobufDecodeFields(b, depth+1, func(num int) (*pbField, reflect.Value) {
+			switch num {
+			case f.key.num:
+				return f.key, key
+			case f.val.num:
+				return f.val, val
+			}
+			return nil, reflect.Value{}
+		})
+		if err != nil {
+			return err
+		}
+		if v.IsNil() {
+			v.Set(reflect.MakeMap(v.Type()))
+		}
+		v.SetMapIndex(key, val)
+		return nil
+	case v.Kind() == reflect.Slice && v.Type().Elem().Kind() != reflect.Uint8:
+		// packed 编码的数值类型
+		if wireType == pbBytes && f.wireType != pbBytes {
+			for len(b) > 0 {
+				var n int
+				switch f.wireType {
+				case pbVarint:
+					if u, n = binary.Uvarint(b); n <= 0 {
+						return errProtobufTruncated
+					}
+				case pbFixed64:
+					if n = 8; len(b) < n {
+						return errProtobufTruncated
+					}
+					u = binary.LittleEndian.Uint64(b)
+				case pbFixed32:
+					if n = 4; len(b) < n {
+						return errProtobufTruncated
+					}
+					u = uint64(binary.LittleEndian.Uint32(b))
+				}
+				b = b[n:]
+				elem := reflect.New(v.Type().Elem()).Elem()
+				if err := protobufDecodeField(f, elem, f.wireType, u, nil, depth); err != nil {
+					return err
+				}
+				v.Set(reflect.Append(v, elem))
+			}
+			return nil
+		}
+		elem := reflect.New(v.Type().Elem()).Elem()
+		if err := protobufDecodeField(f, elem, wireType, u, b, depth); err != nil {
+			return err
+		}
+		v.Set(reflect.Append(v, elem))
+		return nil
+	case v.Kind() == reflect.Ptr:
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return protobufDecodeField(f, v.Elem(), wireType, u, b, depth)
+	}
+	if wireType != f.wireType {
+		return fmt.Errorf("rpc codec: protobuf: field %d has wire type %d, want %d", f.num, wireType, f.wireType)
+	}
+	switch f.encoding {
+	case "varint", "zigzag32", "zigzag64":
+		var i int64
+		switch f.encoding {
+		case "varint":
+			i = int64(u)
+		case "zigzag32":
+			i = int64(int32(uint32(u)>>1) ^ -int32(u&1))
+		default:
+			i = int64(u>>1) ^ -int64(u&1)
+		}
+		switch {
+		case v.Kind() == reflect.Bool:
+			v.SetBool(u != 0)
+			return nil
+		case isIntKind(v.Kind()):
+			// int32 的负数被符号扩展为64位
+			if v.OverflowInt(i) {
+				return fmt.Errorf("rpc codec: protobuf: %d overflows %s", i, v.Type())
+			}
+			v.SetInt(i)
+			return nil
+		case isUintKind(v.Kind()) && f.encoding == "varint":
+			if v.OverflowUint(u) {
+				return fmt.Errorf("rpc codec: protobuf: %d overflows %s", u, v.Type())
+			}
+			v.SetUint(u)
+			return nil
+		}
+	case "fixed32":
+		switch {
+		case v.Kind() == reflect.Float32:
+			v.SetFloat(float64(math.Float32frombits(uint32(u))))
+			return nil
+		case isIntKind(v.Kind()):
+			v.SetInt(int64(int32(uint32(u))))
+			return nil
+		case isUintKind(v.Kind()):
+			v.SetUint(u)
+			return nil
+		}
+	case "fixed64":
+		switch {
+		case v.Kind() == reflect.Float64:
+			v.SetFloat(math.Float64frombits(u))
+			return nil
+		case isIntKind(v.Kind()):
+			v.SetInt(int64(u))
+			return nil
+		case isUintKind(v.Kind()):
+			v.SetUint(u)
+			return nil
+		}
+	case "bytes":
+		switch {
+		case v.Kind() == reflect.String:
+			v.SetString(string(b))
+			return nil
+		case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8:
+			v.SetBytes(append([]byte{}, b...))
+			return nil
+		case v.Kind() == reflect.Struct:
+			return protobufDecodeMessage(b, v, depth+1)
+		}
+	}
+	return fmt.Errorf("rpc codec: protobuf: cannot decode %s into %s", f.encoding, v.Type())
+}
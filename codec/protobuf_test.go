@@ -0,0 +1,158 @@
+package codec
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type pbTest1 struct {
+	A int32 `protobuf:"varint,1,opt,name=a,proto3"`
+}
+
+type pbScalars struct {
+	Sint    int32   `protobuf:"zigzag32,1,opt,name=sint,proto3"`
+	Sint64  int64   `protobuf:"zigzag64,2,opt,name=sint64,proto3"`
+	Fixed   uint32  `protobuf:"fixed32,3,opt,name=fixed,proto3"`
+	Sfixed  int64   `protobuf:"fixed64,4,opt,name=sfixed,proto3"`
+	Float   float32 `protobuf:"fixed32,5,opt,name=float,proto3"`
+	Double  float64 `protobuf:"fixed64,6,opt,name=double,proto3"`
+	Flag    bool    `protobuf:"varint,7,opt,name=flag,proto3"`
+	Neg     int32   `protobuf:"varint,8,opt,name=neg,proto3"`
+	Data    []byte  `protobuf:"bytes,9,opt,name=data,proto3"`
+	Opt     *int64  `protobuf:"varint,10,opt,name=opt,proto3,oneof"`
+	Ignored string
+}
+
+type pbMessage struct {
+	B        string             `protobuf:"bytes,2,opt,name=b,proto3"`
+	C        *pbTest1           `protobuf:"bytes,3,opt,name=c,proto3"`
+	D        []int32            `protobuf:"varint,4,rep,packed,name=d,proto3"`
+	Children []*pbTest1         `protobuf:"bytes,5,rep,name=children,proto3"`
+	Names    []string           `protobuf:"bytes,6,rep,name=names,proto3"`
+	Attrs    map[string]int64   `protobuf:"bytes,7,rep,name=attrs,proto3" protobuf_key:"bytes,1,opt,name=key,proto3" protobuf_val:"varint,2,opt,name=value,proto3"`
+	Nested   map[int32]*pbTest1 `protobuf:"bytes,8,rep,name=nested,proto3" protobuf_key:"varint,1,opt,name=key,proto3" protobuf_val:"bytes,2,opt,name=value,proto3"`
+	At       time.Time          `protobuf:"bytes,9,opt,name=at,proto3"`
+}
+
+// TestProtobuf_Format 编码结果与protobuf文档中的示例一致
+func TestProtobuf_Format(t *testing.T) {
+	cases := []struct {
+		v    interface{}
+		want []byte
+	}{
+		{&pbTest1{A: 150}, []byte{0x08, 0x96, 0x01}},
+		{&pbTest1{}, []byte{}},
+		{&pbMessage{B: "testing"}, []byte{0x12, 0x07, 't', 'e', 's', 't', 'i', 'n', 'g'}},
+		{&pbMessage{C: &pbTest1{A: 150}}, []byte{0x1a, 0x03, 0x08, 0x96, 0x01}},
+		{&pbMessage{D: []int32{3, 270, 86942}}, []byte{0x22, 0x06, 0x03, 0x8e, 0x02, 0x9e, 0xa7, 0x05}},
+		{&pbMessage{Attrs: map[string]int64{"a": 1}}, []byte{0x3a, 0x05, 0x0a, 0x01, 'a', 0x10, 0x01}},
+		{&pbScalars{Sint: -1, Sint64: 1}, []byte{0x08, 0x01, 0x10, 0x02}},
+		{&pbScalars{Neg: -1}, []byte{0x40, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01}},
+		{&pbScalars{Double: 1}, []byte{0x31, 0, 0, 0, 0, 0, 0, 0xf0, 0x3f}},
+		{&pbScalars{Ignored: "x"}, []byte{}},
+		// 不是结构体时编码为google.protobuf.Int64Value等包装类型
+		{int64(150), []byte{0x08, 0x96, 0x01}},
+		{"testing", []byte{0x0a, 0x07, 't', 'e', 's', 't', 'i', 'n', 'g'}},
+		{time.Unix(1, 2), []byte{0x08, 0x01, 0x10, 0x02}},
+		{&Header{Seq: 1, ServiceMethod: "A.B"}, []byte{0x0a, 0x03, 'A', '.', 'B', 0x10, 0x01}},
+	}
+	for _, c := range cases {
+		got, err := protobufMarshal(c.v)
+		_assert(err == nil && bytes.Equal(got, c.want), "encode %+v: got % x, want % x (%v)", c.v, got, c.want, err)
+	}
+}
+
+func TestProtobuf_RoundTrip(t *testing.T) {
+	zero := int64(0)
+	scalars := pbScalars{
+		Sint: math.MinInt32, Sint64: math.MaxInt64, Fixed: math.MaxUint32, Sfixed: -2,
+		Float: 1.5, Double: -0.25, Flag: true, Neg: -3, Data: []byte{0, 1}, Opt: &zero,
+	}
+	data, err := protobufMarshal(&scalars)
+	_assert(err == nil, "marshal scalars: %v", err)
+	var gotScalars pbScalars
+	_assert(protobufUnmarshal(data, &gotScalars) == nil && reflect.DeepEqual(gotScalars, scalars),
+		"scalars mismatch: %+v", gotScalars)
+
+	msg := pbMessage{
+		B:        "b",
+		C:        &pbTest1{A: -1},
+		D:        []int32{1, -1, 1 << 20},
+		Children: []*pbTest1{{A: 1}, {}},
+		Names:    []string{"x", ""},
+		Attrs:    map[string]int64{"zero": 0, "big": math.MinInt64},
+		Nested:   map[int32]*pbTest1{-5: {A: 5}},
+		At:       time.Date(1960, 1, 2, 3, 4, 5, 6, time.UTC),
+	}
+	data, err = protobufMarshal(&msg)
+	_assert(err == nil, "marshal message: %v", err)
+	var gotMsg pbMessage
+	_assert(protobufUnmarshal(data, &gotMsg) == nil, "unmarshal message")
+	_assert(gotMsg.At.Equal(msg.At), "time mismatch: %v", gotMsg.At)
+	gotMsg.At = msg.At
+	_assert(reflect.DeepEqual(gotMsg, msg), "message mismatch: %+v", gotMsg)
+}
+
+// TestProtobuf_Decode 接受未packed的repeated字段，跳过未知的字段
+func TestProtobuf_Decode(t *testing.T) {
+	data := []byte{
+		0x20, 0x03, 0x20, 0x8e, 0x02, // D: 3, 270，未packed
+		0x78, 0x01, // 字段15，varint
+		0x81, 0x01, 0, 0, 0, 0, 0, 0, 0, 0, // 字段16，fixed64
+		0x8a, 0x01, 0x01, 0x00, // 字段17，bytes
+		0x95, 0x01, 0, 0, 0, 0, // 字段18，fixed32
+		0x12, 0x01, 'b',
+	}
+	var m pbMessage
+	_assert(protobufUnmarshal(data, &m) == nil, "unmarshal")
+	_assert(reflect.DeepEqual(m.D, []int32{3, 270}) && m.B == "b", "unexpected message: %+v", m)
+}
+
+// TestProtobuf_Malformed 错误的数据返回错误，不会panic
+func TestProtobuf_Malformed(t *testing.T) {
+	var m pbMessage
+	cases := [][]byte{
+		{0x08},                               // 缺少varint
+		{0x12, 0x05, 'a'},                    // 长度超出数据
+		{0x12, 0xff, 0xff, 0xff, 0xff, 0x0f}, // 伪造的长度
+		{0x0b},                               // group
+		{0x00, 0x00},                         // 字段0
+		{0x10, 0x01},                         // B 的wire type不匹配
+		{0x22, 0x01, 0x80},                   // packed 中截断的varint
+	}
+	for _, data := range cases {
+		_assert(protobufUnmarshal(data, &m) != nil, "% x should fail", data)
+	}
+	var small int8
+	_assert(protobufUnmarshal([]byte{0x08, 0x80, 0x02}, &small) != nil, "256 overflows int8")
+	_assert(protobufUnmarshal([]byte{}, m) != nil, "non-pointer")
+	_, err := protobufMarshal(struct{ C chan int }{})
+	_assert(err != nil, "chan is not supported")
+}
+
+// TestProtobufCodec_Delimited 每条消息是两个带varint长度前缀的protobuf消息，类型不匹配时返回ErrInvalidBody
+func TestProtobufCodec_Delimited(t *testing.T) {
+	conn := new(bufferConn)
+	c := NewProtobufCodec(conn)
+	_ = c.Write(&Header{Seq: 1}, &pbTest1{A: 150})
+	_assert(bytes.Equal(conn.Bytes(), []byte{0x02, 0x10, 0x01, 0x03, 0x08, 0x96, 0x01}), "unexpected bytes: % x", conn.Bytes())
+	_ = c.Write(&Header{Seq: 2}, "not a number")
+	_ = c.Write(&Header{Seq: 3}, 3)
+
+	var h Header
+	var n int
+	_assert(c.ReadHeader(&h) == nil && h.Seq == 1, "read first header")
+	_assert(c.ReadBody(nil) == nil, "discard first body")
+	_assert(c.ReadHeader(&h) == nil && h.Seq == 2, "read second header")
+	_assert(errors.Is(c.ReadBody(&n), ErrInvalidBody), "type mismatch should be ErrInvalidBody")
+	_assert(c.ReadHeader(&h) == nil && h.Seq == 3, "read third header: %+v", h)
+	_assert(c.ReadBody(&n) == nil && n == 3, "read third body")
+
+	conn.Write([]byte{0x05, 0x10})
+	_assert(errors.Is(c.ReadHeader(&h), io.ErrUnexpectedEOF), "truncated header")
+}
@@ -0,0 +1,176 @@
+/*
+snappy.go 实现了snappy的块格式（不包括分块的流格式和校验和），数据的开头是varint编码的原始长度，
+之后是一系列元素，每个元素第一个字节的低两位是tag：
+
+	00 literal 高6位是长度-1，60~63 表示长度-1存放在之后的1~4个字节中（小端序）
+	01 copy    长度4~11（3位），offset 11位
+	10 copy    长度1~64（高6位），offset 2个字节
+	11 copy    长度1~64（高6位），offset 4个字节
+
+copy 表示从已经解压的数据中倒退offset个字节，复制length个字节，可以与自身重叠。
+压缩时使用哈希表查找之前出现过的4个字节，贪心地扩展匹配，offset 不超过64KB。
+*/
+
+package codec
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+const (
+	snappyTagLiteral = 0x00
+	snappyTagCopy1   = 0x01
+	snappyTagCopy2   = 0x02
+	snappyTagCopy4   = 0x03
+
+	snappyTableBits = 14
+	snappyMaxOffset = 1<<16 - 1
+	// snappyMaxExpansion 一个合法的元素解压之后最多是自身长度的64/3倍，用来拒绝伪造的原始长度
+	snappyMaxExpansion = 22
+)
+
+var errSnappyCorrupt = errors.New("rpc codec: snappy: corrupt input")
+
+type snappyCompressor struct{}
+
+func (snappyCompressor) Compress(src []byte) ([]byte, error) {
+	return snappyEncode(src), nil
+}
+
+func (snappyCompressor) Decompress(src []byte, limit int) ([]byte, error) {
+	return snappyDecode(src, limit)
+}
+
+func snappyEncode(src []byte) []byte {
+	dst := binary.AppendUvarint(make([]byte, 0, len(src)/2+16), uint64(len(src)))
+	var table [1 << snappyTableBits]int32
+	lit := 0 // 还没有输出的literal的起始位置
+	for i := 0; i+4 <= len(src); {
+		v := binary.LittleEndian.Uint32(src[i:])
+		h := (v * 0x1e35a7bd) >> (32 - snappyTableBits)
+		candidate := int(table[h])
+		table[h] = int32(i)
+		if candidate >= i || i-candidate > snappyMaxOffset || binary.LittleEndian.Uint32(src[candidate:]) != v {
+			i++
+			continue
+		}
+		length := 4
+		for i+length < len(src) && src[candidate+length] == src[i+length] {
+			length++
+		}
+		dst = snappyAppendLiteral(dst, src[lit:i])
+		dst = snappyAppendCopy(dst, i-candidate, length)
+		i += length
+		lit = i
+	}
+	return snappyAppendLiteral(dst, src[lit:])
+}
+
+func snappyAppendLiteral(dst, lit []byte) []byte {
+	if len(lit) == 0 {
+		return dst
+	}
+	n := len(lit) - 1
+	switch {
+	case n < 60:
+		dst = append(dst, byte(n)<<2|snappyTagLiteral)
+	case n < 1<<8:
+		dst = append(dst, 60<<2|snappyTagLiteral, byte(n))
+	case n < 1<<16:
+		dst = append(dst, 61<<2|snappyTagLiteral, byte(n), byte(n>>8))
+	case n < 1<<24:
+		dst = append(dst, 62<<2|snappyTagLiteral, byte(n), byte(n>>8), byte(n>>16))
+	default:
+		dst = append(dst, 63<<2|snappyTagLiteral, byte(n), byte(n>>8), byte(n>>16), byte(n>>24))
+	}
+	return append(dst, lit...)
+}
+
+// snappyAppendCopy 输出copy元素，较长的匹配拆分为多个元素，并保证最后一个元素的长度不小于4
+func snappyAppendCopy(dst []byte, offset, length int) []byte {
+	for length >= 68 {
+		dst = append(dst, 63<<2|snappyTagCopy2, byte(offset), byte(offset>>8))
+		length -= 64
+	}
+	if length > 64 {
+		dst = append(dst, 59<<2|snappyTagCopy2, byte(offset), byte(offset>>8))
+		length -= 60
+	}
+	if length >= 12 || offset >= 2048 {
+		return append(dst, byte(length-1)<<2|snappyTagCopy2, byte(offset), byte(offset>>8))
+	}
+	return append(dst, byte(offset>>8)<<5|byte(length-4)<<2|snappyTagCopy1, byte(offset))
+}
+
+func snappyDecode(src []byte, limit int) ([]byte, error) {
+	n, k := binary.Uvarint(src)
+	if k <= 0 || n > uint64(len(src))*snappyMaxExpansion {
+		return nil, errSnappyCorrupt
+	}
+	if limit > 0 && n > uint64(limit) {
+		return nil, fmt.Errorf("%w: decompressed body exceeds limit %d", ErrMessageTooLarge, limit)
+	}
+	src = src[k:]
+	dst := make([]byte, 0, n)
+	for len(src) > 0 {
+		tag := src[0]
+		var offset, length int
+		switch tag & 0x03 {
+		case snappyTagLiteral:
+			length = int(tag >> 2)
+			src = src[1:]
+			if length >= 60 {
+				extra := length - 59
+				if len(src) < extra {
+					return nil, errSnappyCorrupt
+				}
+				length = 0
+				for j := 0; j < extra; j++ {
+					length |= int(src[j]) << (8 * j)
+				}
+				src = src[extra:]
+			}
+			length++
+			if length > len(src) || uint64(len(dst)+length) > n {
+				return nil, errSnappyCorrupt
+			}
+			dst = append(dst, src[:length]...)
+			src = src[length:]
+			continue
+		case snappyTagCopy1:
+			if len(src) < 2 {
+				return nil, errSnappyCorrupt
+			}
+			length = 4 + int(tag>>2&0x07)
+			offset = int(tag&0xe0)<<3 | int(src[1])
+			src = src[2:]
+		case snappyTagCopy2:
+			if len(src) < 3 {
+				return nil, errSnappyCorrupt
+			}
+			length = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint16(src[1:3]))
+			src = src[3:]
+		case snappyTagCopy4:
+			if len(src) < 5 {
+				return nil, errSnappyCorrupt
+			}
+			length = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint32(src[1:5]))
+			src = src[5:]
+		}
+		if offset <= 0 || offset > len(dst) || uint64(len(dst)+length) > n {
+			return nil, errSnappyCorrupt
+		}
+		// 复制的区域可以与正在写入的区域重叠，所以逐字节复制
+		for j := 0; j < length; j++ {
+			dst = append(dst, dst[len(dst)-offset])
+		}
+	}
+	if uint64(len(dst)) != n {
+		return nil, errSnappyCorrupt
+	}
+	return dst, nil
+}
@@ -6,6 +6,7 @@
 3. the method has two arguments, both exported (or builtin) types.
 4. the method's second argument is a pointer.
 5. the method has return type error.
+方法也可以在两个参数之前接收一个context.Context，用于感知超时和取消，例如Foo.Sleep。
 */
 package main
 
@@ -34,8 +35,13 @@ func (f Foo) Sum(args Args, reply *int) error {
 	return nil
 }
 
-func (f Foo) Sleep(args Args, reply *int) error {
-	time.Sleep(time.Second * time.Duration(args.Num1))
+// Sleep 接收context，调用方取消或者服务端处理超时时提前返回
+func (f Foo) Sleep(ctx context.Context, args Args, reply *int) error {
+	select {
+	case <-time.After(time.Second * time.Duration(args.Num1)):
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 	*reply = args.Num1 + args.Num2
 	return nil
 }
@@ -54,7 +60,7 @@ func startServer(registryAddr string, wg *sync.WaitGroup) {
 	l, _ := net.Listen("tcp", ":0")
 	s := server.NewServer()
 	_ = s.Register(&foo)
-	registry.Heartbeat(registryAddr, l.Addr().String(), 0)
+	registry.Heartbeat(registryAddr, "tcp@"+l.Addr().String(), 0)
 	wg.Done()
 	s.Accept(l)
 }
@@ -117,7 +123,8 @@ func broadcast(registry string) {
 					Num1: i,
 					Num2: i * 10,
 				})
-			ctx, _ := context.WithTimeout(context.Background(), time.Second*2)
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second*2)
+			defer cancel()
 			printLog(xc, ctx, "broadcast", "Foo.Sleep",
 				&Args{
 					Num1: i,
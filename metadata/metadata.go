@@ -0,0 +1,135 @@
+/*
+metadata 包实现了随RPC调用传递的键值对元数据，例如认证令牌、租户ID、链路追踪ID、请求ID等。
+客户端通过 NewOutgoingContext 或 AppendToOutgoingContext 将元数据附加到调用的context，
+client.Client.Call 与 xclient.XClient.Call 会把它放入 codec.Header.Metadata 随请求发送；
+服务端将收到的元数据通过 NewIncomingContext 附加到方法的context，方法使用 FromIncomingContext 读取。
+方法还可以通过 SetTrailer 设置响应的元数据（trailer），它随响应返回给客户端，
+客户端使用 WithTrailer 指定接收trailer的变量。
+*/
+
+package metadata
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// MD 元数据，键值均为字符串
+type MD map[string]string
+
+// Pairs 根据 key1, value1, key2, value2... 的形式构造元数据，参数个数为奇数时忽略最后一个
+func Pairs(kv ...string) MD {
+	md := make(MD, len(kv)/2)
+	for i := 0; i+1 < len(kv); i += 2 {
+		md[kv[i]] = kv[i+1]
+	}
+	return md
+}
+
+// Get 返回key对应的值，不存在时返回空字符串
+func (md MD) Get(key string) string {
+	return md[key]
+}
+
+// Copy 返回元数据的副本
+func (md MD) Copy() MD {
+	if md == nil {
+		return nil
+	}
+	out := make(MD, len(md))
+	for k, v := range md {
+		out[k] = v
+	}
+	return out
+}
+
+type (
+	outgoingKey struct{}
+	incomingKey struct{}
+	trailerKey  struct{}
+	receiverKey struct{}
+)
+
+// NewOutgoingContext 客户端使用，返回附加了元数据md的context，md会随该context发起的调用发送
+func NewOutgoingContext(ctx context.Context, md MD) context.Context {
+	return context.WithValue(ctx, outgoingKey{}, md.Copy())
+}
+
+// AppendToOutgoingContext 客户端使用，在ctx已有的元数据基础上追加键值对
+func AppendToOutgoingContext(ctx context.Context, kv ...string) context.Context {
+	md, _ := FromOutgoingContext(ctx)
+	if md == nil {
+		md = make(MD)
+	}
+	for k, v := range Pairs(kv...) {
+		md[k] = v
+	}
+	return context.WithValue(ctx, outgoingKey{}, md)
+}
+
+// FromOutgoingContext 返回ctx中将要发送的元数据的副本
+func FromOutgoingContext(ctx context.Context) (MD, bool) {
+	md, ok := ctx.Value(outgoingKey{}).(MD)
+	return md.Copy(), ok
+}
+
+// trailer 保存方法设置的响应元数据，方法可能在多个协程中设置，需要加锁
+type trailer struct {
+	mu sync.Mutex
+	md MD
+}
+
+/*
+NewIncomingContext 服务端使用，返回附加了请求元数据md的context，
+同时准备好接收方法通过 SetTrailer 设置的响应元数据
+*/
+func NewIncomingContext(ctx context.Context, md MD) context.Context {
+	ctx = context.WithValue(ctx, incomingKey{}, md)
+	return context.WithValue(ctx, trailerKey{}, new(trailer))
+}
+
+// FromIncomingContext 方法中使用，返回请求携带的元数据的副本
+func FromIncomingContext(ctx context.Context) (MD, bool) {
+	md, ok := ctx.Value(incomingKey{}).(MD)
+	return md.Copy(), ok
+}
+
+// SetTrailer 方法中使用，设置随响应返回的元数据，多次调用时合并
+func SetTrailer(ctx context.Context, md MD) error {
+	t, ok := ctx.Value(trailerKey{}).(*trailer)
+	if !ok {
+		return errors.New("rpc metadata: context is not an incoming rpc context")
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.md == nil {
+		t.md = make(MD, len(md))
+	}
+	for k, v := range md {
+		t.md[k] = v
+	}
+	return nil
+}
+
+// TrailerFromIncomingContext 服务端使用，返回方法设置的响应元数据的副本
+func TrailerFromIncomingContext(ctx context.Context) MD {
+	t, ok := ctx.Value(trailerKey{}).(*trailer)
+	if !ok {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.md.Copy()
+}
+
+// WithTrailer 客户端使用，调用成功或者服务端返回错误时，响应携带的元数据会写入md
+func WithTrailer(ctx context.Context, md *MD) context.Context {
+	return context.WithValue(ctx, receiverKey{}, md)
+}
+
+// TrailerReceiver 返回通过 WithTrailer 指定的接收变量，没有指定时返回nil
+func TrailerReceiver(ctx context.Context) *MD {
+	md, _ := ctx.Value(receiverKey{}).(*MD)
+	return md
+}
@@ -0,0 +1,47 @@
+package metadata
+
+import (
+	"context"
+	"fmt"
+	"testing"
+)
+
+func _assert(condition bool, msg string, v ...interface{}) {
+	if !condition {
+		panic(fmt.Sprintf("assertion failed: "+msg, v...))
+	}
+}
+
+func TestOutgoingContext(t *testing.T) {
+	ctx := NewOutgoingContext(context.Background(), Pairs("token", "abc", "dangling"))
+	ctx = AppendToOutgoingContext(ctx, "tenant", "t1")
+	md, ok := FromOutgoingContext(ctx)
+	_assert(ok && len(md) == 2 && md.Get("token") == "abc" && md.Get("tenant") == "t1",
+		"unexpected metadata: %v", md)
+
+	// 修改返回的副本不影响context中的元数据
+	md["token"] = "changed"
+	md, _ = FromOutgoingContext(ctx)
+	_assert(md.Get("token") == "abc", "metadata in context should not be modified")
+
+	_, ok = FromOutgoingContext(context.Background())
+	_assert(!ok, "background context has no metadata")
+}
+
+func TestIncomingContextAndTrailer(t *testing.T) {
+	_assert(SetTrailer(context.Background(), Pairs("k", "v")) != nil, "expect an error without rpc context")
+
+	ctx := NewIncomingContext(context.Background(), Pairs("request-id", "42"))
+	md, ok := FromIncomingContext(ctx)
+	_assert(ok && md.Get("request-id") == "42", "unexpected incoming metadata: %v", md)
+
+	_assert(TrailerFromIncomingContext(ctx) == nil, "no trailer before SetTrailer")
+	_assert(SetTrailer(ctx, Pairs("a", "1")) == nil, "set trailer")
+	_assert(SetTrailer(ctx, Pairs("b", "2")) == nil, "set trailer again")
+	tr := TrailerFromIncomingContext(ctx)
+	_assert(len(tr) == 2 && tr.Get("a") == "1" && tr.Get("b") == "2", "unexpected trailer: %v", tr)
+
+	var received MD
+	_assert(TrailerReceiver(WithTrailer(context.Background(), &received)) == &received, "trailer receiver")
+	_assert(TrailerReceiver(context.Background()) == nil, "no trailer receiver")
+}
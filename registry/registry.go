@@ -1,10 +1,12 @@
 /*
 服务端和客户端对于注册中心的通信均采用的是HTTP协议。客户端GET服务列表，服务端POST服务实例和心跳
+注册中心使用HTTPS（http.ServeTLS）时，服务端通过HeartbeatTLS发送心跳
 */
 
 package registry
 
 import (
+	"crypto/tls"
 	"log"
 	"net/http"
 	"sort"
@@ -106,29 +108,41 @@ func HandleHTTP() {
 
 // Heartbeat 服务启动时定时向注册中心发送心跳，默认周期比注册中心设置的过期时间少 1 min。
 func Heartbeat(registry, addr string, duration time.Duration) {
+	HeartbeatTLS(registry, addr, duration, nil)
+}
+
+// HeartbeatTLS 与Heartbeat相同，注册中心使用HTTPS时通过config验证注册中心的证书，config为nil时使用默认配置
+func HeartbeatTLS(registry, addr string, duration time.Duration, config *tls.Config) {
+	httpClient := http.DefaultClient
+	if config != nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = config
+		httpClient = &http.Client{Transport: transport}
+	}
 	if duration == 0 {
 		// 确保在超时之前有足够的时间发送心跳
 		duration = DefaultRegistry.timeout - time.Duration(1)*time.Minute
 	}
-	err := sendHeartbeat(registry, addr)
+	err := sendHeartbeat(httpClient, registry, addr)
 	go func() {
 		t := time.NewTicker(duration) // 启动一个定时器
 		// 只要不产生错误就一直定期发送心跳
 		for err == nil {
 			<-t.C
-			err = sendHeartbeat(registry, addr)
+			err = sendHeartbeat(httpClient, registry, addr)
 		}
 	}()
 }
 
-func sendHeartbeat(registry string, addr string) interface{} {
+func sendHeartbeat(httpClient *http.Client, registry string, addr string) error {
 	log.Println(addr, " send heartbeat to registry ", registry)
-	httpClient := &http.Client{}
 	req, _ := http.NewRequest("POST", registry, nil)
 	req.Header.Set("X-rpc-Server", addr)
-	if _, err := httpClient.Do(req); err != nil {
+	resp, err := httpClient.Do(req)
+	if err != nil {
 		log.Println("rpc server: heartbeat error:", err)
 		return err
 	}
+	_ = resp.Body.Close()
 	return nil
 }
@@ -0,0 +1,72 @@
+/*
+debug.go 实现了调试页面，以HTML表格的形式列出每个已注册的服务，
+以及服务中每个方法的签名（接收context的方法带有ctx参数）和调用次数。
+*/
+
+package server
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"sort"
+)
+
+const debugText = `<html>
+	<head><title>RPC Services</title></head>
+	<body>
+	{{range .}}
+	<hr>
+	Service {{.Name}}
+	<hr>
+		<table>
+		<th align=center>Method</th><th align=center>Calls</th>
+		{{range .Methods}}
+			<tr>
+			<td align=left font=fixed>{{.Name}}({{if .WithContext}}ctx context.Context, {{end}}{{.Type.ArgType}}, {{.Type.ReplyType}}) error</td>
+			<td align=center>{{.Type.NumCalls}}</td>
+			</tr>
+		{{end}}
+		</table>
+	{{end}}
+	</body>
+	</html>`
+
+var debugTemplate = template.Must(template.New("RPC debug").Parse(debugText))
+
+// debugHTTP 调试页面的http.Handler
+type debugHTTP struct {
+	*Server
+}
+
+// debugService 调试页面中的一个服务
+type debugService struct {
+	Name    string
+	Methods []debugMethod
+}
+
+// debugMethod 调试页面中的一个方法，WithContext 表示方法的第一个参数是context.Context
+type debugMethod struct {
+	Name        string
+	Type        *methodType
+	WithContext bool
+}
+
+// ServeHTTP 按照名称排序输出所有的服务和方法
+func (server debugHTTP) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	var services []debugService
+	server.serviceMap.Range(func(namei, svci interface{}) bool {
+		svc := svci.(*service)
+		ds := debugService{Name: namei.(string)}
+		for name, method := range svc.method {
+			ds.Methods = append(ds.Methods, debugMethod{Name: name, Type: method, WithContext: method.withContext})
+		}
+		sort.Slice(ds.Methods, func(i, j int) bool { return ds.Methods[i].Name < ds.Methods[j].Name })
+		services = append(services, ds)
+		return true
+	})
+	sort.Slice(services, func(i, j int) bool { return services[i].Name < services[j].Name })
+	if err := debugTemplate.Execute(w, services); err != nil {
+		_, _ = fmt.Fprintln(w, "rpc: error executing template:", err.Error())
+	}
+}
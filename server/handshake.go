@@ -0,0 +1,146 @@
+/*
+handshake.go 实现了连接建立时的握手应答。客户端发送Option之后，服务端用一行JSON回复Handshake，
+告诉客户端是否接受连接、使用的协议版本、编解码方式和服务端的限制，客户端收到应答之后才开始发送请求：
+
+	| Option{Version: 1, ...} | --->
+	                          <--- | Handshake{Version: 1, CodecType: ..., Error: ""} |
+	| Header | Body | ...     | --->
+
+Option.Version 为0的旧客户端不会等待应答，服务端也不会发送，保持与之前的协议兼容；
+新的客户端连接不回复应答的旧服务端时使用LegacyVersion，否则等待应答超时之后返回错误。
+协议版本取客户端和服务端支持的最高版本中较小的一个，以后修改消息格式时通过版本号协商：
+
+	0 没有握手应答，Header和Body直接由编解码器连续编码
+	1 服务端回复握手应答
+	2 握手应答之后的消息使用codec.FrameCodec分帧，编解码方式不支持分帧时退回版本1；
+	  可以协商压缩算法，旧的客户端不会请求压缩
+
+消息大小的限制（Server.MaxRequestSize、MaxResponseSize 和 Option.MaxResponseSize）只能在分帧的连接上执行，
+双方根据握手应答中的限制设置codec.Limiter：超过限制的请求或响应在发送之前就会失败，
+收到的超过限制的消息被跳过并返回codec.ErrMessageTooLarge，连接继续可用。
+设置了限制的一方拒绝无法分帧的连接（版本小于2，或者编解码方式不支持分帧），避免限制被绕过。
+*/
+
+package server
+
+import (
+	"fmt"
+	"io"
+	"rpc_test/codec"
+	"time"
+)
+
+// ProtocolVersion 当前实现支持的最高协议版本
+const ProtocolVersion = 2
+
+// FramingVersion 开始使用分帧消息格式的协议版本
+const FramingVersion = 2
+
+/*
+LegacyVersion 客户端显式选择版本0（没有握手应答），用于连接引入握手之前的旧服务端。
+client 包会把Option.Version的0替换为ProtocolVersion，所以需要一个不同的值；服务端把所有小于1的版本都当作0处理
+*/
+const LegacyVersion = -1
+
+// Handshake 服务端对Option的应答
+type Handshake struct {
+	Version         int           // 协商之后使用的协议版本
+	CodecType       codec.Type    // 连接使用的编解码方式
+	Codecs          []codec.Type  // 服务端支持的所有编解码方式
+	HandlerTimeout  time.Duration // 服务端实际使用的处理超时，0表示不限制
+	MaxRequestSize  int           // 服务端接受的最大请求，0表示不限制，设置了限制时只接受分帧的连接
+	MaxResponseSize int           // 服务端发送的最大响应，0表示不限制，设置了限制时只接受分帧的连接
+	// Compression CompressThreshold 双方使用的压缩算法和阈值，为空表示不压缩
+	Compression       codec.CompressionType
+	CompressThreshold int
+	Error             string // 拒绝连接的原因，为空表示接受
+}
+
+// negotiate 检查客户端的Option，返回握手应答，拒绝连接时应答的Error说明原因
+func (server *Server) negotiate(opt *Option) *Handshake {
+	ack := &Handshake{Version: opt.Version, CodecType: opt.CodecType, Codecs: codec.Types()}
+	if ack.Version > ProtocolVersion {
+		ack.Version = ProtocolVersion
+	}
+	if opt.MagicNumber != MagicNumber {
+		ack.Error = fmt.Sprintf("invalid magic number %x", opt.MagicNumber)
+		return ack
+	}
+	// 客户端给出了候选的编解码方式时，按照客户端的优先顺序选择第一个服务端也支持的
+	if len(opt.CodecTypes) > 0 {
+		ack.CodecType = ""
+		for _, t := range opt.CodecTypes {
+			if _, ok := codec.Lookup(t); ok {
+				ack.CodecType = t
+				break
+			}
+		}
+		if ack.CodecType == "" {
+			ack.Error = fmt.Sprintf("no mutually supported codec in %v, server supports %v", opt.CodecTypes, ack.Codecs)
+			return ack
+		}
+	}
+	if _, ok := codec.Lookup(ack.CodecType); !ok {
+		ack.Error = fmt.Sprintf("invalid codec type %s, server supports %v", ack.CodecType, ack.Codecs)
+		return ack
+	}
+	if _, ok := codec.LookupMarshaler(ack.CodecType); ack.Version >= FramingVersion && !ok {
+		ack.Version = FramingVersion - 1
+	}
+	// 流式的编解码器无法限制单条消息的大小，客户端可以通过更低的版本绕过限制
+	if ack.Version < FramingVersion && (server.MaxRequestSize > 0 || server.MaxResponseSize > 0) {
+		ack.Error = fmt.Sprintf("message size limits require protocol version %d with a framing codec, got version %d",
+			FramingVersion, ack.Version)
+		return ack
+	}
+	ack.HandlerTimeout = server.handlerTimeout(opt.HandlerTimeout)
+	if ack.Version >= FramingVersion {
+		ack.MaxRequestSize = server.MaxRequestSize
+		ack.MaxResponseSize = minSize(server.MaxResponseSize, opt.MaxResponseSize)
+		if codec.CompressorMap[opt.Compression] != nil && server.allowCompression(opt.Compression) {
+			ack.Compression = opt.Compression
+			ack.CompressThreshold = opt.CompressThreshold
+		}
+	}
+	return ack
+}
+
+// allowCompression 返回Server.Compressions是否允许压缩算法c
+func (server *Server) allowCompression(c codec.CompressionType) bool {
+	if server.Compressions == nil {
+		return true
+	}
+	for _, allowed := range server.Compressions {
+		if allowed == c {
+			return true
+		}
+	}
+	return false
+}
+
+// minSize 返回两个大小限制中较小的一个，0表示不限制
+func minSize(a, b int) int {
+	if a == 0 || (b != 0 && b < a) {
+		return b
+	}
+	return a
+}
+
+/*
+NewCodec 根据握手的结果构造连接使用的编解码器，客户端和服务端都使用它，保证双方的消息格式一致。
+通过codec.Lookup得到h.CodecType序列化方式的构造函数；分帧时使用codec.LookupMarshaler得到的Marshaler
+*/
+func (h *Handshake) NewCodec(conn io.ReadWriteCloser) (codec.Codec, error) {
+	if h.Version >= FramingVersion {
+		if m, ok := codec.LookupMarshaler(h.CodecType); ok {
+			cc := codec.NewFrameCodec(conn, m)
+			if c := codec.CompressorMap[h.Compression]; c != nil {
+				cc.(codec.Compressing).SetCompressor(c, h.CompressThreshold)
+			}
+			return cc, nil
+		}
+	} else if f, ok := codec.Lookup(h.CodecType); ok {
+		return f(conn), nil
+	}
+	return nil, fmt.Errorf("invalid codec type %s for protocol version %d", h.CodecType, h.Version)
+}
@@ -0,0 +1,67 @@
+/*
+http.go 让RPC与HTTP共用一个端口：客户端先向DefaultRPCPath发送一个CONNECT请求，
+服务端回复 "HTTP/1.0 200 Connected to rpc" 之后接管（Hijack）这个TCP连接，
+此后的通信与直接使用TCP完全相同，交给ServerConn处理。
+
+	CONNECT /_rpc_ HTTP/1.0
+	                                   HTTP/1.0 200 Connected to rpc
+	| Option | Header | Body | ...
+
+HandleHTTP 同时在DefaultDebugPath上注册调试页面，列出所有的服务、方法以及调用次数；
+HandleHTTPMux 注册在指定的http.ServeMux上，不使用全局的http.DefaultServeMux。
+*/
+
+package server
+
+import (
+	"io"
+	"log"
+	"net/http"
+)
+
+const (
+	// Connected CONNECT请求成功时服务端回复的状态
+	Connected = "200 Connected to rpc"
+	// DefaultRPCPath HandleHTTP 处理CONNECT请求的路径
+	DefaultRPCPath = "/_rpc_"
+	// DefaultDebugPath HandleHTTP 注册调试页面的路径
+	DefaultDebugPath = "/debug/rpc"
+)
+
+// ServeHTTP 实现http.Handler，只接受CONNECT请求，接管连接之后交给ServerConn处理
+func (server *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodConnect {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		_, _ = io.WriteString(w, "405 must CONNECT\n")
+		return
+	}
+	conn, _, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		log.Print("rpc hijacking ", req.RemoteAddr, ": ", err.Error())
+		return
+	}
+	if _, err := io.WriteString(conn, "HTTP/1.0 "+Connected+"\n\n"); err != nil {
+		_ = conn.Close()
+		return
+	}
+	server.ServerConn(conn)
+}
+
+// HandleHTTP 在http.DefaultServeMux上注册处理RPC的DefaultRPCPath和调试页面DefaultDebugPath，
+// 之后仍然需要调用http.Serve（通常在另一个协程中）
+func (server *Server) HandleHTTP() {
+	server.HandleHTTPMux(http.DefaultServeMux)
+}
+
+// HandleHTTPMux 与HandleHTTP相同，但是注册在指定的mux上，同一个mux只能注册一次
+func (server *Server) HandleHTTPMux(mux *http.ServeMux) {
+	mux.Handle(DefaultRPCPath, server)
+	mux.Handle(DefaultDebugPath, debugHTTP{server})
+	log.Println("rpc server debug path: ", DefaultDebugPath)
+}
+
+// HandleHTTP 默认Server情况下的HandleHTTP
+func HandleHTTP() {
+	DefaultServer.HandleHTTP()
+}
@@ -0,0 +1,93 @@
+/*
+interceptor.go 实现了服务端的拦截器（中间件），在读取请求之后、调用方法之前执行，
+用于日志、认证、监控、参数校验等与具体方法无关的通用逻辑。
+拦截器按照 Server.Use 注册的顺序执行，先注册的在外层；
+拦截器调用 next 继续执行后面的拦截器和方法，不调用 next 而直接返回错误则中止本次调用，错误会返回给客户端。
+
+客户端的拦截器见client包的interceptor.go。
+*/
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"rpc_test/metadata"
+)
+
+// CallInfo 拦截器可以看到的调用信息
+type CallInfo struct {
+	ServiceMethod string      // 调用服务和方法的名称，格式为：Service.Method
+	Metadata      metadata.MD // 请求携带的元数据
+}
+
+/*
+Handler 执行后续的拦截器和方法调用，argv和reply是请求的参数和返回值。
+拦截器可以传入替换后的argv和reply，类型必须与方法的参数一致，方法收到的是传入的值
+*/
+type Handler func(ctx context.Context, argv, reply interface{}) error
+
+// Interceptor 服务端拦截器，next 执行后续的拦截器和方法调用
+type Interceptor func(ctx context.Context, info *CallInfo, argv, reply interface{}, next Handler) error
+
+// Use 注册拦截器，对之后处理的每一个请求生效
+func (server *Server) Use(interceptors ...Interceptor) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	// 写时复制，处理请求时不需要加锁
+	var all []Interceptor
+	if p := server.interceptors.Load(); p != nil {
+		all = append(all, *p...)
+	}
+	all = append(all, interceptors...)
+	server.interceptors.Store(&all)
+}
+
+// invoke 依次执行拦截器，最后调用请求的方法
+func (server *Server) invoke(ctx context.Context, req *request) error {
+	p := server.interceptors.Load()
+	// 没有拦截器时直接调用，不需要构造handler闭包
+	if p == nil || len(*p) == 0 {
+		return req.svc.call(ctx, req.mtype, req.argv, req.reply)
+	}
+	interceptors := *p
+	handler := func(ctx context.Context, argv, reply interface{}) error {
+		argvv, replyv, err := req.mtype.values(argv, reply)
+		if err != nil {
+			return err
+		}
+		// 响应发送的是方法实际写入的reply
+		req.reply = replyv
+		return req.svc.call(ctx, req.mtype, argvv, replyv)
+	}
+
+	md, _ := metadata.FromIncomingContext(ctx)
+	info := &CallInfo{ServiceMethod: req.h.ServiceMethod, Metadata: md}
+	// 从后往前包装，使先注册的拦截器在最外层
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, next := interceptors[i], handler
+		handler = func(ctx context.Context, argv, reply interface{}) error {
+			return interceptor(ctx, info, argv, reply, next)
+		}
+	}
+	return handler(ctx, req.argv.Interface(), req.reply.Interface())
+}
+
+// values 将拦截器传给Handler的argv和reply转换为反射值，类型与方法的参数不一致时返回错误
+func (m *methodType) values(argv, reply interface{}) (reflect.Value, reflect.Value, error) {
+	argvv, replyv := reflect.ValueOf(argv), reflect.ValueOf(reply)
+	if !argvv.IsValid() || !argvv.Type().AssignableTo(m.ArgType) {
+		return argvv, replyv, fmt.Errorf("rpc server: interceptor passed argv of type %T, want %s", argv, m.ArgType)
+	}
+	if argvv.Type() != m.ArgType {
+		// 方法的参数是接口类型
+		v := reflect.New(m.ArgType).Elem()
+		v.Set(argvv)
+		argvv = v
+	}
+	if !replyv.IsValid() || replyv.Type() != m.ReplyType || replyv.IsNil() {
+		return argvv, replyv, fmt.Errorf("rpc server: interceptor passed reply of type %T, want non-nil %s", reply, m.ReplyType)
+	}
+	return argvv, replyv, nil
+}
@@ -0,0 +1,93 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"rpc_test/codec"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestServer_Use(t *testing.T) {
+	s := NewServer()
+	var mu sync.Mutex
+	var trace []string
+	record := func(name string) Interceptor {
+		return func(ctx context.Context, info *CallInfo, argv, reply interface{}, next Handler) error {
+			mu.Lock()
+			trace = append(trace, name+":"+info.ServiceMethod)
+			mu.Unlock()
+			return next(ctx, argv, reply)
+		}
+	}
+	// 认证拦截器：没有token时直接返回错误，不调用方法
+	auth := func(ctx context.Context, info *CallInfo, argv, reply interface{}, next Handler) error {
+		if info.Metadata.Get("token") != "secret" {
+			return errors.New("unauthenticated")
+		}
+		args, ok := argv.(Args)
+		_assert(ok && args.Num1 == 1, "interceptor should see argv: %v", argv)
+		err := next(ctx, argv, reply)
+		_assert(*reply.(*int) == 3, "interceptor should see reply after the call")
+		return err
+	}
+	s.Use(record("first"), record("second"))
+	s.Use(auth)
+	addr := startServer(t, s)
+	cc := dialServer(t, addr, &Option{})
+
+	call := func(seq uint64, md map[string]string) (codec.Header, int) {
+		_ = cc.Write(&codec.Header{ServiceMethod: "Foo.Sum", Seq: seq, Metadata: md}, &Args{Num1: 1, Num2: 2})
+		var h codec.Header
+		var reply int
+		_assert(cc.ReadHeader(&h) == nil, "read header")
+		_ = cc.ReadBody(&reply)
+		return h, reply
+	}
+
+	h, reply := call(1, map[string]string{"token": "secret"})
+	_assert(h.Error == "" && reply == 3, "expect 3 but got %d, %q", reply, h.Error)
+	_assert(strings.Join(trace, ",") == "first:Foo.Sum,second:Foo.Sum", "unexpected order: %v", trace)
+
+	h, _ = call(2, nil)
+	_assert(h.Error == "unauthenticated", "expect the interceptor to short-circuit but got %q", h.Error)
+	svc, _ := s.serviceMap.Load("Foo")
+	_assert(svc.(*service).method["Sum"].NumCalls() == 1, "method should not be called after short-circuit")
+}
+
+// TestServer_UseReplaceArgs 拦截器传给next的argv和reply会被方法使用，类型不一致时返回错误
+func TestServer_UseReplaceArgs(t *testing.T) {
+	s := NewServer()
+	s.Use(func(ctx context.Context, info *CallInfo, argv, reply interface{}, next Handler) error {
+		switch info.Metadata.Get("mode") {
+		case "normalize":
+			args := argv.(Args)
+			if args.Num1 < 0 {
+				args.Num1 = 0
+			}
+			return next(ctx, args, new(int))
+		case "wrong":
+			return next(ctx, &Args{}, reply)
+		}
+		return next(ctx, argv, reply)
+	})
+	addr := startServer(t, s)
+	cc := dialServer(t, addr, &Option{})
+
+	call := func(seq uint64, mode string) (codec.Header, int) {
+		_ = cc.Write(&codec.Header{ServiceMethod: "Foo.Sum", Seq: seq, Metadata: map[string]string{"mode": mode}},
+			&Args{Num1: -5, Num2: 2})
+		var h codec.Header
+		var reply int
+		_assert(cc.ReadHeader(&h) == nil, "read header")
+		_ = cc.ReadBody(&reply)
+		return h, reply
+	}
+	h, reply := call(1, "")
+	_assert(h.Error == "" && reply == -3, "expect -3 but got %d, %q", reply, h.Error)
+	h, reply = call(2, "normalize")
+	_assert(h.Error == "" && reply == 2, "expect the normalized args to be used but got %d, %q", reply, h.Error)
+	h, _ = call(3, "wrong")
+	_assert(strings.Contains(h.Error, "interceptor passed argv of type *server.Args"), "unexpected error %q", h.Error)
+}
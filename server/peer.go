@@ -0,0 +1,64 @@
+/*
+peer.go 将发起请求的客户端信息通过context交给方法和拦截器。
+连接使用TLS时，Peer.TLS 保存握手状态；服务端在tls.Config中要求并验证客户端证书（mTLS）时，
+Peer.Identity 返回客户端证书的CommonName，可以用于认证和鉴权。
+*/
+
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+)
+
+// Peer 发起请求的客户端
+type Peer struct {
+	Addr net.Addr             // 客户端地址，连接不是net.Conn时为nil
+	TLS  *tls.ConnectionState // TLS握手状态，连接没有使用TLS时为nil
+}
+
+// Identity 返回经过验证的客户端证书的CommonName，客户端没有提供证书或者证书没有经过验证时返回""
+func (p *Peer) Identity() string {
+	if p == nil || p.TLS == nil || len(p.TLS.VerifiedChains) == 0 || len(p.TLS.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	return p.TLS.VerifiedChains[0][0].Subject.CommonName
+}
+
+type peerKey struct{}
+
+// newPeerContext 将客户端信息保存到ctx中
+func newPeerContext(ctx context.Context, p *Peer) context.Context {
+	return context.WithValue(ctx, peerKey{}, p)
+}
+
+// PeerFromContext 返回ctx中保存的客户端信息，方法的context中总是存在
+func PeerFromContext(ctx context.Context) (*Peer, bool) {
+	p, ok := ctx.Value(peerKey{}).(*Peer)
+	return p, ok
+}
+
+/*
+newPeer 根据连接构造Peer，TLS连接会先完成握手，以便在读取Option之前得到客户端证书；
+握手失败时返回错误
+*/
+func newPeer(conn interface{}) (*Peer, error) {
+	p := &Peer{}
+	if nc, ok := conn.(net.Conn); ok {
+		p.Addr = nc.RemoteAddr()
+	}
+	if tc, ok := conn.(*tls.Conn); ok {
+		if err := tc.Handshake(); err != nil {
+			return nil, err
+		}
+		state := tc.ConnectionState()
+		p.TLS = &state
+	}
+	return p, nil
+}
+
+// AcceptTLS 与Accept相同，但是所有的连接都使用TLS，config中设置ClientAuth和ClientCAs可以要求客户端证书
+func (server *Server) AcceptTLS(lis net.Listener, config *tls.Config) {
+	server.Accept(tls.NewListener(lis, config))
+}
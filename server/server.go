@@ -4,12 +4,13 @@
 服务端首先使用JSON解码Option，然后通过Option的CodeType解码剩余的内容，在本次实现中主要是Gob解码
 | Option{MagicNumber: xxx, CodecType: xxx} | Header{ServiceMethod ...} | Body interface{} |
 | <------      固定 JSON 编码      ------>  | <-------   编码方式由 CodeType 决定   ------->|
-为了测试简便，代码中DefaultOption 设置默认的序列化方式，DefaultServer 为默认的Server对象
-DefaultAccept 为默认的接受tcp监听的函数。
+Option.Version 不为0时，服务端在收到Option之后先回复一行JSON编码的Handshake，见handshake.go
+DefaultOption 不指定序列化方式，由客户端从codec.Types()中列出候选、服务端选择（默认优先使用Gob），
+DefaultServer 为默认的Server对象，DefaultAccept 为默认的接受tcp监听的函数。
 
 服务端从接收到请求到回复一共以下几个步骤：
 	第一步，根据入参类型，将请求的 body 反序列化；
-	第二步，调用 service.call，完成方法调用；
+	第二步，依次执行通过 Server.Use 注册的拦截器，然后调用 service.call，完成方法调用；
 	第三步，将 reply 序列化为字节流，构造响应报文，返回。
 
 超时处理
@@ -18,16 +19,38 @@ DefaultAccept 为默认的接受tcp监听的函数。
 		2. 生成请求报文时超时
 		3. 等待服务端处理时超时
 		4. 接收服务端响应报文时超时
+		客户端的context被取消时，发送一个ServiceMethod为codec.CancelServiceMethod、Seq为该请求的取消消息，
+		服务端收到后取消对应请求的context。不认识取消消息的服务端只会回复一个找不到服务的错误，客户端会直接丢弃。
 	服务端：
 		1. 读取客户端请求报文时超时
 		2. 生成响应报文时超时
 		3. 调用请求的方法，处理报文超时
-	超时设置在Option字段中。
+	超时设置在Option字段中。服务端处理超时由客户端在Option.HandlerTimeout中请求，
+	服务端通过Server.HandlerTimeout设置默认值（NewServer 为10s），通过Server.MaxHandlerTimeout设置上限。
+	客户端context的截止时间通过Header.Timeout随每个请求发送，服务端取它与处理超时中较短的一个，
+	并作为context的截止时间传给方法，方法中发起的下游调用会继承剩余的时间。
+
+元数据
+	Header.Metadata 在请求中携带客户端附加的元数据，服务端通过metadata.NewIncomingContext交给方法；
+	响应中携带方法通过metadata.SetTrailer设置的trailer。
+
+服务注册
+	Register/RegisterName 注册服务，Unregister 移除服务，Replace 原子地替换服务的实现。
+	请求在读取时就确定了服务，所以移除或替换之前已经开始的请求会在旧的实现上完成，
+	之后的请求找不到服务时返回ErrServiceNotFound。
+
+TLS
+	AcceptTLS 在TLS连接上提供服务，Option握手和之后的消息都是加密的；客户端通过client.DialTLS或者
+	client.XDial("tls@addr")连接，Option.TLSConfig 指定信任的CA和客户端证书。
+	方法可以通过PeerFromContext得到客户端的地址和TLS状态，mTLS时Peer.Identity是客户端证书的CommonName。
 */
 
 package server
 
 import (
+	"bufio"
+	"context"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -36,8 +59,11 @@ import (
 	"net"
 	"reflect"
 	"rpc_test/codec"
+	"rpc_test/metadata"
+	"runtime/debug"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -47,35 +73,141 @@ type Option struct {
 	MagicNumber       int           // 用来区分一次客户端的请求
 	CodecType         codec.Type    // 用来指定客户端序列化与反序列化方式
 	ConnectionTimeout time.Duration // 超时的时间限制
-	HandlerTimeout    time.Duration
+	HandlerTimeout    time.Duration // 服务端处理请求的超时，0表示使用服务端的默认值
+	Version           int           // 客户端支持的最高协议版本，小于1的旧客户端不等待握手应答，client包默认填入ProtocolVersion，见LegacyVersion
+	MaxResponseSize   int           // 客户端接受的最大响应，0表示不限制，服务端不会发送超过它的响应；设置时客户端只使用分帧的连接
+	// CodecTypes 客户端支持的编解码方式，按照优先顺序排列，不为空时由服务端从中选择第一个双方都支持的，
+	// client包在没有指定CodecType时使用codec.Types()
+	CodecTypes []codec.Type
+	// Compression 请求使用的压缩算法，服务端不支持或者连接没有分帧时不压缩
+	Compression codec.CompressionType
+	// CompressThreshold 只压缩不小于这个大小的body，0表示使用codec.DefaultCompressThreshold
+	CompressThreshold int
+	// TLSConfig 客户端通过TLS连接服务端时使用的配置，为nil时使用默认配置并根据地址验证服务端证书
+	TLSConfig *tls.Config `json:"-"`
+	// Interceptors 客户端拦截器（即client.Interceptor），client包创建Client时按顺序注册，先注册的在外层，
+	// 从第一次调用开始生效；xclient.NewXClient 的Option会传给它创建的每一个Client。不发送给服务端
+	Interceptors []func(ctx context.Context, serviceMethod string, args, reply interface{},
+		invoker func(ctx context.Context, serviceMethod string, args, reply interface{}) error) error `json:"-"`
 }
 
-// DefaultOption 设置默认的序列化方式 Gob，默认超时时间为10s
+// DefaultOption 不指定序列化方式，由客户端和服务端协商，默认优先使用Gob，默认超时时间为10s
 var DefaultOption = &Option{
 	MagicNumber:       MagicNumber,
-	CodecType:         codec.GobType,
 	ConnectionTimeout: 10 * time.Second,
+	Version:           ProtocolVersion,
 }
 
 // Server 服务端结构体
 type Server struct {
 	serviceMap sync.Map // 多线程安全的Map
+
+	// HandlerTimeout 客户端没有在Option中指定HandlerTimeout时，服务端使用的默认处理超时，0表示不限制。
+	// NewServer 将它设置为DefaultHandlerTimeout
+	HandlerTimeout time.Duration
+	// MaxHandlerTimeout 服务端允许的最大处理超时，客户端请求的超时（包括0即不限制）都不能超过它，0表示不设上限
+	MaxHandlerTimeout time.Duration
+	// PanicPolicy 方法发生panic时的处理方式，默认恢复并将panic作为错误返回给客户端
+	PanicPolicy PanicPolicy
+	// MaxRequestSize 服务端接受的最大请求（Header与Body编码之后的长度），0表示不限制。
+	// 设置了MaxRequestSize或MaxResponseSize时，服务端拒绝无法分帧的连接
+	MaxRequestSize int
+	// MaxResponseSize 服务端发送的最大响应，超过时改为回复codec.ErrMessageTooLarge错误，0表示不限制
+	MaxResponseSize int
+	// Compressions 允许客户端使用的压缩算法，nil 表示允许codec.CompressorMap中的全部算法，
+	// 空切片表示不允许压缩，客户端请求的算法不在其中时不压缩
+	Compressions []codec.CompressionType
+
+	mu         sync.Mutex // 保护下面的字段
+	listeners  map[net.Listener]struct{}
+	conns      map[*serverConn]struct{}
+	inShutdown bool // 调用了Shutdown或者Close
+
+	// interceptors 通过Use注册的拦截器，Use 在mu的保护下写时复制，处理请求时直接读取
+	interceptors atomic.Pointer[[]Interceptor]
 }
 
-// Register 服务端Server注册服务rcvr
+// Register 服务端Server注册服务rcvr，服务名为rcvr的类型名
 func (server *Server) Register(rcvr interface{}) error {
-	s := newService(rcvr)
+	return server.register(rcvr, "")
+}
+
+// RegisterName 与Register相同，但是使用指定的服务名，可以将同一类型的多个实例注册为不同的服务
+func (server *Server) RegisterName(name string, rcvr interface{}) error {
+	return server.register(rcvr, name)
+}
+
+func (server *Server) register(rcvr interface{}, name string) error {
+	s, err := newService(rcvr, name)
+	if err != nil {
+		return err
+	}
 	if _, dup := server.serviceMap.LoadOrStore(s.name, s); dup {
 		return errors.New("rpc service already defined: " + s.name)
 	}
 	return nil
 }
 
+// Unregister 移除服务name，正在处理的请求不受影响，之后的请求返回ErrServiceNotFound
+func (server *Server) Unregister(name string) error {
+	if _, loaded := server.serviceMap.LoadAndDelete(name); !loaded {
+		return fmt.Errorf("%w: %s", ErrServiceNotFound, name)
+	}
+	return nil
+}
+
+/*
+Replace 将已经注册的服务name原子地替换为rcvr，服务不存在时返回ErrServiceNotFound。
+已经找到旧服务的请求继续在旧的rcvr上执行完成，之后的请求由新的rcvr处理
+*/
+func (server *Server) Replace(name string, rcvr interface{}) error {
+	s, err := newService(rcvr, name)
+	if err != nil {
+		return err
+	}
+	for {
+		old, ok := server.serviceMap.Load(name)
+		if !ok {
+			return fmt.Errorf("%w: %s", ErrServiceNotFound, name)
+		}
+		if server.serviceMap.CompareAndSwap(name, old, s) {
+			return nil
+		}
+	}
+}
+
+// SkippedMethods 返回注册服务name时因为不满足条件而被跳过的方法及原因，服务不存在时返回nil
+func (server *Server) SkippedMethods(name string) []SkippedMethod {
+	svc, ok := server.serviceMap.Load(name)
+	if !ok {
+		return nil
+	}
+	return append([]SkippedMethod(nil), svc.(*service).skipped...)
+}
+
+// Unregister 默认Server情况下的Unregister
+func Unregister(name string) error {
+	return DefaultServer.Unregister(name)
+}
+
+// Replace 默认Server情况下的Replace
+func Replace(name string, rcvr interface{}) error {
+	return DefaultServer.Replace(name, rcvr)
+}
+
 // Register 默认Server情况下的register
 func Register(rcvr interface{}) error {
 	return DefaultServer.Register(rcvr)
 }
 
+// RegisterName 默认Server情况下的RegisterName
+func RegisterName(name string, rcvr interface{}) error {
+	return DefaultServer.RegisterName(name, rcvr)
+}
+
+// ErrServiceNotFound 请求的服务没有注册或者已经被Unregister移除
+var ErrServiceNotFound = errors.New("rpc server: can't find service")
+
 // findService 服务端查找服务，ServiceMethod 的构成是 "Service.Method"
 func (server *Server) findService(serviceMethod string) (s *service, mtype *methodType, err error) {
 	index := strings.LastIndex(serviceMethod, ".")
@@ -86,7 +218,7 @@ func (server *Server) findService(serviceMethod string) (s *service, mtype *meth
 	serviceName, methodName := serviceMethod[:index], serviceMethod[index+1:]
 	svc, ok := server.serviceMap.Load(serviceName)
 	if !ok {
-		err = errors.New("rpc server: can't find service: " + serviceName)
+		err = fmt.Errorf("%w: %s", ErrServiceNotFound, serviceName)
 		return nil, nil, err
 	}
 	s = svc.(*service)
@@ -98,20 +230,30 @@ func (server *Server) findService(serviceMethod string) (s *service, mtype *meth
 	return s, mtype, nil
 }
 
-// NewServer 构造一个新的Server对象
+// DefaultHandlerTimeout NewServer 默认的处理超时，防止失控的方法一直占用服务端
+const DefaultHandlerTimeout = 10 * time.Second
+
+// NewServer 构造一个新的Server对象，处理超时默认为DefaultHandlerTimeout
 func NewServer() *Server {
-	return &Server{}
+	return &Server{HandlerTimeout: DefaultHandlerTimeout}
 }
 
 // DefaultServer 默认的Server对象
 var DefaultServer = NewServer()
 
-// Accept for循环等待 socket 连接建立，并开启子协程处理
+// Accept for循环等待 socket 连接建立，并开启子协程处理，服务端关闭后返回
 func (server *Server) Accept(lis net.Listener) {
+	if !server.trackListener(lis, true) {
+		_ = lis.Close()
+		return
+	}
+	defer server.trackListener(lis, false)
 	for {
 		conn, err := lis.Accept()
 		if err != nil {
-			log.Println("rpc server: accept error: ", err)
+			if !server.isShutdown() {
+				log.Println("rpc server: accept error: ", err)
+			}
 			return
 		}
 		go server.ServerConn(conn)
@@ -125,31 +267,104 @@ func DefaultAccept(lis net.Listener) {
 
 /*
 ServeConn 首先使用json.NewDecoder反序列化得到Option实例，检查MagicNumber和CodeType
-然后根据CodeType得到对应的消息编解码器，接下来的处理交给serverCodec
+然后根据CodeType得到对应的消息编解码器，客户端支持握手应答时回复Handshake，接下来的处理交给serverCodec
 */
 
 func (server *Server) ServerConn(conn io.ReadWriteCloser) {
 	defer func() { _ = conn.Close() }()
+	sc := &serverConn{conn: conn}
+	if !server.trackConn(sc, true) {
+		return
+	}
+	defer server.trackConn(sc, false)
+
+	peer, err := newPeer(conn)
+	if err != nil {
+		log.Println("rpc server: tls handshake error: ", err)
+		return
+	}
+	sc.peer = peer
 
 	var opt Option
-	if err := json.NewDecoder(conn).Decode(&opt); err != nil {
+	dec := json.NewDecoder(conn)
+	if err := dec.Decode(&opt); err != nil {
 		log.Println("rpc server: options error: ", err)
 		return
 	}
-	if opt.MagicNumber != MagicNumber {
-		log.Printf("rpc server: invalid magic number %x\n", opt.MagicNumber)
+	ack := server.negotiate(&opt)
+	if opt.Version >= 1 {
+		if err := json.NewEncoder(conn).Encode(ack); err != nil {
+			log.Println("rpc server: handshake error: ", err)
+			return
+		}
+	}
+	if ack.Error != "" {
+		log.Println("rpc server: options error: ", ack.Error)
 		return
 	}
-	/*
-		构造一个确定序列化方式的构造函数，默认是Gob序列化方式，使用了codec中的NewCodecFuncMap表
-		得到的变量f 是一个构造函数，构造一个opt.CodecType序列化方式的Codec对象
-	*/
-	f := codec.NewCodecFuncMap[opt.CodecType]
-	if f == nil {
-		log.Printf("rpc server: invalid codec type %s\n", opt.CodecType)
+	// json.Decoder 会预读数据，客户端紧跟在Option之后发送的请求可能已经被读入其缓冲区，
+	// 因此需要先读完缓冲区中剩余的数据，再继续从conn中读取
+	cc, err := ack.NewCodec(newBufferedConn(conn, dec.Buffered()))
+	if err != nil {
+		log.Println("rpc server: options error: ", err)
 		return
 	}
-	server.serverCodec(f(conn))
+	if l, ok := cc.(codec.Limiter); ok {
+		l.SetMaxReadSize(ack.MaxRequestSize)
+		l.SetMaxWriteSize(ack.MaxResponseSize)
+	}
+	server.serverCodec(sc, cc, ack.HandlerTimeout)
+}
+
+/*
+handlerTimeout 根据客户端在Option中请求的超时计算该连接实际使用的处理超时：
+客户端未指定（0）时使用服务端的默认值HandlerTimeout；
+设置了MaxHandlerTimeout时，结果不能超过上限，也不能是0（不限制）。
+*/
+func (server *Server) handlerTimeout(requested time.Duration) time.Duration {
+	timeout := requested
+	if timeout == 0 {
+		timeout = server.HandlerTimeout
+	}
+	if server.MaxHandlerTimeout > 0 && (timeout == 0 || timeout > server.MaxHandlerTimeout) {
+		timeout = server.MaxHandlerTimeout
+	}
+	return timeout
+}
+
+// minTimeout 返回两个超时中较短的一个，0表示不限制
+func minTimeout(a, b time.Duration) time.Duration {
+	if a == 0 || (b != 0 && b < a) {
+		return b
+	}
+	return a
+}
+
+/*
+bufferedConn 读取时优先返回Option解码后剩余的数据，写入和关闭直接作用于原始连接。
+json.Encoder 在Option之后会写入一个换行符，它不属于后续编解码器的数据，第一次读取时需要跳过
+*/
+type bufferedConn struct {
+	io.ReadWriteCloser
+	r       *bufio.Reader
+	started bool
+}
+
+func newBufferedConn(conn io.ReadWriteCloser, buffered io.Reader) *bufferedConn {
+	return &bufferedConn{
+		ReadWriteCloser: conn,
+		r:               bufio.NewReader(io.MultiReader(buffered, conn)),
+	}
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	if !c.started {
+		c.started = true
+		if b, err := c.r.Peek(1); err == nil && b[0] == '\n' {
+			_, _ = c.r.Discard(1)
+		}
+	}
+	return c.r.Read(p)
 }
 
 // invalidRequest is a placeholder for response argv when error occurs
@@ -161,45 +376,121 @@ var invalidRequest = struct {
 处理请求 handleRequest
 回复请求 sendResponse
 */
-func (server *Server) serverCodec(f codec.Codec) {
+func (server *Server) serverCodec(sc *serverConn, f codec.Codec, timeout time.Duration) {
 	sending := new(sync.Mutex) // 互斥锁，处理并发
 	wg := new(sync.WaitGroup)  // 确保并发程序执行完毕
+	// 连接的context，回复写入失败或者服务端关闭连接时取消（sc.abort），所有正在处理的请求都会收到取消通知
+	ctx, cancel := context.WithCancel(newPeerContext(context.Background(), sc.peer))
+	defer cancel()
+	sc.setCodec(f, sending, cancel)
+	pending := newPendingRequests() // 正在处理的请求，用于响应客户端的取消消息
 
 	for {
 		req, err := server.readRequest(f)
 		if err != nil {
 			if req == nil {
+				// 客户端半关闭（EOF）时只是不再发送请求，已经收到的请求照常处理并回复；其他错误说明连接已经断开
+				if !errors.Is(err, io.EOF) {
+					cancel()
+				}
 				break
 			}
 			req.h.Error = err.Error()
-			server.sendResponse(f, req.h, invalidRequest, sending)
+			req.h.Metadata = nil
+			if server.sendResponse(f, req.h, invalidRequest, sending) != nil {
+				sc.abort()
+			}
+			continue
+		}
+		if req.h.ServiceMethod == codec.CancelServiceMethod {
+			pending.cancel(req.h.Seq)
 			continue
 		}
+		// 服务端正在关闭，不再处理新的请求
+		if !sc.startRequest() {
+			req.h.Error = ErrServerClosed.Error()
+			req.h.Metadata = nil
+			if server.sendResponse(f, req.h, invalidRequest, sending) != nil {
+				sc.abort()
+			}
+			continue
+		}
+		// 请求的元数据交给方法的context，Header之后用于响应，只携带方法设置的trailer
+		md := req.h.Metadata
+		req.h.Metadata = nil
 		wg.Add(1)
-		go server.handleRequest(f, req, sending, wg, 10*time.Second)
+		go func(req *request, ctx context.Context) {
+			defer pending.remove(req.h.Seq)
+			server.handleRequest(ctx, sc, f, req, sending, wg, minTimeout(timeout, req.h.Timeout))
+		}(req, metadata.NewIncomingContext(pending.add(ctx, req.h.Seq), md))
 	}
 	wg.Wait()
 	_ = f.Close()
 }
 
+// pendingRequests 记录一个连接上正在处理的请求的cancel函数，键是请求的Seq
+type pendingRequests struct {
+	mu      sync.Mutex
+	cancels map[uint64]context.CancelFunc
+}
+
+func newPendingRequests() *pendingRequests {
+	return &pendingRequests{cancels: make(map[uint64]context.CancelFunc)}
+}
+
+// add 为请求创建一个可以被取消的context并记录下来
+func (p *pendingRequests) add(ctx context.Context, seq uint64) context.Context {
+	ctx, cancel := context.WithCancel(ctx)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.cancels[seq] = cancel
+	return ctx
+}
+
+// remove 请求处理结束后移除记录，并释放context
+func (p *pendingRequests) remove(seq uint64) {
+	p.mu.Lock()
+	cancel := p.cancels[seq]
+	delete(p.cancels, seq)
+	p.mu.Unlock()
+	if cancel != nil {
+		cancel()
+	}
+}
+
+// cancel 客户端取消请求，请求已经处理完毕时什么也不做
+func (p *pendingRequests) cancel(seq uint64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if cancel := p.cancels[seq]; cancel != nil {
+		cancel()
+	}
+}
+
 // request 存储了客户端每一次发送的所有数据，包括Header和Body
 type request struct {
-	h           *codec.Header // 请求消息的Header
+	h           *codec.Header // 请求消息的Header，指向header
+	header      codec.Header  // 与request一起分配，减少一次内存分配
 	argv, reply reflect.Value // 请求消息的传参和返回值
 	mtype       *methodType   // 客户端所请求方法的类型
 	svc         *service      // 客户端请求的服务
+	replied     int32         // 是否已经回复，保证每个Seq只回复一次
+}
+
+// claimReply 取得回复请求的权利，只有第一次调用返回true
+func (req *request) claimReply() bool {
+	return atomic.CompareAndSwapInt32(&req.replied, 0, 1)
 }
 
 // 读取请求消息的头部信息
-func (server *Server) readRequestHeader(c codec.Codec) (*codec.Header, error) {
-	var h codec.Header
-	if err := c.ReadHeader(&h); err != nil {
+func (server *Server) readRequestHeader(c codec.Codec, h *codec.Header) error {
+	if err := c.ReadHeader(h); err != nil {
 		if err != io.EOF && !errors.Is(err, io.ErrUnexpectedEOF) {
 			log.Println("rpc server: read header error: ", err)
 		}
-		return nil, err
+		return err
 	}
-	return &h, nil
+	return nil
 }
 
 /*
@@ -207,14 +498,23 @@ readRequest 通过newArgv()和newReply()两个方法创建出两个入参实例
 将请求报文反序列化为第一个入参 argv，在这里同样需要注意argv可能是值类型，也可能是指针类型。
 */
 func (server *Server) readRequest(f codec.Codec) (*request, error) {
-	h, err := server.readRequestHeader(f)
-	if err != nil {
+	req := new(request)
+	req.h = &req.header
+	if err := server.readRequestHeader(f, req.h); err != nil {
 		return nil, err
 	}
-
-	req := &request{h: h}
+	h := req.h
+	var err error
+	// 取消消息只有Header有意义，Body直接丢弃
+	if h.ServiceMethod == codec.CancelServiceMethod {
+		return req, f.ReadBody(nil)
+	}
 	req.svc, req.mtype, err = server.findService(h.ServiceMethod)
 	if err != nil {
+		// 丢弃无法处理的Body，保证后续的请求能被正确读取
+		if e := f.ReadBody(nil); e != nil {
+			return nil, e
+		}
 		return req, err
 	}
 	req.argv = req.mtype.newArgv()
@@ -233,43 +533,116 @@ func (server *Server) readRequest(f codec.Codec) (*request, error) {
 }
 
 func (server *Server) sendResponse(f codec.Codec, h *codec.Header, body interface{},
-	sending *sync.Mutex) {
+	sending *sync.Mutex) error {
 	sending.Lock()
 	defer sending.Unlock()
-	if err := f.Write(h, body); err != nil {
+	err := f.Write(h, body)
+	// 响应超过大小限制时没有写入任何数据，改为回复错误
+	if errors.Is(err, codec.ErrMessageTooLarge) {
+		h.Error = err.Error()
+		err = f.Write(h, invalidRequest)
+	}
+	if err != nil {
 		log.Println("rpc server: write response error: ", err)
 	}
+	return err
 }
 
-func (server *Server) handleRequest(f codec.Codec, req *request, sending *sync.Mutex,
-	wg *sync.WaitGroup, timeout time.Duration) {
-	defer wg.Done()
-	called := make(chan struct{}) // 服务端调用Call时的超时处理通道
-	sent := make(chan struct{})   // 服务端发送响应报文时的超时处理通道
-	go func() {
-		err := req.svc.call(req.mtype, req.argv, req.reply)
-		called <- struct{}{} // 可能超时
-		if err != nil {
-			req.h.Error = err.Error()
-			server.sendResponse(f, req.h, invalidRequest, sending)
-			sent <- struct{}{} // 可能超时
-			return
+/*
+handleRequest 调用请求的方法并回复。方法收到的context在处理超时、连接断开时取消，
+回复写入失败时取消连接上所有的请求。
+方法总是在当前协程中执行；设置了超时时，通过context.AfterFunc在context结束时与方法竞争同一个响应：
+每个请求只有一次回复的机会（request.replied），先到的一方发送响应，
+超时之后方法才返回的结果会被丢弃，并计入methodType.NumLateReplies()。
+AfterFunc 只在context结束时才启动协程，按时完成的请求不需要额外的协程。
+请求在回复之后就算处理完毕（sc.finishRequest、wg.Done），超时的方法不会阻塞连接的关闭。
+*/
+func (server *Server) handleRequest(ctx context.Context, sc *serverConn, f codec.Codec, req *request,
+	sending *sync.Mutex, wg *sync.WaitGroup, timeout time.Duration) {
+	if timeout == 0 {
+		err := server.call(ctx, req)
+		req.mtype.releaseArgv(req.argv)
+		if server.finishRequest(ctx, f, req, err, sending) != nil {
+			sc.abort()
 		}
+		sc.finishRequest()
+		wg.Done()
+		return
+	}
 
-		server.sendResponse(f, req.h, req.reply.Interface(), sending)
-		sent <- struct{}{}
-	}()
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	stop := context.AfterFunc(ctx, func() {
+		if req.claimReply() {
+			req.h.Metadata = metadata.TrailerFromIncomingContext(ctx)
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				req.h.Error = fmt.Sprintf("rpc server: requset handle timeout: expect within %s", timeout)
+			} else {
+				req.h.Error = "rpc server: request canceled: " + ctx.Err().Error()
+			}
+			if server.sendResponse(f, req.h, invalidRequest, sending) != nil {
+				sc.abort()
+			}
+		}
+		sc.finishRequest()
+		wg.Done()
+	})
+	err := server.call(ctx, req)
+	req.mtype.releaseArgv(req.argv)
+	if server.finishRequest(ctx, f, req, err, sending) != nil {
+		sc.abort()
+	}
+	// AfterFunc 已经开始执行时，由它结束请求
+	if stop() {
+		sc.finishRequest()
+		wg.Done()
+	}
+}
 
-	if timeout == 0 { // 设置的超时时间限制时0
-		<-called
-		<-sent
-		return
+// PanicPolicy 方法发生panic时服务端的处理方式
+type PanicPolicy int
+
+const (
+	PanicRecover          PanicPolicy = iota // 恢复panic，记录日志，将其作为错误回复该请求
+	PanicRecoverWithStack                    // 与PanicRecover相同，日志中同时记录panic时的调用栈
+	PanicCrash                               // 不恢复panic，整个进程崩溃
+)
+
+/*
+call 执行拦截器和方法调用。除非PanicPolicy为PanicCrash，方法中的panic会被恢复，
+转换为该请求的错误，并计入methodType.NumPanics()，不会影响其他的请求和连接。
+*/
+func (server *Server) call(ctx context.Context, req *request) (err error) {
+	if server.PanicPolicy != PanicCrash {
+		defer func() {
+			if r := recover(); r != nil {
+				atomic.AddUint64(&req.mtype.numPanics, 1)
+				err = fmt.Errorf("rpc server: %s panic: %v", req.h.ServiceMethod, r)
+				if server.PanicPolicy == PanicRecoverWithStack {
+					log.Printf("%v\n%s", err, debug.Stack())
+				} else {
+					log.Println(err)
+				}
+			}
+		}()
 	}
-	select {
-	case <-time.After(timeout):
-		req.h.Error = fmt.Sprintf("rpc server: requset handle timeout: expect within %s", timeout)
-		server.sendResponse(f, req.h, invalidRequest, sending)
-	case <-called:
-		<-sent
+	return server.invoke(ctx, req)
+}
+
+/*
+finishRequest 根据方法调用的结果回复请求。如果context已经结束（超时或取消），
+回复由handleRequest负责，或者已经不再需要，此时丢弃结果并计数。返回写入回复时的错误
+*/
+func (server *Server) finishRequest(ctx context.Context, f codec.Codec, req *request, err error,
+	sending *sync.Mutex) error {
+	if ctx.Err() != nil || !req.claimReply() {
+		atomic.AddUint64(&req.mtype.numLateReplies, 1)
+		return nil
+	}
+	req.h.Metadata = metadata.TrailerFromIncomingContext(ctx)
+	if err != nil {
+		req.h.Error = err.Error()
+		return server.sendResponse(f, req.h, invalidRequest, sending)
 	}
+	return server.sendResponse(f, req.h, req.reply.Interface(), sending)
 }
@@ -0,0 +1,610 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"rpc_test/codec"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+type Sleeper int
+
+func (s Sleeper) Sleep(d time.Duration, reply *int) error {
+	time.Sleep(d)
+	*reply = 1
+	return nil
+}
+
+// SleepContext 在ctx取消时提前返回，并将ctx的错误发送到sleeperCanceled
+func (s Sleeper) SleepContext(ctx context.Context, d time.Duration, reply *int) error {
+	select {
+	case <-time.After(d):
+		*reply = 1
+		return nil
+	case <-ctx.Done():
+		sleeperCanceled <- ctx.Err()
+		return ctx.Err()
+	}
+}
+
+var sleeperCanceled = make(chan error, 1)
+
+// startServer 启动一个注册了Foo和Sleeper的服务端，返回监听地址
+func startServer(t *testing.T, s *Server) string {
+	var foo Foo
+	var sleeper Sleeper
+	_assert(s.Register(&foo) == nil, "register Foo")
+	_assert(s.Register(&sleeper) == nil, "register Sleeper")
+	l, _ := net.Listen("tcp", ":0")
+	t.Cleanup(func() { _ = l.Close() })
+	go s.Accept(l)
+	return l.Addr().String()
+}
+
+// dialServer 发送Option并返回对应的Gob编解码器
+func dialServer(t *testing.T, addr string, opt *Option) codec.Codec {
+	conn, err := net.Dial("tcp", addr)
+	_assert(err == nil, "dial error: %v", err)
+	t.Cleanup(func() { _ = conn.Close() })
+	opt.MagicNumber = MagicNumber
+	opt.CodecType = codec.GobType
+	_assert(json.NewEncoder(conn).Encode(opt) == nil, "write option")
+	return codec.NewGobCodec(conn)
+}
+
+// TestServer_JsonCodec 模拟netcat一次性写入Option、Header和Body，服务端需要正确处理JSON编码的请求
+func TestServer_JsonCodec(t *testing.T) {
+	addr := startServer(t, NewServer())
+
+	conn, err := net.Dial("tcp", addr)
+	_assert(err == nil, "dial error: %v", err)
+	defer func() { _ = conn.Close() }()
+
+	_, err = conn.Write([]byte(`{"MagicNumber":3927900,"CodecType":"application/json"}` + "\n" +
+		`{"ServiceMethod":"Foo.Sum","Seq":1}` + "\n" +
+		`{"Num1":1,"Num2":2}` + "\n"))
+	_assert(err == nil, "write error: %v", err)
+
+	dec := json.NewDecoder(bufio.NewReader(conn))
+	var h codec.Header
+	var reply int
+	_assert(dec.Decode(&h) == nil && h.Seq == 1 && h.Error == "", "unexpected header: %+v", h)
+	_assert(dec.Decode(&reply) == nil && reply == 3, "expect 3 but got %d", reply)
+}
+
+func TestServer_handlerTimeout(t *testing.T) {
+	cases := []struct {
+		name                  string
+		defaultTimeout, max   time.Duration
+		requested, wantResult time.Duration
+	}{
+		{"no limit", 0, 0, 0, 0},
+		{"client requested", 0, 0, time.Second, time.Second},
+		{"server default", 2 * time.Second, 0, 0, 2 * time.Second},
+		{"client overrides default", 2 * time.Second, 0, time.Second, time.Second},
+		{"capped by max", 0, time.Second, 3 * time.Second, time.Second},
+		{"unlimited forbidden by max", 0, time.Second, 0, time.Second},
+		{"default capped by max", 5 * time.Second, time.Second, 0, time.Second},
+		{"within max", 2 * time.Second, 3 * time.Second, time.Second, time.Second},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			s := &Server{HandlerTimeout: c.defaultTimeout, MaxHandlerTimeout: c.max}
+			got := s.handlerTimeout(c.requested)
+			_assert(got == c.wantResult, "expect %s but got %s", c.wantResult, got)
+		})
+	}
+	got := NewServer().handlerTimeout(0)
+	_assert(got == DefaultHandlerTimeout, "NewServer should default to %s but got %s", DefaultHandlerTimeout, got)
+}
+
+func TestServer_HandlerTimeout(t *testing.T) {
+	t.Parallel()
+	call := func(cc codec.Codec, d time.Duration) (codec.Header, int) {
+		_ = cc.Write(&codec.Header{ServiceMethod: "Sleeper.Sleep", Seq: 1}, d)
+		var h codec.Header
+		var reply int
+		err := cc.ReadHeader(&h)
+		_assert(err == nil, "read header: %v", err)
+		_ = cc.ReadBody(&reply)
+		return h, reply
+	}
+
+	t.Run("option timeout", func(t *testing.T) {
+		addr := startServer(t, NewServer())
+		h, _ := call(dialServer(t, addr, &Option{HandlerTimeout: 100 * time.Millisecond}), time.Second)
+		_assert(strings.Contains(h.Error, "handle timeout"), "expect a timeout error but got %q", h.Error)
+	})
+	t.Run("server default timeout", func(t *testing.T) {
+		addr := startServer(t, &Server{HandlerTimeout: 100 * time.Millisecond})
+		h, _ := call(dialServer(t, addr, &Option{}), time.Second)
+		_assert(strings.Contains(h.Error, "handle timeout"), "expect a timeout error but got %q", h.Error)
+	})
+	t.Run("max timeout caps option", func(t *testing.T) {
+		addr := startServer(t, &Server{MaxHandlerTimeout: 100 * time.Millisecond})
+		h, _ := call(dialServer(t, addr, &Option{HandlerTimeout: time.Minute}), time.Second)
+		_assert(strings.Contains(h.Error, "handle timeout"), "expect a timeout error but got %q", h.Error)
+	})
+	t.Run("within timeout", func(t *testing.T) {
+		addr := startServer(t, &Server{MaxHandlerTimeout: time.Second})
+		h, reply := call(dialServer(t, addr, &Option{}), 10*time.Millisecond)
+		_assert(h.Error == "" && reply == 1, "expect success but got %q", h.Error)
+	})
+}
+
+// TestServer_HandlerTimeoutSingleReply 大量请求超时后，每个Seq只收到一次回复，迟到的结果被丢弃，协程不会泄漏
+func TestServer_HandlerTimeoutSingleReply(t *testing.T) {
+	s := NewServer()
+	addr := startServer(t, s)
+	cc := dialServer(t, addr, &Option{HandlerTimeout: 5 * time.Millisecond})
+
+	// 等待连接建立完成后记录协程数量
+	var h codec.Header
+	var reply int
+	_ = cc.Write(&codec.Header{ServiceMethod: "Sleeper.Sleep", Seq: 0}, time.Duration(0))
+	_assert(cc.ReadHeader(&h) == nil && cc.ReadBody(&reply) == nil, "warm up call")
+	before := runtime.NumGoroutine()
+
+	const n = 100
+	for i := 1; i <= n; i++ {
+		_ = cc.Write(&codec.Header{ServiceMethod: "Sleeper.Sleep", Seq: uint64(i)}, 50*time.Millisecond)
+	}
+	seen := make(map[uint64]bool)
+	for i := 0; i < n; i++ {
+		h = codec.Header{}
+		_assert(cc.ReadHeader(&h) == nil && cc.ReadBody(nil) == nil, "read response %d", i)
+		_assert(!seen[h.Seq], "duplicate response for seq %d", h.Seq)
+		_assert(strings.Contains(h.Error, "handle timeout"), "expect a timeout error but got %q", h.Error)
+		seen[h.Seq] = true
+	}
+
+	svc, _ := s.serviceMap.Load("Sleeper")
+	mType := svc.(*service).method["Sleep"]
+	deadline := time.Now().Add(5 * time.Second)
+	for mType.NumLateReplies() < n && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	_assert(mType.NumLateReplies() == n, "expect %d late replies but got %d", n, mType.NumLateReplies())
+
+	// 迟到的结果不会再发送：紧随其后的请求得到的是它自己的回复
+	_ = cc.Write(&codec.Header{ServiceMethod: "Sleeper.Sleep", Seq: n + 1}, time.Duration(0))
+	h = codec.Header{}
+	_assert(cc.ReadHeader(&h) == nil && h.Seq == n+1 && h.Error == "", "unexpected header: %+v", h)
+	_assert(cc.ReadBody(&reply) == nil && reply == 1, "unexpected reply %d", reply)
+
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	_assert(runtime.NumGoroutine() <= before, "goroutines leaked: %d before, %d after",
+		before, runtime.NumGoroutine())
+}
+
+func TestServer_ContextCanceled(t *testing.T) {
+	t.Run("handler timeout", func(t *testing.T) {
+		addr := startServer(t, NewServer())
+		cc := dialServer(t, addr, &Option{HandlerTimeout: 50 * time.Millisecond})
+		_ = cc.Write(&codec.Header{ServiceMethod: "Sleeper.SleepContext", Seq: 1}, time.Minute)
+		var h codec.Header
+		_assert(cc.ReadHeader(&h) == nil && strings.Contains(h.Error, "handle timeout"),
+			"expect a timeout error but got %q", h.Error)
+		select {
+		case err := <-sleeperCanceled:
+			_assert(errors.Is(err, context.DeadlineExceeded), "expect deadline exceeded but got %v", err)
+		case <-time.After(time.Second):
+			t.Fatal("handler context was not canceled on timeout")
+		}
+	})
+	t.Run("connection reset", func(t *testing.T) {
+		addr := startServer(t, NewServer())
+		conn, err := net.Dial("tcp", addr)
+		_assert(err == nil, "dial error: %v", err)
+		_assert(json.NewEncoder(conn).Encode(&Option{MagicNumber: MagicNumber, CodecType: codec.GobType}) == nil,
+			"write option")
+		cc := codec.NewGobCodec(conn)
+		_ = cc.Write(&codec.Header{ServiceMethod: "Sleeper.SleepContext", Seq: 1}, time.Minute)
+		time.Sleep(50 * time.Millisecond)
+		// SetLinger(0) 让Close发送RST，模拟连接异常断开；正常关闭（FIN）与半关闭无法区分，不会取消请求
+		_ = conn.(*net.TCPConn).SetLinger(0)
+		_ = cc.Close()
+		select {
+		case err := <-sleeperCanceled:
+			_assert(errors.Is(err, context.Canceled), "expect context canceled but got %v", err)
+		case <-time.After(time.Second):
+			t.Fatal("handler context was not canceled when the connection was reset")
+		}
+	})
+}
+
+// TestServer_HalfClose 客户端发送请求之后关闭写入端（如nc -N），服务端仍然处理完请求并回复
+func TestServer_HalfClose(t *testing.T) {
+	for _, s := range []*Server{NewServer(), {}} {
+		addr := startServer(t, s)
+		conn, err := net.Dial("tcp", addr)
+		_assert(err == nil, "dial error: %v", err)
+		_assert(json.NewEncoder(conn).Encode(&Option{MagicNumber: MagicNumber, CodecType: codec.GobType}) == nil,
+			"write option")
+		cc := codec.NewGobCodec(conn)
+		_ = cc.Write(&codec.Header{ServiceMethod: "Sleeper.SleepContext", Seq: 1}, 50*time.Millisecond)
+		_ = cc.Write(&codec.Header{ServiceMethod: "Foo.Sum", Seq: 2}, &Args{Num1: 1, Num2: 2})
+		_assert(conn.(*net.TCPConn).CloseWrite() == nil, "close write")
+
+		replies := make(map[uint64]int)
+		for i := 0; i < 2; i++ {
+			var h codec.Header
+			var reply int
+			_assert(cc.ReadHeader(&h) == nil && h.Error == "", "timeout %v: unexpected header: %+v", s.HandlerTimeout, h)
+			_assert(cc.ReadBody(&reply) == nil, "read body")
+			replies[h.Seq] = reply
+		}
+		_assert(replies[1] == 1 && replies[2] == 3, "unexpected replies: %v", replies)
+		var h codec.Header
+		_assert(cc.ReadHeader(&h) != nil, "server should close the connection after replying")
+		_ = conn.Close()
+	}
+}
+
+func TestServer_CancelFrame(t *testing.T) {
+	// 不设处理超时，取消只通知方法，由方法返回的错误作为回复
+	addr := startServer(t, &Server{})
+	cc := dialServer(t, addr, &Option{})
+	_ = cc.Write(&codec.Header{ServiceMethod: "Sleeper.SleepContext", Seq: 1}, time.Minute)
+	time.Sleep(50 * time.Millisecond)
+	_ = cc.Write(&codec.Header{ServiceMethod: codec.CancelServiceMethod, Seq: 1}, struct{}{})
+	select {
+	case err := <-sleeperCanceled:
+		_assert(errors.Is(err, context.Canceled), "expect context canceled but got %v", err)
+	case <-time.After(time.Second):
+		t.Fatal("handler context was not canceled by the cancel frame")
+	}
+
+	// 取消消息本身没有回复，取消未知的Seq也没有影响，接下来的请求正常处理
+	_ = cc.Write(&codec.Header{ServiceMethod: codec.CancelServiceMethod, Seq: 100}, struct{}{})
+	_ = cc.Write(&codec.Header{ServiceMethod: "Foo.Sum", Seq: 2}, &Args{Num1: 1, Num2: 2})
+	var h codec.Header
+	var reply int
+	_assert(cc.ReadHeader(&h) == nil && h.Seq == 2 && h.Error == "", "unexpected header: %+v", h)
+	_assert(cc.ReadBody(&reply) == nil && reply == 3, "expect 3 but got %d", reply)
+}
+
+func TestServer_UnknownServiceKeepsConnection(t *testing.T) {
+	addr := startServer(t, NewServer())
+	cc := dialServer(t, addr, &Option{})
+	_ = cc.Write(&codec.Header{ServiceMethod: "Nope.Sum", Seq: 1}, &Args{Num1: 1, Num2: 2})
+	_ = cc.Write(&codec.Header{ServiceMethod: "Foo.Sum", Seq: 2}, &Args{Num1: 1, Num2: 2})
+
+	var h codec.Header
+	var reply int
+	_assert(cc.ReadHeader(&h) == nil && h.Seq == 1 && strings.Contains(h.Error, "can't find service"),
+		"unexpected header: %+v", h)
+	_assert(cc.ReadBody(nil) == nil, "discard error body")
+	h = codec.Header{}
+	_assert(cc.ReadHeader(&h) == nil && h.Seq == 2 && h.Error == "", "unexpected header: %+v", h)
+	_assert(cc.ReadBody(&reply) == nil && reply == 3, "expect 3 but got %d", reply)
+}
+
+func TestServer_HeaderTimeout(t *testing.T) {
+	_assert(minTimeout(0, 0) == 0, "no limit")
+	_assert(minTimeout(time.Second, 0) == time.Second, "handler timeout only")
+	_assert(minTimeout(0, time.Second) == time.Second, "header timeout only")
+	_assert(minTimeout(time.Second, time.Minute) == time.Second, "handler timeout is shorter")
+	_assert(minTimeout(time.Minute, time.Second) == time.Second, "header timeout is shorter")
+
+	addr := startServer(t, NewServer())
+	cc := dialServer(t, addr, &Option{HandlerTimeout: time.Minute})
+	_ = cc.Write(&codec.Header{ServiceMethod: "Sleeper.SleepContext", Seq: 1, Timeout: 50 * time.Millisecond},
+		time.Minute)
+	var h codec.Header
+	_assert(cc.ReadHeader(&h) == nil && strings.Contains(h.Error, "handle timeout"),
+		"expect a timeout error but got %q", h.Error)
+	select {
+	case err := <-sleeperCanceled:
+		_assert(errors.Is(err, context.DeadlineExceeded), "expect deadline exceeded but got %v", err)
+	case <-time.After(time.Second):
+		t.Fatal("handler context did not inherit the header timeout")
+	}
+}
+
+type Panicker int
+
+func (p Panicker) Boom(args int, reply *int) error {
+	panic("boom")
+}
+
+func TestServer_PanicRecover(t *testing.T) {
+	for _, policy := range []PanicPolicy{PanicRecover, PanicRecoverWithStack} {
+		s := &Server{PanicPolicy: policy}
+		var p Panicker
+		_assert(s.Register(&p) == nil, "register Panicker")
+		addr := startServer(t, s)
+		cc := dialServer(t, addr, &Option{})
+
+		_ = cc.Write(&codec.Header{ServiceMethod: "Panicker.Boom", Seq: 1}, 1)
+		var h codec.Header
+		_assert(cc.ReadHeader(&h) == nil && h.Seq == 1 && strings.Contains(h.Error, "panic: boom"),
+			"expect a panic error but got %+v", h)
+		_assert(cc.ReadBody(nil) == nil, "discard error body")
+
+		// 连接和其他方法不受影响
+		var reply int
+		_ = cc.Write(&codec.Header{ServiceMethod: "Foo.Sum", Seq: 2}, &Args{Num1: 1, Num2: 2})
+		h = codec.Header{}
+		_assert(cc.ReadHeader(&h) == nil && h.Seq == 2 && h.Error == "", "unexpected header: %+v", h)
+		_assert(cc.ReadBody(&reply) == nil && reply == 3, "expect 3 but got %d", reply)
+
+		svc, _ := s.serviceMap.Load("Panicker")
+		_assert(svc.(*service).method["Boom"].NumPanics() == 1, "expect 1 recovered panic")
+	}
+}
+
+// TestServer_PanicCrash 在子进程中运行服务端，PanicCrash时方法panic会使进程崩溃
+func TestServer_PanicCrash(t *testing.T) {
+	if os.Getenv("RPC_TEST_PANIC_CRASH") == "1" {
+		s := &Server{PanicPolicy: PanicCrash}
+		var p Panicker
+		_ = s.Register(&p)
+		addr := startServer(t, s)
+		cc := dialServer(t, addr, &Option{})
+		_ = cc.Write(&codec.Header{ServiceMethod: "Panicker.Boom", Seq: 1}, 1)
+		var h codec.Header
+		_ = cc.ReadHeader(&h)
+		time.Sleep(time.Second)
+		return
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=^TestServer_PanicCrash$")
+	cmd.Env = append(os.Environ(), "RPC_TEST_PANIC_CRASH=1")
+	out, err := cmd.CombinedOutput()
+	var exitErr *exec.ExitError
+	_assert(errors.As(err, &exitErr) && !exitErr.Success(), "expect the process to crash, got %v", err)
+	_assert(strings.Contains(string(out), "panic: boom"), "expect the panic in the output:\n%s", out)
+}
+
+// Versioned 在gate关闭之前阻塞，返回自己的版本号
+type Versioned struct {
+	version int
+	gate    chan struct{}
+}
+
+func (v *Versioned) Get(args int, reply *int) error {
+	if v.gate != nil {
+		<-v.gate
+	}
+	*reply = v.version
+	return nil
+}
+
+func TestServer_UnregisterAndReplace(t *testing.T) {
+	s := NewServer()
+	old := &Versioned{version: 1, gate: make(chan struct{})}
+	_assert(s.RegisterName("Versioned", old) == nil, "register Versioned")
+	_assert(errors.Is(s.Replace("Missing", &Versioned{}), ErrServiceNotFound), "replace a missing service")
+	_assert(errors.Is(s.Unregister("Missing"), ErrServiceNotFound), "unregister a missing service")
+	addr := startServer(t, s)
+	cc := dialServer(t, addr, &Option{})
+
+	// 第一个请求阻塞在旧的实现上，替换之后的请求由新的实现处理
+	_ = cc.Write(&codec.Header{ServiceMethod: "Versioned.Get", Seq: 1}, 0)
+	time.Sleep(50 * time.Millisecond)
+	_assert(s.Replace("Versioned", &Versioned{version: 2}) == nil, "replace Versioned")
+	_ = cc.Write(&codec.Header{ServiceMethod: "Versioned.Get", Seq: 2}, 0)
+
+	var h codec.Header
+	var reply int
+	_assert(cc.ReadHeader(&h) == nil && h.Seq == 2 && h.Error == "", "unexpected header: %+v", h)
+	_assert(cc.ReadBody(&reply) == nil && reply == 2, "expect the new implementation but got %d", reply)
+
+	close(old.gate)
+	h = codec.Header{}
+	_assert(cc.ReadHeader(&h) == nil && h.Seq == 1 && h.Error == "", "unexpected header: %+v", h)
+	_assert(cc.ReadBody(&reply) == nil && reply == 1, "in-flight call should finish on the old implementation")
+
+	_assert(s.Unregister("Versioned") == nil, "unregister Versioned")
+	_ = cc.Write(&codec.Header{ServiceMethod: "Versioned.Get", Seq: 3}, 0)
+	h = codec.Header{}
+	_assert(cc.ReadHeader(&h) == nil && h.Seq == 3 && strings.HasPrefix(h.Error, ErrServiceNotFound.Error()),
+		"unexpected header: %+v", h)
+	_assert(cc.ReadBody(nil) == nil, "discard error body")
+	_assert(s.RegisterName("Versioned", &Versioned{version: 3}) == nil, "register again after Unregister")
+}
+
+func TestServer_HTTP(t *testing.T) {
+	s := NewServer()
+	var foo Foo
+	_assert(s.Register(&foo) == nil, "register Foo")
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, DefaultRPCPath, nil))
+	_assert(w.Code == http.StatusMethodNotAllowed, "expect 405 but got %d", w.Code)
+
+	l, _ := net.Listen("tcp", ":0")
+	t.Cleanup(func() { _ = l.Close() })
+	go func() { _ = http.Serve(l, s) }()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	_assert(err == nil, "dial error: %v", err)
+	defer func() { _ = conn.Close() }()
+	_, _ = io.WriteString(conn, "CONNECT "+DefaultRPCPath+" HTTP/1.0\n\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: http.MethodConnect})
+	_assert(err == nil && resp.Status == Connected, "unexpected response: %v %v", resp, err)
+
+	_ = json.NewEncoder(conn).Encode(&Option{MagicNumber: MagicNumber, CodecType: codec.GobType})
+	cc := codec.NewGobCodec(conn)
+	_ = cc.Write(&codec.Header{ServiceMethod: "Foo.Sum", Seq: 1}, &Args{Num1: 1, Num2: 2})
+	var h codec.Header
+	var reply int
+	_assert(cc.ReadHeader(&h) == nil && h.Error == "", "unexpected header: %+v", h)
+	_assert(cc.ReadBody(&reply) == nil && reply == 3, "expect 3 but got %d", reply)
+
+	w = httptest.NewRecorder()
+	debugHTTP{s}.ServeHTTP(w, httptest.NewRequest(http.MethodGet, DefaultDebugPath, nil))
+	page := w.Body.String()
+	_assert(strings.Contains(page, "Service Foo") && strings.Contains(page, "Sum(server.Args, *int) error"),
+		"unexpected debug page: %s", page)
+	_assert(strings.Contains(page, "<td align=center>1</td>"), "debug page should show NumCalls: %s", page)
+}
+
+// readHandshake 逐字节读取一行握手应答，json.Decoder 可能多读或者少读行尾的换行符
+func readHandshake(t *testing.T, conn net.Conn) *Handshake {
+	var line []byte
+	b := make([]byte, 1)
+	for {
+		_, err := io.ReadFull(conn, b)
+		_assert(err == nil, "read handshake: %v", err)
+		if b[0] == '\n' {
+			break
+		}
+		line = append(line, b[0])
+	}
+	var ack Handshake
+	_assert(json.Unmarshal(line, &ack) == nil, "decode handshake %q", line)
+	return &ack
+}
+
+func TestServer_Handshake(t *testing.T) {
+	s := NewServer()
+	s.HandlerTimeout = time.Second
+	addr := startServer(t, s)
+
+	handshake := func(opt *Option) (*Handshake, net.Conn) {
+		conn, err := net.Dial("tcp", addr)
+		_assert(err == nil, "dial error: %v", err)
+		t.Cleanup(func() { _ = conn.Close() })
+		_ = json.NewEncoder(conn).Encode(opt)
+		return readHandshake(t, conn), conn
+	}
+
+	ack, _ := handshake(&Option{MagicNumber: MagicNumber, CodecType: codec.GobType, Version: ProtocolVersion})
+	_assert(ack.Error == "" && ack.Version == ProtocolVersion && ack.CodecType == codec.GobType &&
+		ack.HandlerTimeout == time.Second, "unexpected handshake: %+v", ack)
+
+	// 客户端支持更高的版本时，使用服务端支持的版本
+	ack, _ = handshake(&Option{MagicNumber: MagicNumber, CodecType: codec.GobType, Version: ProtocolVersion + 1})
+	_assert(ack.Error == "" && ack.Version == ProtocolVersion, "unexpected handshake: %+v", ack)
+
+	ack, conn := handshake(&Option{MagicNumber: MagicNumber, CodecType: "application/unknown", Version: 1})
+	_assert(strings.Contains(ack.Error, "invalid codec type"), "unexpected handshake: %+v", ack)
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err := conn.Read(make([]byte, 1))
+	_assert(errors.Is(err, io.EOF), "server should close the connection after rejecting, got %v", err)
+
+	ack, _ = handshake(&Option{MagicNumber: 0x1234, Version: 1})
+	_assert(strings.Contains(ack.Error, "invalid magic number"), "unexpected handshake: %+v", ack)
+}
+
+// TestServer_FramedBadBody 分帧之后，无法反序列化的参数只影响这一个请求，连接上后续的请求继续被处理
+func TestServer_FramedBadBody(t *testing.T) {
+	addr := startServer(t, NewServer())
+	conn, err := net.Dial("tcp", addr)
+	_assert(err == nil, "dial error: %v", err)
+	t.Cleanup(func() { _ = conn.Close() })
+	_ = json.NewEncoder(conn).Encode(&Option{MagicNumber: MagicNumber, CodecType: codec.GobType,
+		Version: FramingVersion})
+	ack := readHandshake(t, conn)
+	_assert(ack.Version == FramingVersion, "unexpected handshake %+v", ack)
+	cc, err := ack.NewCodec(conn)
+	_assert(err == nil, "new codec error: %v", err)
+
+	_ = cc.Write(&codec.Header{ServiceMethod: "Foo.Sum", Seq: 1}, "not args")
+	_ = cc.Write(&codec.Header{ServiceMethod: "Foo.Sum", Seq: 2}, &Args{Num1: 1, Num2: 2})
+
+	var h codec.Header
+	var reply int
+	_assert(cc.ReadHeader(&h) == nil && h.Seq == 1 && strings.Contains(h.Error, "invalid body"),
+		"unexpected header: %+v", h)
+	_assert(cc.ReadBody(nil) == nil, "discard error body")
+	h = codec.Header{}
+	_assert(cc.ReadHeader(&h) == nil && h.Seq == 2 && h.Error == "", "unexpected header: %+v", h)
+	_assert(cc.ReadBody(&reply) == nil && reply == 3, "expect 3 but got %d", reply)
+}
+
+// TestServer_MaxRequestSize 客户端没有检查大小时，服务端跳过超过限制的请求并回复错误
+func TestServer_MaxRequestSize(t *testing.T) {
+	s := NewServer()
+	s.MaxRequestSize = 1024
+	addr := startServer(t, s)
+	conn, err := net.Dial("tcp", addr)
+	_assert(err == nil, "dial error: %v", err)
+	t.Cleanup(func() { _ = conn.Close() })
+	_ = json.NewEncoder(conn).Encode(&Option{MagicNumber: MagicNumber, CodecType: codec.GobType,
+		Version: FramingVersion})
+	ack := readHandshake(t, conn)
+	_assert(ack.MaxRequestSize == 1024, "unexpected handshake %+v", ack)
+	cc, _ := ack.NewCodec(conn)
+
+	_ = cc.Write(&codec.Header{ServiceMethod: "Foo.Sum", Seq: 1}, strings.Repeat("x", 4096))
+	_ = cc.Write(&codec.Header{ServiceMethod: "Foo.Sum", Seq: 2}, &Args{Num1: 1, Num2: 2})
+
+	var h codec.Header
+	var reply int
+	_assert(cc.ReadHeader(&h) == nil && h.Seq == 1 && strings.HasPrefix(h.Error, codec.ErrMessageTooLarge.Error()),
+		"unexpected header: %+v", h)
+	_assert(cc.ReadBody(nil) == nil, "discard error body")
+	h = codec.Header{}
+	_assert(cc.ReadHeader(&h) == nil && h.Seq == 2 && h.Error == "", "unexpected header: %+v", h)
+	_assert(cc.ReadBody(&reply) == nil && reply == 3, "expect 3 but got %d", reply)
+}
+
+// TestServer_SizeLimitsRequireFraming 设置了大小限制时，不分帧的连接（版本0和1）会被拒绝，不能绕过限制
+func TestServer_SizeLimitsRequireFraming(t *testing.T) {
+	s := NewServer()
+	s.MaxRequestSize = 1024
+	for _, version := range []int{LegacyVersion, 0, 1} {
+		ack := s.negotiate(&Option{MagicNumber: MagicNumber, CodecType: codec.GobType, Version: version})
+		_assert(strings.Contains(ack.Error, "message size limits require protocol version"),
+			"version %d should be rejected: %+v", version, ack)
+	}
+	ack := s.negotiate(&Option{MagicNumber: MagicNumber, CodecType: codec.GobType, Version: FramingVersion})
+	_assert(ack.Error == "" && ack.MaxRequestSize == 1024, "framed connection should be accepted: %+v", ack)
+
+	// 版本0的客户端收不到应答，连接直接被关闭
+	addr := startServer(t, s)
+	cc := dialServer(t, addr, &Option{})
+	_ = cc.Write(&codec.Header{ServiceMethod: "Foo.Sum", Seq: 1}, strings.Repeat("x", 4096))
+	var h codec.Header
+	_assert(cc.ReadHeader(&h) != nil, "legacy connection should be closed")
+}
+
+// TestServer_AllowedCompressions 客户端请求的压缩算法不在Server.Compressions中时不压缩
+func TestServer_AllowedCompressions(t *testing.T) {
+	s := NewServer()
+	opt := &Option{MagicNumber: MagicNumber, CodecType: codec.GobType, Version: ProtocolVersion,
+		Compression: codec.CompressionGzip}
+	ack := s.negotiate(opt)
+	_assert(ack.Error == "" && ack.Compression == codec.CompressionGzip, "nil allows every compression: %+v", ack)
+
+	s.Compressions = []codec.CompressionType{codec.CompressionSnappy}
+	ack = s.negotiate(opt)
+	_assert(ack.Error == "" && ack.Compression == codec.CompressionNone, "gzip should be refused: %+v", ack)
+	opt.Compression = codec.CompressionSnappy
+	ack = s.negotiate(opt)
+	_assert(ack.Compression == codec.CompressionSnappy, "snappy should be allowed: %+v", ack)
+
+	s.Compressions = []codec.CompressionType{}
+	ack = s.negotiate(opt)
+	_assert(ack.Error == "" && ack.Compression == codec.CompressionNone, "empty list disables compression: %+v", ack)
+}
+
+func TestServer_NegotiateCodec(t *testing.T) {
+	s := NewServer()
+	ack := s.negotiate(&Option{MagicNumber: MagicNumber, Version: ProtocolVersion,
+		CodecType: "application/unknown", CodecTypes: []codec.Type{"application/unknown", codec.JsonType, codec.GobType}})
+	_assert(ack.Error == "" && ack.CodecType == codec.JsonType, "expect the client's preferred codec: %+v", ack)
+	_assert(len(ack.Codecs) >= 2 && ack.Codecs[0] == codec.GobType, "server should advertise its codecs: %v", ack.Codecs)
+
+	ack = s.negotiate(&Option{MagicNumber: MagicNumber, Version: ProtocolVersion,
+		CodecType: "application/unknown", CodecTypes: []codec.Type{"application/unknown"}})
+	_assert(strings.Contains(ack.Error, "no mutually supported codec"), "unexpected handshake: %+v", ack)
+
+	// 没有候选列表时使用CodecType
+	ack = s.negotiate(&Option{MagicNumber: MagicNumber, CodecType: codec.JsonType})
+	_assert(ack.Error == "" && ack.CodecType == codec.JsonType && ack.Version == 0, "unexpected handshake: %+v", ack)
+}
@@ -9,14 +9,25 @@
 	the method's second argument is a pointer.
 	the method has return type error.
 service.go中的代码根据上述的五个条件来实现.
+此外，方法也可以在两个参数之前接收一个context.Context，例如：
+
+	func (t *T) MethodName(ctx context.Context, argType T1, replyType *T2) error
+
+context会在处理超时、连接断开时被取消，耗时较长的方法可以据此提前结束。
+客户端只是关闭写入端（半关闭）时不会取消，已经收到的请求照常处理并回复。
 */
 
 package server
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"go/ast"
 	"log"
 	"reflect"
+	"strings"
+	"sync"
 	"sync/atomic"
 )
 
@@ -27,12 +38,21 @@ methodType 结构体中：
 	ArgType 是第一个参数的类型
 	ReplyType 是第二个参数的类型
 	numCalls 统计方法的调用次数
+	numLateReplies 统计处理超时之后才返回、结果被丢弃的调用次数
+	numPanics 统计发生panic并被恢复的调用次数
+	withContext 方法的第一个参数是否是context.Context
+	argvPool 可以复用时缓存argv，见reusableArgv
 */
 type methodType struct {
-	method    reflect.Method
-	ArgType   reflect.Type
-	ReplyType reflect.Type
-	numCalls  uint64
+	method         reflect.Method
+	ArgType        reflect.Type
+	ReplyType      reflect.Type
+	numCalls       uint64
+	numLateReplies uint64
+	numPanics      uint64
+	withContext    bool
+	reuseArgv      bool
+	argvPool       sync.Pool
 }
 
 func (m *methodType) NumCalls() uint64 {
@@ -40,7 +60,20 @@ func (m *methodType) NumCalls() uint64 {
 	return atomic.LoadUint64(&m.numCalls)
 }
 
+func (m *methodType) NumLateReplies() uint64 {
+	return atomic.LoadUint64(&m.numLateReplies)
+}
+
+func (m *methodType) NumPanics() uint64 {
+	return atomic.LoadUint64(&m.numPanics)
+}
+
 func (m *methodType) newArgv() reflect.Value {
+	if m.reuseArgv {
+		if p := m.argvPool.Get(); p != nil {
+			return reflect.ValueOf(p).Elem()
+		}
+	}
 	var argv reflect.Value
 
 	// argv 可能是指针或者值
@@ -52,6 +85,36 @@ func (m *methodType) newArgv() reflect.Value {
 	return argv
 }
 
+// releaseArgv 方法返回之后归还argv。reply不复用：方法拿到的是指针，可能在返回之后继续持有
+func (m *methodType) releaseArgv(argv reflect.Value) {
+	if !m.reuseArgv || !argv.IsValid() {
+		return
+	}
+	argv.SetZero()
+	m.argvPool.Put(argv.Addr().Interface())
+}
+
+/*
+reusableArgv 参数以值传给方法，并且不包含指针、slice、map、interface等引用类型时，
+方法拿到的是一份完整的拷贝，无法引用argv的内存，调用结束之后argv可以复用。
+string 的内容不可变，解码时总是重新分配，同样可以复用。
+*/
+func reusableArgv(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Ptr, reflect.Slice, reflect.Map, reflect.Chan, reflect.Interface, reflect.Func, reflect.UnsafePointer:
+		return false
+	case reflect.Array:
+		return reusableArgv(t.Elem())
+	case reflect.Struct:
+		for i := 0; i < t.NumField(); i++ {
+			if !reusableArgv(t.Field(i).Type) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
 func (m *methodType) NewReply() reflect.Value {
 	// reply 必须是指针
 	reply := reflect.New(m.ReplyType.Elem())
@@ -67,85 +130,174 @@ func (m *methodType) NewReply() reflect.Value {
 /*
 service 结构体中：
 
-	name 对应反射的结构体的名称，比如 WaitGroup 等等
+	name 对应服务的名称，默认是反射的结构体的名称，比如 WaitGroup 等等，也可以通过 RegisterName 指定
 	typ 对应反射的结构体的类型
 	rcvr 反射的对象本身
 	method 存储映射的结构体的所有符合条件的方法
+	skipped 记录不符合条件而没有注册的方法及原因
 */
 type service struct {
-	name   string
-	typ    reflect.Type
-	rcvr   reflect.Value
-	method map[string]*methodType
+	name    string
+	typ     reflect.Type
+	rcvr    reflect.Value
+	method  map[string]*methodType
+	skipped []SkippedMethod
+}
+
+// SkippedMethod 注册服务时因为不满足条件而被跳过的方法
+type SkippedMethod struct {
+	Name   string // 方法名
+	Reason string // 被跳过的原因
+}
+
+func (m SkippedMethod) String() string {
+	return m.Name + ": " + m.Reason
 }
 
-// newService 针对rcvr实例创建一个service实例，同时注册其满足条件的方法
-func newService(rcvr interface{}) *service {
+/*
+newService 针对rcvr实例创建一个service实例，同时注册其满足条件的方法。
+name 为空时使用rcvr的类型名作为服务名，此时类型必须是导出的。
+没有任何满足条件的方法时返回错误，错误中列出每个方法被跳过的原因。
+*/
+func newService(rcvr interface{}, name string) (*service, error) {
+	if rcvr == nil {
+		return nil, errors.New("rpc server: register nil receiver")
+	}
 	s := new(service)
 	s.rcvr = reflect.ValueOf(rcvr)
-	s.name = reflect.Indirect(s.rcvr).Type().Name()
 	/*
 		reflect.Indirect(s.rcvr)：这个函数用于获取reflect.Value的具体值。
 		如果s.rcvr是一个指针，reflect.Indirect会返回它指向的值；
 		如果它已经是一个值类型，reflect.Indirect直接返回这个值。
 		简言之，这一步确保你得到的是一个值，而不是一个指针。
 	*/
+	typeName := reflect.Indirect(s.rcvr).Type().Name()
 	s.typ = reflect.TypeOf(rcvr)
-	if !ast.IsExported(s.name) {
+	if name == "" {
 		/*
 			ast.IsExported是ast包中的一个函数，用于判断一个标识符（例如变量名、函数名）是否是导出的。
 			根据Go语言的约定，以大写字母开头的标识符是导出的，可以在包外访问；
 			以小写字母开头的标识符是未导出的，仅在包内访问。
 		*/
-		log.Fatalf("rpc server: %s is not a valid service name", s.name)
+		if !ast.IsExported(typeName) {
+			return nil, fmt.Errorf("rpc server: type %s is not exported, use RegisterName to register it", s.typ)
+		}
+		name = typeName
+	}
+	if err := validServiceName(name); err != nil {
+		return nil, err
 	}
+	s.name = name
 	s.registerMethod()
-	return s
+	if len(s.method) == 0 {
+		reasons := make([]string, 0, len(s.skipped))
+		for _, m := range s.skipped {
+			reasons = append(reasons, m.String())
+		}
+		return nil, fmt.Errorf("rpc server: type %s has no exported methods of suitable type [%s]",
+			s.typ, strings.Join(reasons, "; "))
+	}
+	return s, nil
+}
+
+// reservedServiceName 保留的服务名，用于取消、GoAway等控制消息，见codec.CancelServiceMethod
+const reservedServiceName = "_rpc"
+
+// validServiceName 检查服务名是否合法：不能为空，不能包含空白字符，也不能是保留的服务名
+func validServiceName(name string) error {
+	if name == "" || strings.ContainsAny(name, " \t\r\n") {
+		return fmt.Errorf("rpc server: invalid service name %q", name)
+	}
+	if name == reservedServiceName {
+		return fmt.Errorf("rpc server: service name %q is reserved", name)
+	}
+	return nil
 }
 
+var (
+	typeOfError   = reflect.TypeOf((*error)(nil)).Elem()
+	typeOfContext = reflect.TypeOf((*context.Context)(nil)).Elem()
+)
+
 /*
-registerMethod 必须满足下面的两个条件：
+registerMethod 必须满足下面的条件：
 
 	the method has two arguments, both exported (or builtin) types.
+	the method's second argument is a pointer.
 	the method has return type error.
+
+两个参数之前可以有一个可选的context.Context参数。不满足条件的方法记录在skipped中。
 */
 func (s *service) registerMethod() {
 	s.method = make(map[string]*methodType)
+	s.skipped = nil
 	for i := range s.typ.NumMethod() {
 		method := s.typ.Method(i)
 		mType := method.Type
 
-		// 传参为两个，包括自己的话就是三个，返回值只能是一个error
-		if mType.NumIn() != 3 || mType.NumOut() != 1 {
-			continue
-		}
-		if mType.Out(0) != reflect.TypeOf((*error)(nil)).Elem() {
-			continue
-		}
-		argType, replyType := mType.In(1), mType.In(2)
-		if !isExportedOrBuiltinType(argType) || !isExportedOrBuiltinType(replyType) {
+		// 传参为两个，包括自己的话就是三个；接收context时为四个。返回值只能是一个error
+		withContext := mType.NumIn() == 4 && mType.In(1) == typeOfContext
+		if reason := checkMethod(mType, withContext); reason != "" {
+			s.skipped = append(s.skipped, SkippedMethod{Name: method.Name, Reason: reason})
+			log.Printf("rpc server: skip %s.%s: %s\n", s.name, method.Name, reason)
 			continue
 		}
+		argType, replyType := mType.In(mType.NumIn()-2), mType.In(mType.NumIn()-1)
 		s.method[method.Name] = &methodType{
-			method:    method,
-			ArgType:   argType,
-			ReplyType: replyType,
+			method:      method,
+			ArgType:     argType,
+			ReplyType:   replyType,
+			withContext: withContext,
+			reuseArgv:   reusableArgv(argType),
 		}
 		log.Printf("rpc server: register %s.%s\n", s.name, method.Name)
 	}
 }
 
-// isExportedOrBuiltinType 返回argType是否是已导出的或者是内建的
+// checkMethod 检查方法是否满足注册的条件，返回不满足的原因，满足时返回空字符串
+func checkMethod(mType reflect.Type, withContext bool) string {
+	if mType.NumIn() != 3 && !withContext {
+		return fmt.Sprintf("wrong number of arguments: want (args, *reply) or (ctx, args, *reply), got %d",
+			mType.NumIn()-1)
+	}
+	if mType.NumOut() != 1 {
+		return fmt.Sprintf("wrong number of return values: want 1, got %d", mType.NumOut())
+	}
+	if mType.Out(0) != typeOfError {
+		return fmt.Sprintf("return type %s is not error", mType.Out(0))
+	}
+	argType, replyType := mType.In(mType.NumIn()-2), mType.In(mType.NumIn()-1)
+	if !isExportedOrBuiltinType(argType) {
+		return fmt.Sprintf("argument type %s is not exported", argType)
+	}
+	if replyType.Kind() != reflect.Ptr {
+		return fmt.Sprintf("reply type %s is not a pointer", replyType)
+	}
+	if !isExportedOrBuiltinType(replyType) {
+		return fmt.Sprintf("reply type %s is not exported", replyType)
+	}
+	return ""
+}
+
+// isExportedOrBuiltinType 返回argType是否是已导出的或者是内建的，指针类型检查其指向的类型
 func isExportedOrBuiltinType(argType reflect.Type) bool {
+	for argType.Kind() == reflect.Ptr {
+		argType = argType.Elem()
+	}
 	return ast.IsExported(argType.Name()) || argType.PkgPath() == ""
 	// t.PkgPath()：返回定义类型的包路径。如果类型是内建类型或未命名类型，返回空字符串。
 }
 
-// call 通过反射值调用方法
-func (s *service) call(m *methodType, argv, replyv reflect.Value) error {
+// call 通过反射值调用方法，方法接收context时将ctx作为第一个参数传入
+func (s *service) call(ctx context.Context, m *methodType, argv, replyv reflect.Value) error {
 	atomic.AddUint64(&m.numCalls, 1)
 	f := m.method.Func
-	returnValue := f.Call([]reflect.Value{s.rcvr, argv, replyv})
+	var returnValue []reflect.Value
+	if m.withContext {
+		returnValue = f.Call([]reflect.Value{s.rcvr, reflect.ValueOf(ctx), argv, replyv})
+	} else {
+		returnValue = f.Call([]reflect.Value{s.rcvr, argv, replyv})
+	}
 	if err := returnValue[0].Interface(); err != nil {
 		return err.(error)
 	}
@@ -1,9 +1,13 @@
 package server
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
 type Foo int
@@ -31,21 +35,137 @@ func _assert(condition bool, msg string, v ...interface{}) {
 
 func TestNewService(t *testing.T) {
 	var foo Foo
-	s := newService(&foo)
-	_assert(len(s.method) == 1, "wrong service Method, expect 1 but %d", len(s.method))
+	s, _ := newService(&foo, "")
+	_assert(s.name == "Foo" && len(s.method) == 1, "wrong service Method, expect 1 but %d", len(s.method))
 	mType := s.method["Sum"]
 	_assert(mType != nil, "wrong Method, Sum shouldn't nil")
 }
 
 func TestMethodType_Call(t *testing.T) {
 	var foo Foo
-	s := newService(&foo)
+	s, _ := newService(&foo, "")
 	mType := s.method["Sum"]
 
 	argv := mType.newArgv()
 	replyv := mType.NewReply()
 	argv.Set(reflect.ValueOf(Args{Num1: 1, Num2: 1}))
-	err := s.call(mType, argv, replyv)
+	err := s.call(context.Background(), mType, argv, replyv)
 	_assert(err == nil && *replyv.Interface().(*int) == 2 && mType.NumCalls() == 1,
 		"failed to call Foo.Sum")
 }
+
+// TestMethodType_ReuseArgv 值类型且不含引用的参数在调用结束后复用，复用前清零
+func TestMethodType_ReuseArgv(t *testing.T) {
+	_assert(reusableArgv(reflect.TypeOf(Args{})) && reusableArgv(reflect.TypeOf([2]string{})), "Args should be reusable")
+	for _, v := range []interface{}{&Args{}, []int{}, struct{ M map[string]int }{}, time.Time{}, [1]interface{}{}} {
+		_assert(!reusableArgv(reflect.TypeOf(v)), "%T should not be reusable", v)
+	}
+
+	var foo Foo
+	s, _ := newService(&foo, "")
+	mType := s.method["Sum"]
+	argv := mType.newArgv()
+	argv.Set(reflect.ValueOf(Args{Num1: 1, Num2: 2}))
+	p := argv.Addr().Pointer()
+	mType.releaseArgv(argv)
+	// sync.Pool 不保证一定能取回，只检查取回时已经清零
+	if argv = mType.newArgv(); argv.Addr().Pointer() == p {
+		_assert(argv.Interface().(Args) == Args{}, "reused argv should be zeroed: %+v", argv.Interface())
+	}
+}
+
+type Baz int
+
+// 接收context的方法
+func (b Baz) Wait(ctx context.Context, d time.Duration, reply *int) error {
+	select {
+	case <-time.After(d):
+		*reply = 1
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func TestMethodType_CallWithContext(t *testing.T) {
+	var baz Baz
+	s, _ := newService(&baz, "")
+	mType := s.method["Wait"]
+	_assert(mType != nil && mType.withContext, "Wait should be registered as a context-aware method")
+
+	argv := mType.newArgv()
+	replyv := mType.NewReply()
+	argv.Set(reflect.ValueOf(time.Millisecond))
+	err := s.call(context.Background(), mType, argv, replyv)
+	_assert(err == nil && *replyv.Interface().(*int) == 1, "failed to call Baz.Wait")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	argv.Set(reflect.ValueOf(time.Minute))
+	err = s.call(ctx, mType, argv, mType.NewReply())
+	_assert(errors.Is(err, context.Canceled), "expect context canceled but got %v", err)
+}
+
+type unexported int
+
+func (u unexported) Sum(args Args, reply *int) error {
+	return nil
+}
+
+type Mixed int
+
+func (m Mixed) Good(args Args, reply *int) error               { return nil }
+func (m Mixed) NoReply(args Args) error                        { return nil }
+func (m Mixed) TwoResults(args Args, reply *int) (int, error)  { return 0, nil }
+func (m Mixed) NotError(args Args, reply *int) int             { return 0 }
+func (m Mixed) ValueReply(args Args, reply int) error          { return nil }
+func (m Mixed) HiddenArg(args unexported, reply *int) error    { return nil }
+func (m Mixed) HiddenReply(args Args, reply *unexported) error { return nil }
+
+type Empty int
+
+func (e Empty) String() string { return "empty" }
+
+func TestNewService_Errors(t *testing.T) {
+	_, err := newService(nil, "")
+	_assert(err != nil, "expect an error for nil receiver")
+
+	var u unexported
+	_, err = newService(&u, "")
+	_assert(err != nil && strings.Contains(err.Error(), "not exported"), "unexpected error: %v", err)
+	s, err := newService(&u, "Visible")
+	_assert(err == nil && s.name == "Visible" && s.method["Sum"] != nil, "RegisterName should accept %v", err)
+
+	_, err = newService(&u, "_rpc")
+	_assert(err != nil && strings.Contains(err.Error(), "reserved"), "unexpected error: %v", err)
+	_, err = newService(&u, "bad name")
+	_assert(err != nil, "expect an error for invalid name")
+
+	var e Empty
+	_, err = newService(&e, "")
+	_assert(err != nil && strings.Contains(err.Error(), "String: wrong number of arguments"),
+		"unexpected error: %v", err)
+}
+
+func TestNewService_Skipped(t *testing.T) {
+	var m Mixed
+	s, err := newService(&m, "")
+	_assert(err == nil && len(s.method) == 1 && s.method["Good"] != nil, "only Good should be registered")
+
+	reasons := make(map[string]string)
+	for _, skipped := range s.skipped {
+		reasons[skipped.Name] = skipped.Reason
+	}
+	expect := map[string]string{
+		"NoReply":     "wrong number of arguments",
+		"TwoResults":  "wrong number of return values",
+		"NotError":    "is not error",
+		"ValueReply":  "is not a pointer",
+		"HiddenArg":   "argument type server.unexported is not exported",
+		"HiddenReply": "reply type *server.unexported is not exported",
+	}
+	_assert(len(reasons) == len(expect), "unexpected skipped methods: %v", s.skipped)
+	for name, reason := range expect {
+		_assert(strings.Contains(reasons[name], reason), "%s: expect %q but got %q", name, reason, reasons[name])
+	}
+}
@@ -0,0 +1,215 @@
+/*
+shutdown.go 实现了服务端的关闭：
+Shutdown 优雅关闭，停止接受新的连接，通过GoAway消息通知已连接的客户端不要再发送新的请求，
+等待正在处理的请求完成后关闭连接；ctx结束时仍未完成的连接会被强制关闭。
+Close 立即关闭所有的监听和连接。
+*/
+
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"rpc_test/codec"
+	"sync"
+	"time"
+)
+
+// ErrServerClosed 服务端关闭后，新的连接和请求都会收到这个错误
+var ErrServerClosed = errors.New("rpc server: server closed")
+
+// shutdownPollInterval Shutdown 检查连接是否全部关闭的时间间隔
+const shutdownPollInterval = 10 * time.Millisecond
+
+/*
+serverConn 记录一个连接的状态，用于关闭服务端：
+conn 是原始连接，cc 是握手完成后的编解码器，sending 是回复时使用的互斥锁，
+cancel 取消连接上所有请求的context，只在写入失败和服务端关闭连接时调用
+active 是正在处理的请求数量，draining 表示连接正在关闭，不再接受新的请求，goAway 表示GoAway消息已经发送
+*/
+type serverConn struct {
+	conn    io.Closer
+	mu      sync.Mutex
+	cc      codec.Codec
+	sending *sync.Mutex
+	cancel  context.CancelFunc
+	active  int
+	peer    *Peer // 客户端信息，交给连接上每个请求的context
+	// draining 并且goAway之后，连接空闲时立即关闭
+	draining bool
+	goAway   bool
+}
+
+// setCodec 握手完成，连接开始处理请求
+func (sc *serverConn) setCodec(cc codec.Codec, sending *sync.Mutex, cancel context.CancelFunc) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	sc.cc = cc
+	sc.sending = sending
+	sc.cancel = cancel
+}
+
+// abort 取消连接上所有正在处理的请求并关闭连接，回复已经无法送达
+func (sc *serverConn) abort() {
+	sc.mu.Lock()
+	cancel := sc.cancel
+	sc.mu.Unlock()
+	if cancel != nil {
+		cancel()
+	}
+	_ = sc.conn.Close()
+}
+
+// startRequest 开始处理一个请求，连接正在关闭时返回false
+func (sc *serverConn) startRequest() bool {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if sc.draining {
+		return false
+	}
+	sc.active++
+	return true
+}
+
+// finishRequest 请求处理结束，连接正在关闭并且已经空闲时关闭连接
+func (sc *serverConn) finishRequest() {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	sc.active--
+	if sc.goAway && sc.active == 0 {
+		_ = sc.conn.Close()
+	}
+}
+
+/*
+drain 发送GoAway消息通知客户端不要再发送新的请求，连接空闲时直接关闭。
+写入GoAway时不持有sc.mu：不读取数据的客户端会让写入一直阻塞，此时由Shutdown超时之后关闭连接来结束
+*/
+func (sc *serverConn) drain() {
+	sc.mu.Lock()
+	if sc.draining {
+		sc.mu.Unlock()
+		return
+	}
+	sc.draining = true
+	cc, sending := sc.cc, sc.sending
+	sc.mu.Unlock()
+
+	if cc != nil {
+		sending.Lock()
+		h := &codec.Header{ServiceMethod: codec.GoAwayServiceMethod, Error: ErrServerClosed.Error()}
+		_ = cc.Write(h, invalidRequest)
+		sending.Unlock()
+	}
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	sc.goAway = true
+	if sc.active == 0 {
+		_ = sc.conn.Close()
+	}
+}
+
+// trackListener 记录或者移除监听，服务端已经关闭时返回false
+func (server *Server) trackListener(lis net.Listener, add bool) bool {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if !add {
+		delete(server.listeners, lis)
+		return true
+	}
+	if server.inShutdown {
+		return false
+	}
+	if server.listeners == nil {
+		server.listeners = make(map[net.Listener]struct{})
+	}
+	server.listeners[lis] = struct{}{}
+	return true
+}
+
+// trackConn 记录或者移除连接，服务端已经关闭时返回false
+func (server *Server) trackConn(sc *serverConn, add bool) bool {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if !add {
+		delete(server.conns, sc)
+		return true
+	}
+	if server.inShutdown {
+		return false
+	}
+	if server.conns == nil {
+		server.conns = make(map[*serverConn]struct{})
+	}
+	server.conns[sc] = struct{}{}
+	return true
+}
+
+// closeListenersLocked 关闭所有的监听，调用方需持有server.mu
+func (server *Server) closeListenersLocked() error {
+	var err error
+	for lis := range server.listeners {
+		if cerr := lis.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// isShutdown 服务端是否已经开始关闭
+func (server *Server) isShutdown() bool {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	return server.inShutdown
+}
+
+/*
+Shutdown 优雅地关闭服务端：关闭所有的监听，向每个连接发送GoAway消息，
+然后等待正在处理的请求完成、连接全部关闭。ctx结束时强制关闭剩余的连接并返回ctx.Err()。
+GoAway 在各自的协程中发送，某个客户端不读取数据时也不会阻塞Shutdown。
+*/
+func (server *Server) Shutdown(ctx context.Context) error {
+	server.mu.Lock()
+	server.inShutdown = true
+	err := server.closeListenersLocked()
+	conns := make([]*serverConn, 0, len(server.conns))
+	for sc := range server.conns {
+		conns = append(conns, sc)
+	}
+	server.mu.Unlock()
+
+	for _, sc := range conns {
+		go sc.drain()
+	}
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		server.mu.Lock()
+		n := len(server.conns)
+		server.mu.Unlock()
+		if n == 0 {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			_ = server.Close()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Close 立即关闭所有的监听和连接，正在处理的请求的context会被取消
+func (server *Server) Close() error {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	server.inShutdown = true
+	err := server.closeListenersLocked()
+	for sc := range server.conns {
+		sc.abort()
+	}
+	return err
+}
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"rpc_test/codec"
+	"testing"
+	"time"
+)
+
+// readGoAway 读取服务端关闭时发送的GoAway消息
+func readGoAway(cc codec.Codec) {
+	var h codec.Header
+	_assert(cc.ReadHeader(&h) == nil && h.ServiceMethod == codec.GoAwayServiceMethod && h.Seq == 0,
+		"expect a GoAway message but got %+v", h)
+	_assert(cc.ReadBody(nil) == nil, "discard GoAway body")
+}
+
+func TestServer_Shutdown(t *testing.T) {
+	s := NewServer()
+	addr := startServer(t, s)
+	cc := dialServer(t, addr, &Option{})
+	_ = cc.Write(&codec.Header{ServiceMethod: "Sleeper.Sleep", Seq: 1}, 200*time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- s.Shutdown(context.Background()) }()
+
+	readGoAway(cc)
+	// GoAway之后到达的请求会被拒绝，已经在处理的请求正常完成
+	_ = cc.Write(&codec.Header{ServiceMethod: "Foo.Sum", Seq: 2}, &Args{Num1: 1, Num2: 2})
+	var h codec.Header
+	_assert(cc.ReadHeader(&h) == nil && h.Seq == 2 && h.Error == ErrServerClosed.Error(),
+		"expect server closed error but got %+v", h)
+	_assert(cc.ReadBody(nil) == nil, "discard error body")
+
+	var reply int
+	h = codec.Header{}
+	_assert(cc.ReadHeader(&h) == nil && h.Seq == 1 && h.Error == "", "unexpected header: %+v", h)
+	_assert(cc.ReadBody(&reply) == nil && reply == 1, "in-flight request should finish")
+
+	select {
+	case err := <-shutdown:
+		_assert(err == nil, "shutdown error: %v", err)
+	case <-time.After(time.Second):
+		t.Fatal("shutdown did not return after in-flight requests finished")
+	}
+	_assert(cc.ReadHeader(&h) != nil, "connection should be closed")
+	_, err := net.Dial("tcp", addr)
+	_assert(err != nil, "listener should be closed")
+}
+
+func TestServer_ShutdownTimeout(t *testing.T) {
+	s := NewServer()
+	addr := startServer(t, s)
+	cc := dialServer(t, addr, &Option{})
+	_ = cc.Write(&codec.Header{ServiceMethod: "Sleeper.SleepContext", Seq: 1}, time.Minute)
+	time.Sleep(50 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err := s.Shutdown(ctx)
+	_assert(errors.Is(err, context.DeadlineExceeded), "expect deadline exceeded but got %v", err)
+	select {
+	case err := <-sleeperCanceled:
+		_assert(errors.Is(err, context.Canceled), "expect context canceled but got %v", err)
+	case <-time.After(time.Second):
+		t.Fatal("in-flight handler was not canceled after the forced close")
+	}
+}
+
+// TestServer_ShutdownStalledClient 客户端不读取数据时GoAway的写入会阻塞，Shutdown 仍然在ctx结束时返回
+func TestServer_ShutdownStalledClient(t *testing.T) {
+	s := NewServer()
+	client, conn := net.Pipe() // 同步的管道，没有缓冲区，客户端不读取时服务端的写入一直阻塞
+	t.Cleanup(func() { _ = client.Close() })
+	go s.ServerConn(conn)
+	_ = json.NewEncoder(client).Encode(&Option{MagicNumber: MagicNumber, CodecType: codec.GobType})
+	time.Sleep(50 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- s.Shutdown(ctx) }()
+	select {
+	case err := <-shutdown:
+		_assert(errors.Is(err, context.DeadlineExceeded), "expect deadline exceeded but got %v", err)
+	case <-time.After(time.Second):
+		t.Fatal("shutdown blocked on a client that never reads")
+	}
+	// 强制关闭之后，阻塞的写入返回，客户端读到连接关闭
+	_ = client.SetReadDeadline(time.Now().Add(time.Second))
+	_, err := io.ReadAll(client)
+	_assert(err == nil, "expect the connection to be closed but got %v", err)
+}
+
+func TestServer_Close(t *testing.T) {
+	s := NewServer()
+	addr := startServer(t, s)
+	cc := dialServer(t, addr, &Option{})
+	_ = cc.Write(&codec.Header{ServiceMethod: "Sleeper.Sleep", Seq: 1}, time.Second)
+	time.Sleep(50 * time.Millisecond)
+
+	_assert(s.Close() == nil, "close server")
+	var h codec.Header
+	_assert(cc.ReadHeader(&h) != nil, "connection should be closed")
+
+	// 关闭之后新的连接会被立即关闭
+	client, server := net.Pipe()
+	go s.ServerConn(server)
+	_, err := client.Read(make([]byte, 1))
+	_assert(err != nil, "connection should be rejected after Close")
+}
@@ -5,6 +5,7 @@
 package xclient
 
 import (
+	"crypto/tls"
 	"log"
 	"net/http"
 	"strings"
@@ -16,17 +17,24 @@ RegistryDiscovery 嵌套了 MultiServersDiscovery，很多能力可以复用。
 registry 即注册中心的地址
 timeout 服务列表的过期时间
 lastUpdate 是代表最后从注册中心更新服务列表的时间，默认10s过期，即10s之后，需要从注册中心更新新的列表。
+httpClient 从注册中心获取服务列表的HTTP客户端
 */
 type RegistryDiscovery struct {
 	*MultiServerDiscovery
 	registry   string
 	timeout    time.Duration
 	lastUpdate time.Time
+	httpClient *http.Client
 }
 
 const defaultUpdateTimeout = time.Second * 10
 
 func NewRegistryDiscovery(registryAddr string, timeout time.Duration) *RegistryDiscovery {
+	return NewRegistryDiscoveryTLS(registryAddr, timeout, nil)
+}
+
+// NewRegistryDiscoveryTLS 注册中心使用HTTPS时，通过config验证注册中心的证书，config为nil时使用默认配置
+func NewRegistryDiscoveryTLS(registryAddr string, timeout time.Duration, config *tls.Config) *RegistryDiscovery {
 	if timeout == 0 {
 		timeout = defaultUpdateTimeout
 	}
@@ -34,6 +42,12 @@ func NewRegistryDiscovery(registryAddr string, timeout time.Duration) *RegistryD
 		MultiServerDiscovery: NewMultiServerDiscovery(make([]string, 0)),
 		registry:             registryAddr,
 		timeout:              timeout,
+		httpClient:           http.DefaultClient,
+	}
+	if config != nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = config
+		d.httpClient = &http.Client{Transport: transport}
 	}
 	return d
 }
@@ -56,11 +70,12 @@ func (r *RegistryDiscovery) Refresh() error {
 	}
 
 	log.Println("rpc registry: refresh servers from registry: ", r.registry)
-	resp, err := http.Get(r.registry)
+	resp, err := r.httpClient.Get(r.registry)
 	if err != nil {
 		log.Println("rpc registry refresh error: ", err)
 		return err
 	}
+	_ = resp.Body.Close()
 	servers := strings.Split(resp.Header.Get("X-rpc-Server"), ",")
 	r.servers = make([]string, 0, len(servers))
 	for _, server := range servers {
@@ -0,0 +1,36 @@
+package xclient
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"rpc_test/registry"
+	"testing"
+	"time"
+)
+
+func _assert(condition bool, msg string, v ...interface{}) {
+	if !condition {
+		panic(fmt.Sprintf("assertion failed: "+msg, v...))
+	}
+}
+
+// TestRegistryDiscovery_HTTPS 注册中心使用自签名证书的HTTPS，服务端发送心跳、客户端获取服务列表都需要信任它
+func TestRegistryDiscovery_HTTPS(t *testing.T) {
+	r := registry.NewRegistry(time.Minute)
+	ts := httptest.NewTLSServer(http.HandlerFunc(r.ServerHTTP))
+	defer ts.Close()
+	config := ts.Client().Transport.(*http.Transport).TLSClientConfig
+
+	registry.HeartbeatTLS(ts.URL, "tls@127.0.0.1:8443", time.Hour, config)
+
+	d := NewRegistryDiscoveryTLS(ts.URL, 0, config)
+	servers, err := d.GetAll()
+	_assert(err == nil, "refresh error: %v", err)
+	_assert(len(servers) == 1 && servers[0] == "tls@127.0.0.1:8443", "unexpected servers: %v", servers)
+
+	untrusted := NewRegistryDiscoveryTLS(ts.URL, 0, &tls.Config{})
+	_, err = untrusted.GetAll()
+	_assert(err != nil, "expect a certificate error")
+}
@@ -14,11 +14,12 @@ import (
 )
 
 type XClient struct {
-	d       Discovery
-	mode    SelectMode
-	opt     *server.Option
-	mu      sync.Mutex
-	clients map[string]*client.Client
+	d            Discovery
+	mode         SelectMode
+	opt          *server.Option
+	mu           sync.Mutex
+	clients      map[string]*client.Client
+	interceptors []client.Interceptor // 通过Use追加，在opt.Interceptors之后应用于每一个Client
 }
 
 var _ io.Closer = (*XClient)(nil)
@@ -36,7 +37,8 @@ func (xc *XClient) Close() error {
 
 /*
 NewXClient 的构造函数需要传入三个参数，服务发现实例Discovery、负载均衡模式SelectMode
-以及协议选项Option。使用clients 保存创建成功的 Client 实例，
+以及协议选项Option。使用clients 保存创建成功的 Client 实例。
+Option.Interceptors 中的客户端拦截器会配置到每一个Client上，从第一次调用开始生效。
 */
 func NewXClient(d Discovery, mode SelectMode, opt *server.Option) *XClient {
 	return &XClient{
@@ -47,9 +49,20 @@ func NewXClient(d Discovery, mode SelectMode, opt *server.Option) *XClient {
 	}
 }
 
+// Use 追加客户端拦截器，应用于 Call 和 Broadcast 发往每个服务实例的调用，与Client.Use 一样应该在发起第一次调用之前调用
+func (xc *XClient) Use(interceptors ...client.Interceptor) {
+	xc.mu.Lock()
+	defer xc.mu.Unlock()
+	xc.interceptors = append(xc.interceptors[:len(xc.interceptors):len(xc.interceptors)], interceptors...)
+	for _, clt := range xc.clients {
+		clt.Use(interceptors...)
+	}
+}
+
 /*
 dial 检查xc.clients是否有缓存的Client，如果有，检查是否是可用状态，如果是则返回缓存的 Client;
 如果不可用，则从缓存中删除。如果没有返回缓存的Client，则说明需要创建新的Client，缓存并返回。
+rpcAddr 的格式为 protocol@addr，由client.XDial根据协议建立连接。
 */
 func (xc *XClient) dial(rpcAddr string) (*client.Client, error) {
 	xc.mu.Lock()
@@ -63,10 +76,13 @@ func (xc *XClient) dial(rpcAddr string) (*client.Client, error) {
 	}
 	if clt == nil {
 		var err error
-		clt, err = client.Dial("tcp", rpcAddr, xc.opt)
+		clt, err = client.XDial(rpcAddr, xc.opt)
 		if err != nil {
 			return nil, err
 		}
+		if len(xc.interceptors) > 0 {
+			clt.Use(xc.interceptors...)
+		}
 		xc.clients[rpcAddr] = clt
 	}
 	return clt, nil
@@ -107,6 +123,7 @@ func (xc *XClient) Broadcast(ctx context.Context, serviceMethod string,
 	var e error
 	replyDone := reply == nil // if reply is nil, don't need to set value
 	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
 	for _, rpcAddr := range servers {
 		wg.Add(1)
@@ -0,0 +1,67 @@
+package xclient
+
+import (
+	"context"
+	"net"
+	"rpc_test/client"
+	"rpc_test/server"
+	"sync/atomic"
+	"testing"
+)
+
+type Echo int
+
+func (e Echo) Double(args int, reply *int) error {
+	*reply = args * 2
+	return nil
+}
+
+// startEchoServers 启动n个注册了Echo的服务端，返回它们的地址
+func startEchoServers(t *testing.T, n int) []string {
+	var addrs []string
+	for i := 0; i < n; i++ {
+		s := server.NewServer()
+		var e Echo
+		_ = s.Register(&e)
+		l, _ := net.Listen("tcp", "127.0.0.1:0")
+		t.Cleanup(func() { _ = l.Close() })
+		go s.Accept(l)
+		addrs = append(addrs, "tcp@"+l.Addr().String())
+	}
+	return addrs
+}
+
+// TestXClient_OptionInterceptors Option中配置的拦截器从第一次调用开始应用于每一个服务实例
+func TestXClient_OptionInterceptors(t *testing.T) {
+	var calls int32
+	opt := &server.Option{Interceptors: []client.Interceptor{
+		func(ctx context.Context, serviceMethod string, args, reply interface{}, invoker client.Invoker) error {
+			atomic.AddInt32(&calls, 1)
+			return invoker(ctx, serviceMethod, args, reply)
+		},
+	}}
+	xc := NewXClient(NewMultiServerDiscovery(startEchoServers(t, 2)), RoundRobinSelect, opt)
+	defer func() { _ = xc.Close() }()
+
+	var reply int
+	_assert(xc.Call(context.Background(), "Echo.Double", 1, &reply) == nil && reply == 2, "call")
+	_assert(xc.Broadcast(context.Background(), "Echo.Double", 3, &reply) == nil && reply == 6, "broadcast")
+	_assert(atomic.LoadInt32(&calls) == 3, "expect 3 intercepted calls but got %d", calls)
+}
+
+// TestXClient_Use 拦截器应用于Call和Broadcast发往每个服务实例的调用，包括Use之前已经建立的连接
+func TestXClient_Use(t *testing.T) {
+	xc := NewXClient(NewMultiServerDiscovery(startEchoServers(t, 2)), RoundRobinSelect, nil)
+	defer func() { _ = xc.Close() }()
+
+	var reply int
+	_assert(xc.Call(context.Background(), "Echo.Double", 1, &reply) == nil && reply == 2, "call before Use")
+	var calls int32
+	xc.Use(func(ctx context.Context, serviceMethod string, args, reply interface{}, invoker client.Invoker) error {
+		atomic.AddInt32(&calls, 1)
+		return invoker(ctx, serviceMethod, args, reply)
+	})
+	_assert(xc.Call(context.Background(), "Echo.Double", 2, &reply) == nil && reply == 4, "call after Use")
+	_assert(xc.Broadcast(context.Background(), "Echo.Double", 3, &reply) == nil && reply == 6, "broadcast")
+	_assert(atomic.LoadInt32(&calls) == 3, "expect 3 intercepted calls but got %d", calls)
+}